@@ -0,0 +1,330 @@
+// Command mockidp is an OpenID Connect identity provider for trying out logging into the
+// dashboard locally. It logs in anyone as whoever they say they are, so never use it for
+// anything else.
+//
+//	go run ./cmd/mockidp -addr :9999
+//
+// and in the server config:
+//
+//	"oidc": {"issuer": "http://localhost:9999", "client_id": "quick-image-server"}
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keyId     = "mockidp"
+	codeAge   = time.Minute
+	tokenAge  = time.Hour
+	codeBytes = 24
+)
+
+// authCode is a code the client can exchange for an ID token once.
+type authCode struct {
+	clientId      string
+	redirectUri   string
+	nonce         string
+	challenge     string // the PKCE code challenge, or empty if the client didn't send one
+	userName      string
+	email         string
+	emailVerified bool
+	expiresAt     time.Time
+}
+
+type provider struct {
+	issuer   string
+	clientId string
+	key      *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authCode
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!doctype html>
+<html lang="en">
+<head><meta charset="UTF-8"><title>Mock Identity Provider</title></head>
+<body>
+<h1>Mock Identity Provider</h1>
+<p>Log into {{.ClientId}} as anyone.</p>
+<form method="POST">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<p><label>User name <input name="username" required autofocus></label></p>
+<p><label>Email <input name="email" type="email"></label></p>
+<p><label><input name="email_verified" type="checkbox" value="true" checked> Email is verified</label></p>
+<p><button>Log In</button> <button name="deny" value="true">Deny</button></p>
+</form>
+</body>
+</html>`))
+
+func main() {
+	addr := flag.String("addr", "localhost:9999", "address to listen on")
+	issuer := flag.String("issuer", "", "issuer url, defaults to http://<addr>")
+	clientId := flag.String("client-id", "quick-image-server", "the only client id that's accepted")
+	flag.Parse()
+
+	if *issuer == "" {
+		*issuer = "http://" + *addr
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("Failed to generate signing key: %s", err)
+	}
+
+	p := &provider{
+		issuer:   strings.TrimSuffix(*issuer, "/"),
+		clientId: *clientId,
+		key:      key,
+		codes:    make(map[string]authCode),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("GET /jwks", p.handleKeys)
+	mux.HandleFunc("/authorize", p.handleAuthorize)
+	mux.HandleFunc("POST /token", p.handleToken)
+
+	log.Printf("Mock identity provider %s listening on %s", p.issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// tokenError writes an error response of the token endpoint, as in RFC 6749 section 5.2.
+func tokenError(w http.ResponseWriter, code string, description string) {
+	log.Printf("Refused token request: %s: %s", code, description)
+	writeJson(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func randomString() string {
+	b := make([]byte, codeBytes)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (p *provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]any{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"claims_supported":                      []string{"sub", "preferred_username", "name", "email", "email_verified"},
+	})
+}
+
+func (p *provider) handleKeys(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+	writeJson(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": keyId,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// handleAuthorize shows a form to log in as anyone, and sends the browser back to the
+// client with a code when it's submitted.
+func (p *provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request.", http.StatusBadRequest)
+		return
+	}
+
+	// Errors about the client itself can't be sent back to it.
+	if r.Form.Get("client_id") != p.clientId {
+		http.Error(w, "Unknown client_id.", http.StatusBadRequest)
+		return
+	}
+	redirectUri, err := url.Parse(r.Form.Get("redirect_uri"))
+	if err != nil || !redirectUri.IsAbs() {
+		http.Error(w, "Invalid redirect_uri.", http.StatusBadRequest)
+		return
+	}
+
+	back := func(params url.Values) {
+		params.Set("state", r.Form.Get("state"))
+		redirectUri.RawQuery = params.Encode()
+		http.Redirect(w, r, redirectUri.String(), http.StatusFound)
+	}
+
+	if r.Form.Get("response_type") != "code" {
+		back(url.Values{"error": {"unsupported_response_type"}})
+		return
+	}
+	if !strings.Contains(" "+r.Form.Get("scope")+" ", " openid ") {
+		back(url.Values{"error": {"invalid_scope"}, "error_description": {"The openid scope is required."}})
+		return
+	}
+	if method := r.Form.Get("code_challenge_method"); r.Form.Get("code_challenge") != "" && method != "S256" {
+		back(url.Values{"error": {"invalid_request"}, "error_description": {"Only the S256 code challenge method is supported."}})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		params := make(map[string]string)
+		for _, name := range []string{"client_id", "redirect_uri", "response_type", "scope", "state", "nonce", "code_challenge", "code_challenge_method"} {
+			params[name] = r.Form.Get(name)
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = loginPage.Execute(w, map[string]any{"ClientId": p.clientId, "Params": params})
+		return
+	}
+
+	if r.PostForm.Get("deny") != "" {
+		back(url.Values{"error": {"access_denied"}})
+		return
+	}
+
+	userName := strings.TrimSpace(r.PostForm.Get("username"))
+	if userName == "" {
+		http.Error(w, "Enter a user name.", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	p.mu.Lock()
+	p.codes[code] = authCode{
+		clientId:      p.clientId,
+		redirectUri:   r.Form.Get("redirect_uri"),
+		nonce:         r.Form.Get("nonce"),
+		challenge:     r.Form.Get("code_challenge"),
+		userName:      userName,
+		email:         r.PostForm.Get("email"),
+		emailVerified: r.PostForm.Get("email_verified") == "true",
+		expiresAt:     time.Now().Add(codeAge),
+	}
+	p.mu.Unlock()
+
+	log.Printf("Logged in %s", userName)
+	back(url.Values{"code": {code}})
+}
+
+// handleToken exchanges a code for an ID token.
+func (p *provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request", "Invalid form.")
+		return
+	}
+
+	clientId := r.PostForm.Get("client_id")
+	if user, _, ok := r.BasicAuth(); ok {
+		clientId = user // confidential clients send it this way, the secret isn't checked
+	}
+	if clientId != p.clientId {
+		tokenError(w, "invalid_client", "Unknown client.")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type", "Only authorization_code is supported.")
+		return
+	}
+
+	// Codes can only be used once, even if using them fails.
+	p.mu.Lock()
+	code, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	if !ok || time.Now().After(code.expiresAt) {
+		tokenError(w, "invalid_grant", "Unknown or expired code.")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != code.redirectUri {
+		tokenError(w, "invalid_grant", "The redirect_uri doesn't match.")
+		return
+	}
+	if code.challenge != "" {
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(code.challenge)) != 1 {
+			tokenError(w, "invalid_grant", "The code_verifier doesn't match the code_challenge.")
+			return
+		}
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":                p.issuer,
+		"sub":                "mock-" + code.userName,
+		"aud":                code.clientId,
+		"iat":                now.Unix(),
+		"exp":                now.Add(tokenAge).Unix(),
+		"preferred_username": code.userName,
+		"name":               code.userName,
+	}
+	if code.nonce != "" {
+		claims["nonce"] = code.nonce
+	}
+	if code.email != "" {
+		claims["email"] = code.email
+		claims["email_verified"] = code.emailVerified
+	}
+
+	idToken, err := p.sign(claims)
+	if err != nil {
+		log.Printf("Failed to sign ID token: %s", err)
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]any{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   int(tokenAge.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+// sign creates a JWT of the claims, signed with RS256.
+func (p *provider) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyId})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
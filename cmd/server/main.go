@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"github.com/jmoiron/sqlx"
 	"github.com/liondadev/quick-image-server/config"
 	"github.com/liondadev/quick-image-server/server"
+	"github.com/liondadev/quick-image-server/server/storage"
 	"log"
 	"os"
+	"time"
 
 	_ "github.com/glebarez/go-sqlite"
 )
@@ -44,7 +48,19 @@ func main() {
 	}
 	defer db.Close()
 
-	svr := server.New(cfg, db)
+	// Managing the database schema doesn't need anything else.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(db, os.Args[2:])
+		return
+	}
+
+	store, err := storage.FromConfig(cfg)
+	if err != nil {
+		log.Fatalf("Failed to setup storage backend: %s", err.Error())
+		return
+	}
+
+	svr := server.New(cfg, db, store)
 	err = svr.SetupHTTP()
 	if err != nil {
 		log.Panicf("setup http: %s", err.Error())
@@ -57,5 +73,39 @@ func main() {
 		return
 	}
 
+	if err := svr.ImportConfigUsers(context.Background()); err != nil {
+		log.Fatalf("Failed to import the users from the config: %s", err.Error())
+	}
+
+	if err := svr.LoadBubbleMasks(); err != nil {
+		log.Fatalf("Failed to load bubble masks: %s", err.Error())
+	}
+
+	// Maintenance commands, instead of running the server.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "dedupe":
+			if err := svr.DedupeLegacyUploads(context.Background(), log.Printf); err != nil {
+				log.Fatalf("Failed to deduplicate uploads: %s", err.Error())
+			}
+		case "users":
+			runUsersCommand(svr, os.Args[2:])
+		case "sweep-derivatives":
+			flags := flag.NewFlagSet("sweep-derivatives", flag.ExitOnError)
+			dryRun := flags.Bool("dry-run", false, "only log what would be deleted")
+			_ = flags.Parse(os.Args[2:])
+
+			if err := svr.SweepDerivatives(context.Background(), *dryRun, log.Printf); err != nil {
+				log.Fatalf("Failed to sweep derivatives: %s", err.Error())
+			}
+		default:
+			log.Fatalf("Unknown command '%s'. The commands are 'migrate', 'dedupe', 'sweep-derivatives' and 'users'.", os.Args[1])
+		}
+
+		return
+	}
+
+	svr.StartReaper(context.Background(), time.Minute)
+
 	log.Panicln(svr.Run(":8080"))
 }
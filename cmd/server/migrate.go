@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/liondadev/quick-image-server/server/migrations"
+)
+
+const migrateUsage = `usage: server migrate <command>
+
+commands:
+  status       show which migrations have been applied
+  up           apply every migration that hasn't been applied yet
+  down         revert the newest applied migration
+  to <version> apply or revert migrations until the database is at version`
+
+// runMigrateCommand handles the "migrate" command, which manages the database schema.
+func runMigrateCommand(db *sqlx.DB, args []string) {
+	if len(args) == 0 {
+		log.Fatalln(migrateUsage)
+	}
+
+	switch args[0] {
+	case "status":
+		statuses, err := migrations.List(db)
+		if err != nil {
+			log.Fatalf("Failed to get migration status: %s", err.Error())
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, st := range statuses {
+			applied := "no"
+			if st.Applied {
+				applied = st.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+
+			fmt.Fprintf(tw, "%03d\t%s\t%s\n", st.Version, st.Name, applied)
+		}
+		_ = tw.Flush()
+	case "up":
+		migrate(db, migrations.Latest())
+	case "down":
+		current, err := migrations.Current(db)
+		if err != nil {
+			log.Fatalf("Failed to get the current migration: %s", err.Error())
+		}
+
+		// Find the version right before the current one.
+		target := 0
+		for _, m := range migrations.All {
+			if m.Version < current {
+				target = m.Version
+			}
+		}
+
+		migrate(db, target)
+	case "to":
+		if len(args) < 2 {
+			log.Fatalln(migrateUsage)
+		}
+
+		target, err := strconv.Atoi(args[1])
+		if err != nil {
+			log.Fatalf("Invalid version '%s'.", args[1])
+		}
+
+		migrate(db, target)
+	default:
+		log.Fatalln(migrateUsage)
+	}
+}
+
+func migrate(db *sqlx.DB, target int) {
+	if err := migrations.Migrate(db, target, log.Printf); err != nil {
+		log.Fatalf("Failed to migrate: %s", err.Error())
+	}
+
+	log.Printf("Database is at version %d.", target)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/liondadev/quick-image-server/server"
+)
+
+const usersUsage = `usage: server users <command>
+
+commands:
+  list                     show every user
+  add <name>               add a user and print an API key for them
+  remove <name>            remove a user and revoke their API keys, their uploads are kept
+  keys <name>              show the API keys of a user
+  add-key [-scopes list] [-expires duration] <name> [label]
+                           create another API key for a user and print it. It has every
+                           scope unless -scopes (like "upload,read-own") says otherwise
+  revoke-key <name> <id>   revoke an API key of a user
+  link-oidc <name> <sub>   let the identity provider account with the subject (sub claim)
+                           log in as a user
+  unlink-oidc <name>       stop every identity provider account from logging in as a user`
+
+// runUsersCommand handles the "users" command, which manages users and their API keys.
+func runUsersCommand(svr *server.Server, args []string) {
+	if len(args) == 0 {
+		log.Fatalln(usersUsage)
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "list":
+		users, err := svr.ListUsers(ctx)
+		if err != nil {
+			log.Fatalf("Failed to list users: %s", err.Error())
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tCREATED")
+		for _, u := range users {
+			fmt.Fprintf(tw, "%s\t%s\n", u.Name, formatTime(u.CreatedAt))
+		}
+		_ = tw.Flush()
+	case "add":
+		if len(args) < 2 {
+			log.Fatalln(usersUsage)
+		}
+
+		if err := svr.CreateUser(ctx, args[1]); err != nil {
+			log.Fatalf("Failed to add user: %s", err.Error())
+		}
+
+		createKey(svr, args[1], "", server.Scopes, 0)
+	case "remove":
+		if len(args) < 2 {
+			log.Fatalln(usersUsage)
+		}
+
+		if err := svr.DeleteUser(ctx, args[1]); err != nil {
+			log.Fatalf("Failed to remove user: %s", err.Error())
+		}
+
+		log.Printf("Removed user '%s'.", args[1])
+	case "keys":
+		if len(args) < 2 {
+			log.Fatalln(usersUsage)
+		}
+
+		keys, err := svr.ListAPIKeys(ctx, args[1])
+		if err != nil {
+			log.Fatalf("Failed to list API keys: %s", err.Error())
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tPREFIX\tLABEL\tSCOPES\tCREATED\tLAST USED\tEXPIRES")
+		for _, k := range keys {
+			fmt.Fprintf(tw, "%s\t%s...\t%s\t%s\t%s\t%s\t%s\n", k.Id, k.Prefix, k.Label, strings.ReplaceAll(k.Scopes, " ", ","), formatTime(k.CreatedAt), formatTime(k.LastUsedAt), formatTime(k.ExpiresAt))
+		}
+		_ = tw.Flush()
+	case "add-key":
+		flags := flag.NewFlagSet("add-key", flag.ExitOnError)
+		scopes := flags.String("scopes", strings.Join(server.Scopes, ","), "comma separated scopes of the key")
+		expires := flags.Duration("expires", 0, "how long until the key expires, or 0 if it never does")
+		_ = flags.Parse(args[1:])
+
+		if flags.NArg() < 1 {
+			log.Fatalln(usersUsage)
+		}
+
+		createKey(svr, flags.Arg(0), strings.Join(flags.Args()[1:], " "), strings.Split(*scopes, ","), *expires)
+	case "revoke-key":
+		if len(args) < 3 {
+			log.Fatalln(usersUsage)
+		}
+
+		if err := svr.RevokeAPIKey(ctx, args[1], args[2]); err != nil {
+			log.Fatalf("Failed to revoke API key: %s", err.Error())
+		}
+
+		log.Printf("Revoked API key '%s' of '%s'.", args[2], args[1])
+	case "link-oidc":
+		if len(args) < 3 {
+			log.Fatalln(usersUsage)
+		}
+
+		if err := svr.LinkOIDCIdentity(ctx, args[1], args[2]); err != nil {
+			log.Fatalf("Failed to link identity provider account: %s", err.Error())
+		}
+
+		log.Printf("Linked identity provider account '%s' to '%s'.", args[2], args[1])
+	case "unlink-oidc":
+		if len(args) < 2 {
+			log.Fatalln(usersUsage)
+		}
+
+		n, err := svr.UnlinkOIDCIdentities(ctx, args[1])
+		if err != nil {
+			log.Fatalf("Failed to unlink identity provider accounts: %s", err.Error())
+		}
+
+		log.Printf("Unlinked %d identity provider account(s) from '%s'.", n, args[1])
+	default:
+		log.Fatalln(usersUsage)
+	}
+}
+
+// createKey creates an API key and prints it, since it can't be shown again.
+func createKey(svr *server.Server, user string, label string, scopes []string, expires time.Duration) {
+	var expiresAt time.Time
+	if expires > 0 {
+		expiresAt = time.Now().Add(expires)
+	}
+
+	key, k, err := svr.CreateAPIKey(context.Background(), user, label, scopes, expiresAt)
+	if err != nil {
+		log.Fatalf("Failed to create API key: %s", err.Error())
+	}
+
+	log.Printf("Created API key '%s' for '%s'. It won't be shown again:", k.Id, user)
+	fmt.Println(key)
+}
+
+// formatTime formats a unix timestamp, or says never for 0.
+func formatTime(ts uint64) string {
+	if ts == 0 {
+		return "never"
+	}
+
+	return time.Unix(int64(ts), 0).Format("2006-01-02 15:04:05")
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 
 	"github.com/liondadev/quick-image-server/server"
+	"github.com/liondadev/quick-image-server/server/bubble"
 )
 
 func main() {
@@ -17,7 +18,7 @@ func main() {
 	}
 	defer f.Close()
 
-	c, err := s.MakeBubbleImage("image/jpeg", f)
+	c, err := s.MakeBubbleImage("image/jpeg", f, *bubble.StdDrawer)
 	if err != nil {
 		panic(err)
 	}
@@ -27,7 +28,7 @@ func main() {
 		panic(err)
 	}
 
-	gifr, err := s.ImageToGif(c)
+	gifr, err := s.ImageToGif(c, *bubble.StdDrawer)
 	if err != nil {
 		panic(err)
 	}
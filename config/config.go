@@ -8,13 +8,172 @@ import (
 
 // Config is the config for the application
 type Config struct {
-	// Users is a map of the user api key to a nice name for the user
+	// Users is a map of the user api key to a nice name for the user. They're imported
+	// into the database the first time the server starts, and ignored after that.
 	Users                map[string]string `json:"users"`
 	DatabasePath         string            `json:"sqlite"`
 	FSPath               string            `json:"storage_path"`
 	BasePath             string            `json:"base_path"`
 	AllowedToImportUsers []string          `json:"allowed_to_import"`
 	BaseImportPath       string            `json:"base_import_path"`
+
+	// StorageBackend is the backend uploads are stored in. It's either "local" (the
+	// default), which stores everything in FSPath, or "s3".
+	StorageBackend string   `json:"storage_backend"`
+	S3             S3Config `json:"s3"`
+
+	// TusPath is the local directory unfinished resumable uploads are collected in. It
+	// defaults to a folder in the temp directory.
+	TusPath string `json:"tus_path"`
+	// TusMaxSize is the largest resumable upload in bytes we accept, or 0 for no limit.
+	TusMaxSize int64 `json:"tus_max_size"`
+	// TusExpiryHours is how long an unfinished resumable upload is kept around after the
+	// last chunk of it arrived, before it's thrown away. Finished ones are forgotten after
+	// the same time. It defaults to 1 day.
+	TusExpiryHours int `json:"tus_expiry_hours"`
+
+	// Secret is the key cookies and links are signed with. Changing it invalidates
+	// everything that has been signed with the old one.
+	Secret string `json:"secret"`
+	// MaxShareHours is the longest a share link can be valid for. It defaults to 30 days.
+	MaxShareHours int `json:"max_share_hours"`
+	// SessionIdleHours is how long someone stays logged into the dashboard without using
+	// it. It defaults to 7 days.
+	SessionIdleHours int `json:"session_idle_hours"`
+	// SessionMaxHours is how long someone stays logged into the dashboard at most, even
+	// if they keep using it. It defaults to 30 days.
+	SessionMaxHours int `json:"session_max_hours"`
+	// OIDC lets people log into the dashboard with an OpenID Connect identity provider.
+	OIDC OIDCConfig `json:"oidc"`
+
+	// DefaultExpiry maps a user name to how long their uploads stay around for when
+	// they don't say (like "24h" or "30d"). Users that aren't in here keep them forever.
+	DefaultExpiry map[string]string `json:"default_expiry"`
+
+	// Transform configures the /i/ endpoint that resizes and converts images on demand.
+	Transform TransformConfig `json:"transform"`
+	// MaxImagePixels is the biggest image (width × height) thumbnails, bubbles, captions
+	// and transformations are made of. Bigger images are refused before they're decoded,
+	// since a small file can still take gigabytes to decode. It defaults to 64 million.
+	MaxImagePixels int64 `json:"max_image_pixels"`
+
+	// ThumbnailSizes are the sizes thumbnails are served in, by name (like "small"), as
+	// /thumb/{size}/{file}. It defaults to small, medium and large 16:9 sizes.
+	ThumbnailSizes map[string]ThumbnailSize `json:"thumbnail_sizes"`
+	// AnimatedThumbnails configures animated thumbnails for animated gifs.
+	AnimatedThumbnails AnimatedThumbnailConfig `json:"animated_thumbnails"`
+
+	// BubbleMasks maps a mask name to the path of an image, which every user can draw
+	// bubbles with (as /bubble/{file}?mask=name). Fully opaque parts of the image are cut out.
+	BubbleMasks map[string]string `json:"bubble_masks"`
+	// AnimatedBubbles limits the bubble gifs made from animated gifs. Gifs that go over
+	// any of the limits only get the bubble over their first frame.
+	AnimatedBubbles AnimationLimits `json:"animated_bubbles"`
+	// AnimatedCaptions limits the captioned gifs made from animated gifs. Gifs that go
+	// over any of the limits only get their first frame captioned.
+	AnimatedCaptions AnimationLimits `json:"animated_captions"`
+
+	// DerivativeWorkers is how many thumbnails, bubbles and other derivatives can be
+	// generated at once. It defaults to the number of cpus.
+	DerivativeWorkers int `json:"derivative_workers"`
+	// DerivativeQueue is how many derivatives can wait for a worker before more requests
+	// for new ones have to wait too. It defaults to 64.
+	DerivativeQueue int `json:"derivative_queue"`
+	// EagerThumbnails generates the thumbnails of images as soon as they're uploaded,
+	// instead of the first time they're looked at.
+	EagerThumbnails bool `json:"eager_thumbnails"`
+}
+
+// AnimatedThumbnailConfig configures animated thumbnails. Gifs that go over any of the
+// limits only get their first frame as their thumbnail.
+type AnimatedThumbnailConfig struct {
+	Enabled bool `json:"enabled"`
+	AnimationLimits
+	// MaxBytes is the biggest an animated thumbnail can be. It defaults to 4 MiB.
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// AnimationLimits limit the animated gifs that are made out of animated gifs, since
+// decoding every frame of one is expensive.
+type AnimationLimits struct {
+	// MaxFrames is the most frames a gif can have. It defaults to 150.
+	MaxFrames int `json:"max_frames"`
+	// MaxSourceBytes is the biggest a gif can be before we don't even try to animate
+	// it. It defaults to 20 MiB.
+	MaxSourceBytes int64 `json:"max_source_bytes"`
+	// MaxPixels is the most pixels a gif can have in all of its frames together (width
+	// × height × frames). Gifs compress well, so a small file can still take gigabytes
+	// to decode. It defaults to 64 million.
+	MaxPixels int64 `json:"max_pixels"`
+}
+
+// ThumbnailSize is the size of a thumbnail. Thumbnails keep their aspect ratio: with the
+// "contain" fit (the default) they fit inside the size, and with "cover" they're cropped to fill it.
+type ThumbnailSize struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Fit    string `json:"fit"`
+}
+
+// TransformConfig configures on the fly image transformations.
+type TransformConfig struct {
+	// CachePath is the local directory transformed images are cached in. It defaults
+	// to a folder in the temp directory.
+	CachePath string `json:"cache_path"`
+	// CacheMaxBytes is how big the cache can grow before the least recently used
+	// images are thrown away. It defaults to 256 MiB.
+	CacheMaxBytes int64 `json:"cache_max_bytes"`
+	// Presets are the parameter sets anyone can request (like "w=640&fit=contain&format=webp").
+	// Every other set of parameters needs a signature from the owner of the upload.
+	Presets []string `json:"presets"`
+	// MaxDimension is the largest width or height that can be requested. It defaults to 4096.
+	MaxDimension int `json:"max_dimension"`
+}
+
+// OIDCConfig configures logging into the dashboard with an OpenID Connect identity
+// provider. It's enabled when Issuer and ClientID are set.
+type OIDCConfig struct {
+	// Issuer is the url of the identity provider, like https://accounts.example.com. Its
+	// configuration is discovered from /.well-known/openid-configuration under it.
+	Issuer   string `json:"issuer"`
+	ClientID string `json:"client_id"`
+	// ClientSecret is only needed for confidential clients, public clients are protected by PKCE.
+	ClientSecret string `json:"client_secret"`
+	// RedirectURL is where the identity provider sends people back to. It defaults to
+	// /app/login/oidc/callback under BasePath.
+	RedirectURL string `json:"redirect_url"`
+	// Scopes are the OpenID Connect scopes that are requested. It defaults to openid,
+	// profile and email.
+	Scopes []string `json:"scopes"`
+	// UsernameClaim is the claim of the ID token that new users get their name from. It
+	// defaults to preferred_username. If it's email, the email has to be verified.
+	UsernameClaim string `json:"username_claim"`
+	// AutoProvision creates a new user for accounts that log in for the first time.
+	// Accounts are never linked to existing users this way, the "users link-oidc"
+	// command does that. Without it, only linked accounts can log in.
+	AutoProvision bool `json:"auto_provision"`
+	// SessionScopes is what people that log in this way can do, like the scopes of an
+	// API key. It defaults to every scope but admin.
+	SessionScopes []string `json:"session_scopes"`
+	// ButtonLabel is the text of the login button. It defaults to "Log in with SSO".
+	ButtonLabel string `json:"button_label"`
+}
+
+// S3Config configures the S3 compatible storage backend.
+type S3Config struct {
+	Endpoint  string `json:"endpoint"` // host[:port], without the scheme
+	Bucket    string `json:"bucket"`
+	Region    string `json:"region"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Prefix    string `json:"prefix"` // optional folder inside the bucket to store everything in
+	UseSSL    bool   `json:"use_ssl"`
+	// PathStyle uses http://endpoint/bucket/key urls instead of http://bucket.endpoint/key,
+	// which is what most self-hosted stand-ins (like MinIO) need.
+	PathStyle bool `json:"path_style"`
+	// PresignSeconds makes file views redirect to a presigned url that's valid for
+	// this many seconds, instead of streaming the file through the server.
+	PresignSeconds int `json:"presign_seconds"`
 }
 
 // New returns a config with default values
@@ -29,5 +188,23 @@ func FromReader(f io.Reader) (*Config, error) {
 		return nil, fmt.Errorf("config from reader: %w", err)
 	}
 
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("config from reader: %w", err)
+	}
+
 	return cfg, nil
 }
+
+// validate checks the parts of the config that can't be fixed by falling back to a default.
+func (c *Config) validate() error {
+	for name, size := range c.ThumbnailSizes {
+		if size.Width <= 0 || size.Height <= 0 {
+			return fmt.Errorf("thumbnail size '%s' must have a positive width and height", name)
+		}
+		if size.Fit != "" && size.Fit != "contain" && size.Fit != "cover" {
+			return fmt.Errorf("thumbnail size '%s' has fit '%s', it must be contain or cover", name, size.Fit)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestThumbnailSizes(t *testing.T) {
+	tests := []struct {
+		name  string
+		sizes string
+		err   bool
+	}{
+		{name: "none", sizes: `{}`},
+		{name: "valid", sizes: `{"small": {"width": 240, "height": 135}, "square": {"width": 128, "height": 128, "fit": "cover"}}`},
+		{name: "no width", sizes: `{"tall": {"height": 200}}`, err: true},
+		{name: "negative height", sizes: `{"odd": {"width": 200, "height": -1}}`, err: true},
+		{name: "unknown fit", sizes: `{"wide": {"width": 200, "height": 100, "fit": "stretch"}}`, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := FromReader(strings.NewReader(`{"thumbnail_sizes": ` + tt.sizes + `}`))
+			if (err != nil) != tt.err {
+				t.Errorf("got error %v, want an error: %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/liondadev/quick-image-server/server/pages"
+	"github.com/liondadev/quick-image-server/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	unlockCookieLifetime = time.Hour
+	defaultMaxShareHours = 24 * 30
+)
+
+// authenticatedUser returns the name of the user that made the request, or an empty
+// string if they aren't logged in or preHandleAuthentication wasn't called.
+func authenticatedUser(r *http.Request) string {
+	userName, _ := r.Context().Value(AuthenticatedUserContextKey).(string)
+	return userName
+}
+
+// unlockCookieName returns the name of the cookie that unlocks a password protected upload.
+func unlockCookieName(fileId string) string {
+	return "qis_unlock_" + fileId
+}
+
+// unlockSignature signs an unlock cookie. Part of the password hash is included, so
+// changing the password locks everyone out again.
+func (s *Server) unlockSignature(up types.Upload, exp string) string {
+	return s.sign("unlock", up.Id, exp, up.PasswordHash)
+}
+
+// hasUnlocked checks if the request has a valid cookie that unlocks the upload.
+func (s *Server) hasUnlocked(r *http.Request, up types.Upload) bool {
+	cook, err := r.Cookie(unlockCookieName(up.Id))
+	if err != nil {
+		return false
+	}
+
+	exp, sig, ok := strings.Cut(cook.Value, ".")
+	if !ok {
+		return false
+	}
+
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expUnix {
+		return false
+	}
+
+	return s.verify(sig, "unlock", up.Id, exp, up.PasswordHash)
+}
+
+// checkAccess makes sure the request is allowed to see the upload, or any of its
+// derivatives. If it isn't, the response has already been written (like an unlock page)
+// or an error is returned.
+func (s *Server) checkAccess(w http.ResponseWriter, r *http.Request, up types.Upload) (bool, error) {
+	isOwner := up.User != "" && up.User == authenticatedUser(r) && hasScope(r, ScopeReadOwn)
+
+	// Private files don't exist as far as anyone else is concerned, unless they have a
+	// share link from the owner.
+	if up.Visibility == types.VisibilityPrivate && !isOwner && !s.hasValidShareSignature(r, up) {
+		return false, PublicError{http.StatusNotFound, "File not found."}
+	}
+
+	if up.Visibility == types.VisibilityUnlisted {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	}
+
+	if up.PasswordHash != "" && !isOwner && !s.hasUnlocked(r, up) {
+		w.Header().Set("Cache-Control", "no-store")
+		return false, writeHTML(w, r, http.StatusUnauthorized, pages.Unlock(up.Id+up.Extension, r.URL.RequestURI(), ""))
+	}
+
+	return true, nil
+}
+
+// handleUnlockFile checks the password for a password protected upload, and gives the
+// client a cookie that lets them see it for a while.
+func (s *Server) handleUnlockFile(w http.ResponseWriter, r *http.Request) error {
+	fileName, fileId := getFileDetails(r)
+
+	var up types.Upload
+	if err := s.db.Get(&up, `SELECT "id", "ext", "password_hash" FROM "uploads" WHERE "id" = $1`, fileId); err != nil || fileName != up.Id+up.Extension {
+		return PublicError{http.StatusNotFound, "File not found."}
+	}
+
+	// Only send people back to our own pages.
+	returnTo := r.FormValue("return-to")
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		returnTo = "/f/" + fileName
+	}
+
+	if up.PasswordHash == "" {
+		http.Redirect(w, r, returnTo, http.StatusSeeOther)
+		return nil
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(up.PasswordHash), []byte(r.FormValue("password"))); err != nil {
+		return writeHTML(w, r, http.StatusUnauthorized, pages.Unlock(fileName, returnTo, "Incorrect password."))
+	}
+
+	exp := time.Now().Add(unlockCookieLifetime)
+	expStr := strconv.FormatInt(exp.Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookieName(up.Id),
+		Value:    expStr + "." + s.unlockSignature(up, expStr),
+		Path:     "/",
+		Expires:  exp,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, returnTo, http.StatusSeeOther) // StatusSeeOther makes the client do a GET instead of a POST
+	return nil
+}
+
+// hashUploadPassword hashes the password of an upload, or returns an empty string if
+// there's no password.
+func hashUploadPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// handleSetFilePassword sets, changes or removes (with an empty password) the password
+// of one of the uploads of the authenticated user.
+func (s *Server) handleSetFilePassword(w http.ResponseWriter, r *http.Request) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	hash, err := hashUploadPassword(r.FormValue("password"))
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(`UPDATE "uploads" SET "password_hash" = $1 WHERE "id" = $2 AND "user" = $3`, hash, chi.URLParam(r, "fileId"), userName)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return PublicError{http.StatusNotFound, "File not found."}
+	}
+
+	writeJson(w, http.StatusOK, jMap{"message": "Password updated", "protected": hash != ""})
+	return nil
+}
+
+// validVisibility checks if visibility is one of the visibilities an upload can have.
+func validVisibility(visibility string) bool {
+	return visibility == types.VisibilityPublic || visibility == types.VisibilityUnlisted || visibility == types.VisibilityPrivate
+}
+
+// handleSetFileVisibility changes who can see one of the uploads of the authenticated user.
+func (s *Server) handleSetFileVisibility(w http.ResponseWriter, r *http.Request) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	visibility := r.FormValue("visibility")
+	if !validVisibility(visibility) {
+		return PublicError{http.StatusBadRequest, "Invalid visibility, it must be public, unlisted or private."}
+	}
+
+	res, err := s.db.Exec(`UPDATE "uploads" SET "visibility" = $1 WHERE "id" = $2 AND "user" = $3`, visibility, chi.URLParam(r, "fileId"), userName)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return PublicError{http.StatusNotFound, "File not found."}
+	}
+
+	writeJson(w, http.StatusOK, jMap{"message": "Visibility updated", "visibility": visibility})
+	return nil
+}
+
+// shareSignature signs a share link for an upload that's valid until exp.
+func (s *Server) shareSignature(fileId string, exp string) string {
+	return s.sign("share", fileId, exp)
+}
+
+// hasValidShareSignature checks if the request was made with a share link for the
+// upload that hasn't expired yet.
+func (s *Server) hasValidShareSignature(r *http.Request, up types.Upload) bool {
+	q := r.URL.Query()
+	exp, sig := q.Get("exp"), q.Get("sig")
+	if exp == "" || sig == "" {
+		return false
+	}
+
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expUnix {
+		return false
+	}
+
+	return s.verify(sig, "share", up.Id, exp)
+}
+
+// handleCreateShareLink creates links to one of the uploads of the authenticated user
+// that work for the given amount of hours, even if the upload is private.
+func (s *Server) handleCreateShareLink(w http.ResponseWriter, r *http.Request) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	maxHours := s.cfg.MaxShareHours
+	if maxHours <= 0 {
+		maxHours = defaultMaxShareHours
+	}
+
+	hours := 24
+	if h := r.FormValue("hours"); h != "" {
+		n, err := strconv.Atoi(h)
+		if err != nil || n < 1 || n > maxHours {
+			return PublicError{http.StatusBadRequest, fmt.Sprintf("hours must be a number between 1 and %d.", maxHours)}
+		}
+		hours = n
+	}
+
+	var up types.Upload
+	if err := s.db.Get(&up, `SELECT "id", "ext" FROM "uploads" WHERE "id" = $1 AND "user" = $2`, chi.URLParam(r, "fileId"), userName); err != nil {
+		return PublicError{http.StatusNotFound, "File not found."}
+	}
+
+	exp := time.Now().Add(time.Duration(hours) * time.Hour)
+	expStr := strconv.FormatInt(exp.Unix(), 10)
+	query := "?" + url.Values{"exp": {expStr}, "sig": {s.shareSignature(up.Id, expStr)}}.Encode()
+
+	fileUrl, err := url.JoinPath(s.cfg.BasePath, "/f/", up.Id+up.Extension)
+	if err != nil {
+		return err
+	}
+
+	thumbUrl, err := url.JoinPath(s.cfg.BasePath, "/thumb/", up.Id+up.Extension)
+	if err != nil {
+		return err
+	}
+
+	writeJson(w, http.StatusOK, jMap{
+		"file_url":      fileUrl + query,
+		"thumbnail_url": thumbUrl + query,
+		"expires_at":    exp.Unix(),
+	})
+	return nil
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liondadev/quick-image-server/types"
+)
+
+// getFile requests target with the cookies, and with the API key unless it's empty.
+func getFile(s *Server, target string, apiKey string, cookies ...*http.Cookie) (*http.Response, string) {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if apiKey != "" {
+		r.Header.Set("X-Server-Api-Key", apiKey)
+	}
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+
+	res := serve(s, r)
+	body, _ := io.ReadAll(res.Body)
+	return res, string(body)
+}
+
+func TestPasswordUnlock(t *testing.T) {
+	s := newTestServer(t, nil)
+	ownerKey, _ := newTestKey(t, s, "alice", []string{ScopeUpload, ScopeReadOwn}, time.Time{})
+	hash, err := hashUploadPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := newTestUpload(t, s, "alice", "secret.txt", "text/plain", []byte("secret"), uploadOptions{PasswordHash: hash})
+	target := "/f/" + up.Id + up.Extension
+	csrf := strings.Repeat("a", csrfTokenLength)
+
+	if res, body := getFile(s, target, ""); res.StatusCode != http.StatusUnauthorized || strings.Contains(body, "secret") {
+		t.Fatalf("locked: got status %d, want the unlock page", res.StatusCode)
+	}
+
+	// The owner doesn't need the password.
+	if res, body := getFile(s, target, ownerKey); res.StatusCode != http.StatusOK || body != "secret" {
+		t.Errorf("owner: got status %d and %q", res.StatusCode, body)
+	}
+
+	unlock := func(password string, returnTo string) *http.Response {
+		return serve(s, newFormRequest(target, url.Values{"password": {password}, "return-to": {returnTo}}, csrf))
+	}
+
+	res := unlock("wrong", target)
+	if res.StatusCode != http.StatusUnauthorized || responseCookie(res, unlockCookieName(up.Id)) != nil {
+		t.Errorf("wrong password: got status %d, want %d and no cookie", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	// Only our own pages are returned to.
+	res = unlock("hunter2", "//evil.example/")
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != target {
+		t.Errorf("return to another site: got status %d and location %q, want to go to %s", res.StatusCode, res.Header.Get("Location"), target)
+	}
+
+	cookie := responseCookie(res, unlockCookieName(up.Id))
+	if cookie == nil {
+		t.Fatal("unlocking didn't set a cookie")
+	}
+	if res, body := getFile(s, target, "", cookie); res.StatusCode != http.StatusOK || body != "secret" {
+		t.Errorf("unlocked: got status %d and %q", res.StatusCode, body)
+	}
+
+	// The cookie is only good for this upload.
+	other := newTestUpload(t, s, "alice", "other.txt", "text/plain", []byte("other"), uploadOptions{PasswordHash: hash})
+	forged := &http.Cookie{Name: unlockCookieName(other.Id), Value: cookie.Value}
+	if res, _ := getFile(s, "/f/"+other.Id+other.Extension, "", forged); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("cookie of another upload: got status %d, want %d", res.StatusCode, http.StatusUnauthorized)
+	}
+
+	// Changing the password locks everyone out again.
+	r := httptest.NewRequest(http.MethodPost, "/app/uploads/"+up.Id+"/password", strings.NewReader(url.Values{"password": {"hunter3"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Server-Api-Key", ownerKey)
+	if res := serve(s, r); res.StatusCode != http.StatusOK {
+		t.Fatalf("change password: got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if res, _ := getFile(s, target, "", cookie); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("after changing the password: got status %d, want %d", res.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	s := newTestServer(t, nil)
+	aliceKey, _ := newTestKey(t, s, "alice", []string{ScopeUpload, ScopeReadOwn}, time.Time{})
+	bobKey, _ := newTestKey(t, s, "bob", []string{ScopeUpload, ScopeReadOwn}, time.Time{})
+
+	tests := []struct {
+		visibility string
+		anyone     int    // the status anyone but the owner gets
+		robots     string // the X-Robots-Tag header
+		cache      string // the Cache-Control header
+	}{
+		{visibility: types.VisibilityPublic, anyone: http.StatusOK, cache: "public, max-age=1800"},
+		{visibility: types.VisibilityUnlisted, anyone: http.StatusOK, robots: "noindex, nofollow", cache: "public, max-age=1800"},
+		{visibility: types.VisibilityPrivate, anyone: http.StatusNotFound, cache: "private, max-age=1800"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.visibility, func(t *testing.T) {
+			up := newTestUpload(t, s, "alice", "file.txt", "text/plain", []byte("contents"), uploadOptions{Visibility: tt.visibility})
+			target := "/f/" + up.Id + up.Extension
+
+			for _, key := range []string{"", bobKey} {
+				if res, _ := getFile(s, target, key); res.StatusCode != tt.anyone {
+					t.Errorf("someone else: got status %d, want %d", res.StatusCode, tt.anyone)
+				}
+			}
+			if tt.anyone == http.StatusNotFound {
+				if res, _ := getFile(s, "/thumb/"+up.Id+up.Extension, ""); res.StatusCode != http.StatusNotFound {
+					t.Errorf("thumbnail: got status %d, want %d", res.StatusCode, http.StatusNotFound)
+				}
+			}
+
+			res, body := getFile(s, target, aliceKey)
+			if res.StatusCode != http.StatusOK || body != "contents" {
+				t.Fatalf("owner: got status %d and %q", res.StatusCode, body)
+			}
+			if got := res.Header.Get("X-Robots-Tag"); got != tt.robots {
+				t.Errorf("got X-Robots-Tag %q, want %q", got, tt.robots)
+			}
+			if got := res.Header.Get("Cache-Control"); got != tt.cache {
+				t.Errorf("got Cache-Control %q, want %q", got, tt.cache)
+			}
+		})
+	}
+}
+
+func TestSetVisibility(t *testing.T) {
+	s := newTestServer(t, nil)
+	aliceKey, _ := newTestKey(t, s, "alice", []string{ScopeUpload}, time.Time{})
+	bobKey, _ := newTestKey(t, s, "bob", []string{ScopeUpload}, time.Time{})
+	up := newTestUpload(t, s, "alice", "file.txt", "text/plain", []byte("contents"), uploadOptions{})
+	target := "/f/" + up.Id + up.Extension
+
+	set := func(key string, visibility string) int {
+		r := httptest.NewRequest(http.MethodPost, "/app/uploads/"+up.Id+"/visibility", strings.NewReader(url.Values{"visibility": {visibility}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Server-Api-Key", key)
+		return serve(s, r).StatusCode
+	}
+
+	if status := set(aliceKey, "secret"); status != http.StatusBadRequest {
+		t.Errorf("invalid visibility: got status %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := set(bobKey, types.VisibilityPrivate); status != http.StatusNotFound {
+		t.Errorf("upload of someone else: got status %d, want %d", status, http.StatusNotFound)
+	}
+	if res, _ := getFile(s, target, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("before making it private: got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	if status := set(aliceKey, types.VisibilityPrivate); status != http.StatusOK {
+		t.Fatalf("make it private: got status %d, want %d", status, http.StatusOK)
+	}
+	if res, _ := getFile(s, target, ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("after making it private: got status %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestShareLinks(t *testing.T) {
+	s := newTestServer(t, nil)
+	aliceKey, _ := newTestKey(t, s, "alice", []string{ScopeReadOwn}, time.Time{})
+	bobKey, _ := newTestKey(t, s, "bob", []string{ScopeReadOwn}, time.Time{})
+	up := newTestUpload(t, s, "alice", "file.txt", "text/plain", []byte("contents"), uploadOptions{Visibility: types.VisibilityPrivate})
+	other := newTestUpload(t, s, "alice", "other.txt", "text/plain", []byte("other"), uploadOptions{Visibility: types.VisibilityPrivate})
+
+	share := func(key string, hours string) *http.Response {
+		r := httptest.NewRequest(http.MethodPost, "/app/uploads/"+up.Id+"/share", strings.NewReader(url.Values{"hours": {hours}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Server-Api-Key", key)
+		return serve(s, r)
+	}
+
+	for _, hours := range []string{"0", "soon", strconv.Itoa(defaultMaxShareHours + 1)} {
+		if res := share(aliceKey, hours); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("share for %s hours: got status %d, want %d", hours, res.StatusCode, http.StatusBadRequest)
+		}
+	}
+	if res := share(bobKey, "1"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("share an upload of someone else: got status %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+
+	res := share(aliceKey, "1")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("share: got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	var link struct {
+		FileURL   string `json:"file_url"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&link); err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(time.Unix(link.ExpiresAt, 0)); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("the link expires in %s, want an hour", until)
+	}
+
+	shared, err := url.Parse(link.FileURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, body := getFile(s, shared.RequestURI(), ""); res.StatusCode != http.StatusOK || body != "contents" {
+		t.Fatalf("shared link: got status %d and %q", res.StatusCode, body)
+	}
+
+	q := shared.Query()
+	exp, sig := q.Get("exp"), q.Get("sig")
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	tests := []struct {
+		name string
+		file string
+		exp  string
+		sig  string
+	}{
+		{name: "tampered signature", file: up.Id + up.Extension, exp: exp, sig: strings.ToUpper(sig)},
+		{name: "later expiry", file: up.Id + up.Extension, exp: strconv.FormatInt(link.ExpiresAt+3600, 10), sig: sig},
+		{name: "another upload", file: other.Id + other.Extension, exp: exp, sig: sig},
+		{name: "expired", file: up.Id + up.Extension, exp: past, sig: s.shareSignature(up.Id, past)},
+		{name: "no signature", file: up.Id + up.Extension, exp: exp},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/f/" + tt.file + "?" + url.Values{"exp": {tt.exp}, "sig": {tt.sig}}.Encode()
+			if res, _ := getFile(s, target, ""); res.StatusCode != http.StatusNotFound {
+				t.Errorf("got status %d, want %d", res.StatusCode, http.StatusNotFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+
+	"github.com/ericpauley/go-quantize/quantize"
+	"github.com/liondadev/quick-image-server/config"
+	"github.com/liondadev/quick-image-server/types"
+)
+
+// maxPaletteSamplePixels is the most pixels looked at to make a palette shared by every
+// frame of an animation.
+const maxPaletteSamplePixels = 1 << 21
+
+const (
+	defaultAnimationMaxFrames        = 150
+	defaultAnimationMaxSourceBytes   = 20 << 20
+	defaultAnimationMaxPixels        = 64 << 20
+	defaultAnimatedThumbnailMaxBytes = 4 << 20
+)
+
+// animatedThumbnailName returns the name an animated thumbnail of an upload is stored as.
+func animatedThumbnailName(fileId string, size types.ThumbnailSize) string {
+	return fmt.Sprintf("%s.thumbnail.%dx%d.%s.gif", fileId, size.Width, size.Height, size.Fit)
+}
+
+// animationLimits returns the limits with the defaults filled in.
+func animationLimits(limits config.AnimationLimits) config.AnimationLimits {
+	if limits.MaxFrames <= 0 {
+		limits.MaxFrames = defaultAnimationMaxFrames
+	}
+	if limits.MaxSourceBytes <= 0 {
+		limits.MaxSourceBytes = defaultAnimationMaxSourceBytes
+	}
+	if limits.MaxPixels <= 0 {
+		limits.MaxPixels = defaultAnimationMaxPixels
+	}
+
+	return limits
+}
+
+// animatedThumbnailMaxBytes returns the biggest an animated thumbnail can be.
+func (s *Server) animatedThumbnailMaxBytes() int64 {
+	if s.cfg.AnimatedThumbnails.MaxBytes <= 0 {
+		return defaultAnimatedThumbnailMaxBytes
+	}
+
+	return s.cfg.AnimatedThumbnails.MaxBytes
+}
+
+// wantsAnimatedThumbnail returns whether the thumbnails of an upload should be animated.
+func (s *Server) wantsAnimatedThumbnail(up types.Upload) bool {
+	return s.cfg.AnimatedThumbnails.Enabled && up.MimeType == "image/gif"
+}
+
+// countGifFrames counts the frames of a gif by skipping over its blocks, without decoding
+// any of them.
+func countGifFrames(data []byte) (int, error) {
+	errTruncated := errors.New("gif: unexpected end of data")
+
+	// skipSubBlocks skips the data sub-blocks starting at i, returning where they end.
+	skipSubBlocks := func(i int) (int, error) {
+		for {
+			if i >= len(data) {
+				return 0, errTruncated
+			}
+
+			size := int(data[i])
+			i++
+			if size == 0 {
+				return i, nil
+			}
+			i += size
+		}
+	}
+
+	// The header and logical screen descriptor, followed by the global color table.
+	if len(data) < 13 {
+		return 0, errTruncated
+	}
+	i := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << ((flags & 0x07) + 1)
+	}
+
+	frames := 0
+	for {
+		if i >= len(data) {
+			return 0, errTruncated
+		}
+
+		var err error
+		switch data[i] {
+		case 0x21: // extension: introducer, label and sub-blocks
+			if i, err = skipSubBlocks(i + 2); err != nil {
+				return 0, err
+			}
+		case 0x2C: // image descriptor, the local color table, the lzw code size and sub-blocks
+			if i+10 > len(data) {
+				return 0, errTruncated
+			}
+			frames++
+
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << ((flags & 0x07) + 1)
+			}
+			if i, err = skipSubBlocks(i + 1); err != nil {
+				return 0, err
+			}
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("gif: unknown block type 0x%x", data[i])
+		}
+	}
+}
+
+// decodeAnimation decodes every frame of a gif, unless it goes over the limits, in which
+// case it returns nil and only the first frame should be used. The size and the number
+// of frames are checked before anything is decoded.
+func decodeAnimation(data []byte, limits config.AnimationLimits) (*gif.GIF, error) {
+	cfg, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode gif: %w", err)
+	}
+
+	frames, err := countGifFrames(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode gif: %w", err)
+	}
+
+	if frames > limits.MaxFrames || int64(cfg.Width)*int64(cfg.Height)*int64(frames) > limits.MaxPixels {
+		return nil, nil
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode gif: %w", err)
+	}
+
+	return g, nil
+}
+
+// compositeFrames draws the frames of a gif like a browser would, calling each with the
+// full image that's visible during every frame, which it can keep. The disposal of every
+// frame has already been applied to the frame after it, so each of them replaces the one
+// before it entirely. Frames are made one at a time, so they don't all have to be in
+// memory at full size.
+func compositeFrames(g *gif.GIF, each func(frame *image.RGBA)) {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		for _, frame := range g.Image {
+			bounds = bounds.Union(frame.Bounds())
+		}
+	}
+
+	canvas := image.NewRGBA(bounds)
+
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, bounds.Min, draw.Src)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		visible := image.NewRGBA(bounds)
+		draw.Draw(visible, bounds, canvas, bounds.Min, draw.Src)
+		each(visible)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+}
+
+// encodeSharedPalette encodes the frames of g as a gif with its timing and loop count.
+// Every frame uses the same palette, which includes a transparent color. The frames are
+// composited twice, first to sample them for the palette and then to draw them with it,
+// so only one of them is at full size at a time. prepare (which can be nil) is called on
+// every composited frame before it's used, and drawer draws each frame onto its
+// paletted image.
+func encodeSharedPalette(g *gif.GIF, prepare func(frame *image.RGBA), drawer draw.Drawer) (io.Reader, error) {
+	// The sample is made of evenly spaced pixels from every frame laid out side by side,
+	// so one palette can be made for all of them without looking at every pixel.
+	var sample *image.RGBA
+	var w, h, step, i int
+	compositeFrames(g, func(frame *image.RGBA) {
+		if prepare != nil {
+			prepare(frame)
+		}
+
+		b := frame.Bounds()
+		if sample == nil {
+			step = 1
+			for b.Dx()*b.Dy()*len(g.Image)/(step*step) > maxPaletteSamplePixels {
+				step++
+			}
+			w, h = (b.Dx()+step-1)/step, (b.Dy()+step-1)/step
+			sample = image.NewRGBA(image.Rect(0, 0, w*len(g.Image), h))
+		}
+
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				sample.SetRGBA(i*w+x, y, frame.RGBAAt(b.Min.X+x*step, b.Min.Y+y*step))
+			}
+		}
+		i++
+	})
+	if sample == nil {
+		return nil, errors.New("gif has no frames")
+	}
+
+	palette := TransparentQuantizer{quantize.MedianCutQuantizer{}}.Quantize(make(color.Palette, 0, 256), sample)
+
+	out := &gif.GIF{LoopCount: g.LoopCount, Delay: g.Delay}
+	compositeFrames(g, func(frame *image.RGBA) {
+		if prepare != nil {
+			prepare(frame)
+		}
+
+		dst := image.NewPaletted(frame.Bounds(), palette)
+		drawer.Draw(dst, dst.Bounds(), frame, frame.Bounds().Min)
+
+		out.Image = append(out.Image, dst)
+		// Every frame has to be cleared, or the frame before would show through
+		// transparent parts.
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+	})
+	b := out.Image[0].Bounds()
+	out.Config = image.Config{ColorModel: palette, Width: b.Dx(), Height: b.Dy()}
+
+	buff := new(bytes.Buffer)
+	if err := gif.EncodeAll(buff, out); err != nil {
+		return nil, fmt.Errorf("encode gif: %w", err)
+	}
+
+	return buff, nil
+}
+
+// palettedFrame turns a frame into a paletted image with a palette of its own, which
+// always includes a transparent color.
+func palettedFrame(img image.Image) *image.Paletted {
+	palette := TransparentQuantizer{quantize.MedianCutQuantizer{}}.Quantize(make(color.Palette, 0, 256), img)
+	dst := image.NewPaletted(img.Bounds(), palette)
+	draw.FloydSteinberg.Draw(dst, img.Bounds(), img, img.Bounds().Min)
+
+	return dst
+}
+
+// scaleThumbnailFrame scales a single image down to a thumbnail size, without blowing
+// up images that already fit.
+func scaleThumbnailFrame(img image.Image, size types.ThumbnailSize) image.Image {
+	if b := img.Bounds(); size.Fit == "cover" || b.Dx() > size.Width || b.Dy() > size.Height {
+		return transformImage(img, transformParams{Width: size.Width, Height: size.Height, Fit: size.Fit})
+	}
+
+	return img
+}
+
+// MakeAnimatedThumbnail creates an animated gif thumbnail from an animated gif upload,
+// keeping the timing and loop count of the original. Originals bigger than the budget
+// (sourceSize bytes, too many frames or too big a thumbnail) only get their first
+// frame as the thumbnail.
+func (s *Server) MakeAnimatedThumbnail(original io.Reader, sourceSize int64, size types.ThumbnailSize) (io.Reader, error) {
+	limits := animationLimits(s.cfg.AnimatedThumbnails.AnimationLimits)
+
+	if sourceSize > limits.MaxSourceBytes {
+		return s.firstFrameThumbnail(original, size)
+	}
+
+	// We need to read it twice if we end up falling back to the first frame.
+	data, err := io.ReadAll(original)
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := decodeAnimation(data, limits)
+	if err != nil {
+		return nil, err
+	}
+	if g == nil {
+		return s.firstFrameThumbnail(bytes.NewReader(data), size)
+	}
+
+	// Frames are scaled down as soon as they're made, so only the thumbnails are kept.
+	out := &gif.GIF{LoopCount: g.LoopCount, Delay: g.Delay}
+	compositeFrames(g, func(frame *image.RGBA) {
+		out.Image = append(out.Image, palettedFrame(scaleThumbnailFrame(frame, size)))
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+	})
+	if len(out.Image) > 0 {
+		b := out.Image[0].Bounds()
+		out.Config = image.Config{Width: b.Dx(), Height: b.Dy()}
+	}
+
+	buff := new(bytes.Buffer)
+	if err := gif.EncodeAll(buff, out); err != nil {
+		return nil, fmt.Errorf("encode gif: %w", err)
+	}
+
+	if int64(buff.Len()) > s.animatedThumbnailMaxBytes() {
+		return s.firstFrameThumbnail(bytes.NewReader(data), size)
+	}
+
+	return buff, nil
+}
+
+// firstFrameThumbnail creates a gif thumbnail out of only the first frame of a gif.
+func (s *Server) firstFrameThumbnail(original io.Reader, size types.ThumbnailSize) (io.Reader, error) {
+	img, err := decodeImage("image/gif", original, s.maxImagePixels())
+	if err != nil {
+		return nil, err
+	}
+
+	buff := new(bytes.Buffer)
+	if err := gif.Encode(buff, palettedFrame(scaleThumbnailFrame(img, size)), nil); err != nil {
+		return nil, fmt.Errorf("encode gif: %w", err)
+	}
+
+	return buff, nil
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/liondadev/quick-image-server/config"
+)
+
+// testGIF encodes an animated gif of width by height with the frames. Every other frame
+// has a palette of its own, so it gets a local color table.
+func testGIF(t *testing.T, width int, height int, frames int) []byte {
+	t.Helper()
+
+	g := &gif.GIF{Config: image.Config{ColorModel: color.Palette(palette.Plan9), Width: width, Height: height}}
+	for i := 0; i < frames; i++ {
+		p := color.Palette(palette.Plan9)
+		if i%2 == 1 {
+			p = palette.WebSafe
+		}
+
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), p)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i * 10)
+		}
+
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+
+	buff := new(bytes.Buffer)
+	if err := gif.EncodeAll(buff, g); err != nil {
+		t.Fatal(err)
+	}
+
+	return buff.Bytes()
+}
+
+func TestCountGifFrames(t *testing.T) {
+	for _, frames := range []int{1, 2, 7} {
+		data := testGIF(t, 16, 8, frames)
+
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := countGifFrames(data)
+		if err != nil || got != len(g.Image) {
+			t.Errorf("%d frames: counted %d %v, DecodeAll found %d", frames, got, err, len(g.Image))
+		}
+
+		// Every truncated gif is refused, instead of being counted short.
+		for n := 0; n < len(data); n++ {
+			if _, err := countGifFrames(data[:n]); err == nil {
+				t.Errorf("%d frames: counted the first %d bytes of %d without an error", frames, n, len(data))
+				break
+			}
+		}
+	}
+
+	if _, err := countGifFrames(append([]byte("GIF89a\x01\x00\x01\x00\x00\x00\x00"), 0x99)); err == nil {
+		t.Error("counted a gif with an unknown block")
+	}
+}
+
+func TestDecodeAnimation(t *testing.T) {
+	data := testGIF(t, 16, 8, 3)
+
+	tests := []struct {
+		name    string
+		limits  config.AnimationLimits
+		decoded bool
+	}{
+		{name: "within the limits", limits: config.AnimationLimits{MaxFrames: 3, MaxPixels: 16 * 8 * 3}, decoded: true},
+		{name: "too many frames", limits: config.AnimationLimits{MaxFrames: 2, MaxPixels: 16 * 8 * 3}},
+		{name: "too many pixels", limits: config.AnimationLimits{MaxFrames: 3, MaxPixels: 16*8*3 - 1}},
+	}
+
+	for _, tt := range tests {
+		g, err := decodeAnimation(data, tt.limits)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if decoded := g != nil; decoded != tt.decoded {
+			t.Errorf("%s: decoded %v, want %v", tt.name, decoded, tt.decoded)
+		}
+		if g != nil && len(g.Image) != 3 {
+			t.Errorf("%s: decoded %d frames, want 3", tt.name, len(g.Image))
+		}
+	}
+
+	if _, err := decodeAnimation([]byte("GIF89a"), animationLimits(config.AnimationLimits{})); err == nil {
+		t.Error("decoded a broken gif")
+	}
+}
+
+func TestAnimatedThumbnail(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits config.AnimationLimits
+		frames int
+	}{
+		{name: "animated", frames: 4},
+		{name: "too many frames", limits: config.AnimationLimits{MaxFrames: 3}, frames: 1},
+		{name: "too big", limits: config.AnimationLimits{MaxSourceBytes: 10}, frames: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(cfg *config.Config) {
+				cfg.AnimatedThumbnails = config.AnimatedThumbnailConfig{Enabled: true, AnimationLimits: tt.limits}
+				cfg.ThumbnailSizes = map[string]config.ThumbnailSize{"medium": {Width: 32, Height: 32}}
+			})
+			up := newTestUpload(t, s, "alice", "cat.gif", "image/gif", testGIF(t, 64, 48, 4), uploadOptions{})
+
+			res := serve(s, httptest.NewRequest(http.MethodGet, "/thumb/"+up.Id+up.Extension, nil))
+			if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "image/gif" {
+				t.Fatalf("got status %d and type %q, want a gif", res.StatusCode, res.Header.Get("Content-Type"))
+			}
+
+			g, err := gif.DecodeAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(g.Image) != tt.frames {
+				t.Errorf("got %d frames, want %d", len(g.Image), tt.frames)
+			}
+			if size := g.Image[0].Bounds().Size(); size != image.Pt(32, 24) {
+				t.Errorf("got size %s, want 32x24", size)
+			}
+		})
+	}
+}
@@ -6,7 +6,8 @@ const handler = () => {
     buttonElement.removeEventListener("click", handler)
 
     const val = encodeURIComponent(inputElement.value);
-    const evt = new EventSource("/import-api?fileName="+val, {withCredentials: true})
+    const token = encodeURIComponent(document.querySelector('meta[name="csrf-token"]').content);
+    const evt = new EventSource("/import-api?fileName="+val+"&csrf_token="+token, {withCredentials: true})
 
     function addMessage(type, content) {
         const el = document.createElement("pre")
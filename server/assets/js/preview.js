@@ -48,6 +48,51 @@ let bubbledPngButton;
  */
 let bubbledGifButton;
 
+/**
+ * @type {HTMLButtonElement}
+ */
+let passwordButton;
+
+/**
+ * @type {((event: Event) => void) | undefined}
+ */
+let lastPasswordHandler;
+
+/**
+ * @type {HTMLSelectElement}
+ */
+let visibilitySelect;
+
+/**
+ * @type {HTMLInputElement}
+ */
+let shareHoursInput;
+
+/**
+ * @type {HTMLButtonElement}
+ */
+let shareButton;
+
+/**
+ * @type {((event: Event) => void) | undefined}
+ */
+let lastShareHandler;
+
+/**
+ * @type {((event: Event) => void) | undefined}
+ */
+let lastVisibilityHandler;
+
+/**
+ * Returns the headers requests that change something need, so they aren't mistaken for
+ * cross-site request forgery.
+ * @return {Record<string, string>}
+ */
+function csrfHeaders() {
+    const meta = document.querySelector('meta[name="csrf-token"]');
+    return {"X-CSRF-Token": meta ? meta.content : ""};
+}
+
 /**
  * Shows the popup modal for an image preview.
  * @param {string} name
@@ -56,9 +101,12 @@ let bubbledGifButton;
  * @param {string} mimeType
  * @param {number} uploadedAt
  * @param {string} deleteToken
+ * @param {boolean} burnAfterRead
+ * @param {boolean} passwordProtected
+ * @param {string} visibility
  * @return {boolean}
  */
-function showImagePreview(name, id, ext, mimeType, uploadedAt, deleteToken) {
+function showImagePreview(name, id, ext, mimeType, uploadedAt, deleteToken, burnAfterRead, passwordProtected, visibility) {
     // Ensure all the required elements are created and exist.
     if (!popupElement) return false;
     if (!titleElement) return false;
@@ -70,7 +118,8 @@ function showImagePreview(name, id, ext, mimeType, uploadedAt, deleteToken) {
     const deleteUrl = "/delete/"+id+"/"+deleteToken;
 
     titleElement.innerText = name;
-    previewContainer.src = targetUrl;
+    // Previewing a one-time file would burn it.
+    previewContainer.src = burnAfterRead ? "about:blank" : targetUrl;
 
     openUrlButton.href = targetUrl;
     openThumbButton.href = "/thumb/"+id+".png"
@@ -86,7 +135,7 @@ function showImagePreview(name, id, ext, mimeType, uploadedAt, deleteToken) {
         const shouldDelete = confirm(`Are you sure you want to PERMANENTLY delete ${name}?`);
         if (!shouldDelete) return;
 
-        const status = await fetch(deleteUrl).then((r) => r.status).catch((err) => {
+        const status = await fetch(deleteUrl, {method: "POST", headers: csrfHeaders()}).then((r) => r.status).catch((err) => {
             alert("Failed to delete the file. Please check your JS console.")
             console.error(err)
         })
@@ -98,6 +147,73 @@ function showImagePreview(name, id, ext, mimeType, uploadedAt, deleteToken) {
     }
     deleteButton.addEventListener("click", lastDeleteHandler)
 
+    passwordButton.innerText = passwordProtected ? "Change Password" : "Set Password";
+    if (lastPasswordHandler)
+        passwordButton.removeEventListener("click", lastPasswordHandler);
+
+    lastPasswordHandler = async (event) => {
+        const password = prompt(`New password for ${name}. Leave it empty to remove the password.`);
+        if (password === null) return; // cancelled
+
+        const body = new FormData();
+        body.set("password", password);
+        const status = await fetch("/app/uploads/"+id+"/password", {method: "POST", body, headers: csrfHeaders()}).then((r) => r.status).catch((err) => {
+            alert("Failed to set the password. Please check your JS console.")
+            console.error(err)
+        })
+        if (!status) return; // caught error
+        if (status !== 200)
+            alert("Failed to set the password. Received non-200 error code.");
+
+        window.location = window.location; // refresh page
+    }
+    passwordButton.addEventListener("click", lastPasswordHandler)
+
+    visibilitySelect.value = visibility || "public";
+    if (lastVisibilityHandler)
+        visibilitySelect.removeEventListener("change", lastVisibilityHandler);
+
+    lastVisibilityHandler = async (event) => {
+        const body = new FormData();
+        body.set("visibility", visibilitySelect.value);
+        const status = await fetch("/app/uploads/"+id+"/visibility", {method: "POST", body, headers: csrfHeaders()}).then((r) => r.status).catch((err) => {
+            alert("Failed to change the visibility. Please check your JS console.")
+            console.error(err)
+        })
+        if (!status) return; // caught error
+        if (status !== 200)
+            alert("Failed to change the visibility. Received non-200 error code.");
+
+        window.location = window.location; // refresh page
+    }
+    visibilitySelect.addEventListener("change", lastVisibilityHandler)
+
+    if (lastShareHandler)
+        shareButton.removeEventListener("click", lastShareHandler);
+
+    lastShareHandler = async (event) => {
+        const body = new FormData();
+        body.set("hours", shareHoursInput.value);
+        const res = await fetch("/app/uploads/"+id+"/share", {method: "POST", body, headers: csrfHeaders()}).then((r) => r.json()).catch((err) => {
+            alert("Failed to create a share link. Please check your JS console.")
+            console.error(err)
+        })
+        if (!res) return; // caught error
+        if (!res.file_url) {
+            alert("Failed to create a share link: " + res.error);
+            return;
+        }
+
+        const link = res.file_url;
+        try {
+            await navigator.clipboard.writeText(link);
+            alert(`Copied a link that's valid for ${shareHoursInput.value} hours.`);
+        } catch (err) {
+            prompt("Copy the link below.", link);
+        }
+    }
+    shareButton.addEventListener("click", lastShareHandler)
+
     popupElement.showModal();
     return true;
 }
@@ -113,6 +229,10 @@ window.onload = function() {
     closeModalButton = document.getElementById("upload-preview-close-button")
     bubbledPngButton = document.getElementById("upload-preview-btn-open-bubbled-png");
     bubbledGifButton = document.getElementById("upload-preview-btn-open-bubbled-gif");
+    passwordButton = document.getElementById("upload-preview-btn-password");
+    visibilitySelect = document.getElementById("upload-preview-visibility");
+    shareHoursInput = document.getElementById("upload-preview-share-hours");
+    shareButton = document.getElementById("upload-preview-btn-share");
 
     closeModalButton.addEventListener("click", () => {
         if (popupElement.open) popupElement.close();
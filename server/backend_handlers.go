@@ -2,25 +2,25 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"image/jpeg"
-	"image/png"
-	"io"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
-	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/liondadev/quick-image-server/server/bubble"
+	"github.com/liondadev/quick-image-server/server/pages"
+	"github.com/liondadev/quick-image-server/server/storage"
 	"github.com/liondadev/quick-image-server/types"
 
 	"github.com/go-chi/chi/v5"
@@ -51,65 +51,24 @@ func (s *Server) handleFileUpload(w http.ResponseWriter, r *http.Request) error
 		return err
 	}
 
-	fileId, err := s.getFreeFileId(FileIdLength)
-	if err != nil {
-		fmt.Println(err)
-		return PublicError{http.StatusInternalServerError, "failed to generate id"}
-	}
-
-	mimeType := header.Header.Get("Content-Type")
-	if mimeType == "" {
-		mimeType = "application/octet-stream" // default for binary data
-	}
-
-	ext := path.Ext(header.Filename)
-	diskName := fileId + ext
-
-	// Handle storing the file
-	fullPath := path.Join(s.cfg.FSPath, diskName)
-	f, err := os.Create(fullPath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	n, err := io.Copy(f, uploadedFile)
+	opts, err := s.parseUploadOptions(userName, r.FormValue)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("User '%s' uploaded file '%s' (%s), n=%d\n", userName, header.Filename, diskName, n)
-
-	// Handle storing the upload in the database
-	deleteToken := s.generateDeleteToken(32)
-	if _, err := s.db.Exec(`INSERT INTO "uploads" ("id", "mime", "user", "uploaded_at", "uploaded_as", "delete_token", "ext") VALUES ($1, $2, $3, $4, $5, $6, $7)`, fileId, mimeType, userName, time.Now().Unix(), header.Filename, deleteToken, ext); err != nil {
-		// If we fail the database query we need to delete the file
-		f.Close()
-		_ = os.Remove(fullPath) // if we error here it's already too late
-
-		return err
-	}
-
-	uploadUrl, err := url.JoinPath(s.cfg.BasePath, "/f/", diskName)
+	up, n, err := s.storeUpload(r.Context(), userName, header.Filename, header.Header.Get("Content-Type"), uploadedFile, opts)
 	if err != nil {
 		return err
 	}
 
-	thumbUrl, err := url.JoinPath(s.cfg.BasePath, "/thumb/", diskName)
-	if err != nil {
-		return err
-	}
+	log.Printf("User '%s' uploaded file '%s' (%s), n=%d\n", userName, header.Filename, up.Id+up.Extension, n)
 
-	deleteUrl, err := url.JoinPath(s.cfg.BasePath, "/delete/", fileId, "/", deleteToken)
+	urls, err := s.uploadUrls(up)
 	if err != nil {
 		return err
 	}
 
-	writeJson(w, http.StatusCreated, jMap{ // it was a success!
-		"file_url":      uploadUrl,
-		"thumbnail_url": thumbUrl,
-		"delete_url":    deleteUrl,
-	})
+	writeJson(w, http.StatusCreated, urls) // it was a success!
 	return nil
 }
 
@@ -124,30 +83,50 @@ func getFileDetails(r *http.Request) (fileName string, fileId string) {
 func (s *Server) handleFileView(w http.ResponseWriter, r *http.Request) error {
 	fileName, fileId := getFileDetails(r)
 
-	// make sure the file exists (this is quicker than the sql query???)
-	cleanPath := filepath.Clean(fileName) // prevent path traversal -- which should be impossible anyway
-	diskPath := path.Join(s.cfg.FSPath, cleanPath)
-
-	f, err := os.Open(diskPath)
-	if err != nil {
+	var upload types.Upload
+	if err := s.db.Get(&upload, `SELECT "id", "mime", "uploaded_at", "uploaded_as", "ext", "blob", "expires_at", "burn_after_read", "user", "password_hash", "visibility" FROM "uploads" WHERE "id" = $1`, fileId); err != nil || fileName != upload.Id+upload.Extension {
 		return PublicError{http.StatusNotFound, "File not found."}
 	}
-	defer f.Close()
 
-	var upload types.Upload
-	if err := s.db.Get(&upload, `SELECT "mime", "uploaded_as" FROM "uploads" WHERE "id" = $1`, fileId); err != nil {
-		// This means the file exists on disk but not in the database??
+	if isExpired(upload) {
+		return PublicError{http.StatusGone, "This file has expired."}
+	}
+
+	if ok, err := s.checkAccess(w, r, upload); !ok {
 		return err
 	}
 
-	setCacheControlHeaders(w)
-	w.Header().Set("Content-Type", upload.MimeType)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", strings.ReplaceAll(upload.UploadedAs, "\"", "\\\"")))
-	w.WriteHeader(200)
+	if upload.BurnAfterRead {
+		return s.serveBurnAfterRead(w, r, upload)
+	}
+
+	disposition := fmt.Sprintf("inline; filename=\"%s\"", strings.ReplaceAll(upload.UploadedAs, "\"", "\\\""))
+
+	// If the storage backend lets clients download objects directly, send them there
+	// instead of streaming the whole file through us.
+	if p, ok := s.store.(storage.Presigner); ok && s.cfg.S3.PresignSeconds > 0 {
+		expiry := time.Duration(s.cfg.S3.PresignSeconds) * time.Second
+		u, err := p.PresignGet(r.Context(), originalName(upload), expiry, url.Values{
+			"response-content-type":        {upload.MimeType},
+			"response-content-disposition": {disposition},
+		})
+		if err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+		return nil
+	}
 
-	if _, err := io.Copy(w, f); err != nil {
+	f, err := s.store.Get(r.Context(), originalName(upload))
+	if err != nil {
+		// This means the file is in the database but not in storage??
 		return err
 	}
+	defer f.Close()
+
+	w.Header().Set("Content-Disposition", disposition)
+	serveContent(w, r, upload, upload.MimeType, contentETag(upload, ""), f)
 
 	return nil
 }
@@ -159,92 +138,94 @@ func (s *Server) handleBubbleView(w http.ResponseWriter, r *http.Request) error
 		return PublicError{http.StatusBadRequest, "Bubble images can only be generated into GIFs or PNGs."}
 	}
 
-	diskPath := path.Join(s.cfg.FSPath, fileId+".bubble"+ext)
-
 	var upload types.Upload
 	if err := s.db.Get(&upload, `SELECT * FROM "uploads" WHERE "id" = $1`, fileId); err != nil {
 		return PublicError{http.StatusNotFound, "File not found."}
 	}
 
-	if f, err := os.Open(diskPath); err == nil {
-		defer f.Close()
+	if isExpired(upload) {
+		return PublicError{http.StatusGone, "This file has expired."}
+	}
 
-		w.Header().Set("Content-Type", upload.MimeType)
-		w.WriteHeader(http.StatusOK)
-		if _, err = io.Copy(w, f); err != nil {
-			return err
-		}
-		return nil
+	// Derivatives would let people see a one-time file without burning it.
+	if upload.BurnAfterRead {
+		return PublicError{http.StatusNotFound, "File not found."}
 	}
 
-	if upload.MimeType != "image/png" && upload.MimeType != "image/jpeg" {
-		return PublicError{http.StatusBadRequest, "The original asset must be either a PNG or GIF."}
+	if ok, err := s.checkAccess(w, r, upload); !ok {
+		return err
 	}
 
-	f, err := os.Open(path.Join(s.cfg.FSPath, fileId+upload.Extension))
-	if err != nil {
-		return nil
+	q := r.URL.Query()
+	pos := q.Get("pos")
+	if pos == "" {
+		pos = "top"
+	}
+	if pos != "top" && pos != "bottom" {
+		return PublicError{http.StatusBadRequest, "pos must be top or bottom."}
 	}
-	defer f.Close()
 
-	bubbled, err := s.MakeBubbleImage(upload.MimeType, f)
+	mask, err := s.resolveMask(r.Context(), upload.User, q.Get("mask"))
 	if err != nil {
 		return err
 	}
+	drawer := bubble.Drawer{Mask: mask.Alpha, Bottom: pos == "bottom", Flip: formBool(q.Get("flip"))}
 
-	enc := new(bytes.Buffer)
-	switch ext {
-	case ".png":
-		if err := png.Encode(enc, bubbled); err != nil {
-			return err
-		}
-	case ".jpg", ".jpeg":
-		if err := jpeg.Encode(enc, bubbled, &jpeg.Options{Quality: 75}); err != nil { // 75 quality is good enough for most text
-			return err
+	// Bubbles with the default mask and position keep the name they always had.
+	bubbleName, variant := fileId+".bubble"+ext, "bubble"+ext
+	if mask.Key != bubble.DefaultMask || drawer.Bottom || drawer.Flip {
+		variant = mask.Key + "-" + pos
+		if drawer.Flip {
+			variant += "-flip"
 		}
-	case ".gif":
-		buff, err := s.ImageToGif(bubbled)
-		if err != nil {
-			return err
-		}
-		if _, err := io.Copy(enc, buff); err != nil {
-			return err
-		}
-	}
+		variant += ext
 
-	nf, err := os.Create(diskPath)
-	if err != nil {
-		return err
+		bubbleName = bubbleVariantPrefix(fileId) + variant
+		variant = "bubbles/" + variant
 	}
-	defer nf.Close()
 
-	if _, err := io.Copy(nf, enc); err != nil {
-		return err
-	}
+	contentType := mime.TypeByExtension(ext)
+	etag := contentETag(upload, variant)
 
-	if f, err := os.Open(diskPath); err == nil {
+	if f, err := s.store.Get(r.Context(), bubbleName); err == nil {
 		defer f.Close()
 
-		w.Header().Set("Content-Type", upload.MimeType)
-		w.WriteHeader(http.StatusOK)
-		if _, err = io.Copy(w, f); err != nil {
-			return err
-		}
+		serveContent(w, r, upload, contentType, etag, f)
 		return nil
 	}
 
+	if !CanDecode(upload.MimeType) {
+		return PublicError{http.StatusBadRequest, "Bubble images can't be made from this kind of file."}
+	}
+
+	bubbled, err := s.derivative(r.Context(), upload.Id, bubbleName, func(ctx context.Context) ([]byte, error) {
+		return s.generateBubble(ctx, upload, ext, drawer)
+	})
+	if err != nil {
+		return err
+	}
+
+	serveContent(w, r, upload, contentType, etag, bytes.NewReader(bubbled))
 	return nil
 }
 
 // handleThumbnailView handles people viewing the thumbnail images of files. The thumbnails are
-// always 480x270, and pngs.
+// always pngs, in one of the configured sizes (or the default size if there isn't one in the url).
 func (s *Server) handleThumbnailView(w http.ResponseWriter, r *http.Request) error {
-	fileName, fileId := getFileDetails(r)
-	diskPath := path.Join(s.cfg.FSPath, fileId+".thumbnail.png")
-	originalDiskPath := path.Join(s.cfg.FSPath, filepath.Clean(fileName))
+	_, fileId := getFileDetails(r)
 
-	var mimeType string
-	if err := s.db.Get(&mimeType, `SELECT "mime" FROM "uploads" WHERE "id" = $1`, fileId); err != nil {
+	sizeName := chi.URLParam(r, "size")
+	if sizeName == "" {
+		sizeName = DefaultThumbnailSize
+	}
+
+	size, ok := s.thumbnailSize(sizeName)
+	if !ok {
+		return PublicError{http.StatusNotFound, "Thumbnail size not Found."}
+	}
+
+	var upload types.Upload
+	if err := s.db.Get(&upload, `SELECT "id", "mime", "uploaded_at", "ext", "blob", "expires_at", "burn_after_read", "user", "password_hash", "visibility" FROM "uploads" WHERE "id" = $1`, fileId); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return PublicError{http.StatusNotFound, "File not Found."}
 		}
@@ -252,21 +233,32 @@ func (s *Server) handleThumbnailView(w http.ResponseWriter, r *http.Request) err
 		return err
 	}
 
+	if isExpired(upload) {
+		return PublicError{http.StatusGone, "This file has expired."}
+	}
+
+	// Derivatives would let people see a one-time file without burning it.
+	if upload.BurnAfterRead {
+		return PublicError{http.StatusNotFound, "File not Found."}
+	}
+
+	if ok, err := s.checkAccess(w, r, upload); !ok {
+		return err
+	}
+	thumbName, thumbType := s.thumbnailNameAndType(upload, size)
+	etag := contentETag(upload, strings.TrimPrefix(thumbName, fileId+"."))
+
 	// We already have the thumbnail image cached.
-	if f, err := os.Open(diskPath); err == nil {
+	if f, err := s.store.Get(r.Context(), thumbName); err == nil {
 		defer f.Close()
-		w.Header().Set("Content-Type", mimeType)
-		w.WriteHeader(http.StatusOK)
-		if _, err = io.Copy(w, f); err != nil {
-			return err
-		}
 
+		serveContent(w, r, upload, thumbType, etag, f)
 		return nil
 	}
 
 	// If the file isn't one of the allowed thumbnail types, we
 	// return the default thumbnail.
-	if !slices.Contains(AllowedThumbnailMimeTypes, mimeType) {
+	if !CanDecode(upload.MimeType) {
 		defaultThumbnailPath, err := url.JoinPath(s.cfg.BasePath, "/assets/img/default_thumbnail.png")
 		if err != nil {
 			return err
@@ -276,58 +268,52 @@ func (s *Server) handleThumbnailView(w http.ResponseWriter, r *http.Request) err
 		return nil
 	}
 
-	origFile, err := os.Open(originalDiskPath)
+	thumb, err := s.derivative(r.Context(), upload.Id, thumbName, func(ctx context.Context) ([]byte, error) {
+		return s.generateThumbnail(ctx, upload, size)
+	})
 	if err != nil {
 		return err
 	}
-	defer origFile.Close()
 
-	thumb, err := s.MakeThumbnail(mimeType, origFile)
-	if err != nil {
-		return err
-	}
+	serveContent(w, r, upload, thumbType, etag, bytes.NewReader(thumb))
+	return nil
+}
 
-	outFile, err := os.Create(diskPath)
-	if err != nil {
+// handleConfirmDelete asks browsers to confirm deleting a file, so link previews and
+// prefetching can't delete it by visiting the delete url. Other clients delete it right away.
+func (s *Server) handleConfirmDelete(w http.ResponseWriter, r *http.Request) error {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		HandlerWithError(s.handleDeleteFile).ServeHTTP(w, r) // keep JSON errors for scripts
 		return nil
 	}
-	defer outFile.Close()
-
-	if _, err = io.Copy(outFile, thumb); err != nil {
-		return err
-	}
-	outFile.Close()
 
-	if f, err := os.Open(diskPath); err == nil {
-		defer f.Close()
-		setCacheControlHeaders(w)
-		w.Header().Set("Content-Type", mimeType)
-		w.WriteHeader(http.StatusOK)
-		if _, err = io.Copy(w, f); err != nil {
-			return err
-		}
+	fileId := chi.URLParam(r, "fileId")
+	deleteToken := chi.URLParam(r, "deleteToken")
 
-		return nil
+	var upload types.Upload
+	if err := s.db.Get(&upload, `SELECT "id", "ext" FROM "uploads" WHERE "id" = $1 AND "delete_token" = $2`, fileId, deleteToken); err != nil {
+		return PublicError{http.StatusNotFound, "File upload not found or delete token is incorrect."}
 	}
 
-	return errors.New("thumbnail created, but not saved to disk")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	return writeHTML(w, r, http.StatusOK, pages.ConfirmDelete(upload.Id+upload.Extension, r.URL.Path))
 }
 
 func (s *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) error {
 	fileId := chi.URLParam(r, "fileId")
 	deleteToken := chi.URLParam(r, "deleteToken")
-	// todo: delete main image and thumbnail
 
-	var fileExt string
-	if err := s.db.Get(&fileExt, `DELETE FROM "uploads" WHERE "id" = $1 AND "delete_token" = $2 RETURNING "ext"`, fileId, deleteToken); err != nil {
-		return PublicError{http.StatusNotFound, "File upload not found or delete token is incorrect."}
-	}
+	upload, derivatives, err := s.deleteUpload(r.Context(), `DELETE FROM "uploads" WHERE "id" = $1 AND "delete_token" = $2 RETURNING "id", "ext", "blob"`, fileId, deleteToken)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return PublicError{http.StatusNotFound, "File upload not found or delete token is incorrect."}
+		}
 
-	if err := os.Remove(path.Join(s.cfg.FSPath, "/"+fileId+fileExt)); err != nil {
 		return err
 	}
 
-	if err := os.Remove(path.Join(s.cfg.FSPath, "/"+fileId+".thumbnail.png")); err != nil && !errors.Is(err, os.ErrNotExist) {
+	if err := s.deleteUploadFiles(r.Context(), upload, derivatives); err != nil {
 		return err
 	}
 
@@ -335,7 +321,13 @@ func (s *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) error
 	return nil
 }
 
-func setCacheControlHeaders(w http.ResponseWriter) {
+func setCacheControlHeaders(w http.ResponseWriter, up types.Upload) {
+	if up.PasswordHash != "" || up.Visibility == types.VisibilityPrivate {
+		// Shared caches must not hand protected files to people that can't see them.
+		w.Header().Set("Cache-Control", "private, max-age=1800")
+		return
+	}
+
 	w.Header().Set("Cache-Control", "public, max-age=1800") // 30 min cache time
 }
 
@@ -347,6 +339,12 @@ func (s *Server) handleRunImport(w http.ResponseWriter, r *http.Request) {
 
 	_ = userName
 
+	// EventSource can't send headers, so the import page sends the token in the query.
+	if !checkCSRFToken(r, r.URL.Query().Get(csrfFieldName)) {
+		http.Error(w, "The page has expired, reload it and try again.", http.StatusForbidden)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.WriteHeader(http.StatusOK)
@@ -435,10 +433,13 @@ func (s *Server) handleRunImport(w http.ResponseWriter, r *http.Request) {
 		for _, up := range uploads {
 			_ = writeNormalMessage(typeInfo, "Handling file with ID: "+up.Id)
 
-			fullPath := path.Join(s.cfg.FSPath, up.Id+up.Extension)
-
-			if _, err := os.Stat(fullPath); err == nil {
-				_ = writeNormalMessage(typeInfo, "Skipping "+up.Id+" because a file already exists on our FS.")
+			var exists bool
+			if err := s.db.Get(&exists, `SELECT EXISTS (SELECT 1 FROM "uploads" WHERE "id" = $1)`, up.Id); err != nil {
+				_ = writeNormalMessage(typeFail, "Failed to check if a file with id "+up.Id+" already exists: "+err.Error())
+				continue
+			}
+			if exists {
+				_ = writeNormalMessage(typeInfo, "Skipping "+up.Id+" because a file with the same id already exists.")
 				continue
 			}
 
@@ -450,6 +451,12 @@ func (s *Server) handleRunImport(w http.ResponseWriter, r *http.Request) {
 				mimeType = "image/jpeg"
 			case ".gif":
 				mimeType = "image/gif"
+			case ".webp":
+				mimeType = "image/webp"
+			case ".bmp":
+				mimeType = "image/bmp"
+			case ".tif", ".tiff":
+				mimeType = "image/tiff"
 			case ".txt":
 				mimeType = "text/plain"
 			case ".bin":
@@ -468,25 +475,19 @@ func (s *Server) handleRunImport(w http.ResponseWriter, r *http.Request) {
 				mimeType = "application/pdf"
 			}
 
-			// insert into THE REAL db
-			if _, err := s.db.Exec(`INSERT INTO "uploads" ("id", "mime", "user", "uploaded_at", "uploaded_as", "delete_token", "ext") VALUES ($1, $2, $3, $4, $5, $6, $7)`, up.Id, mimeType, userName, time.Now().Unix(), up.UploadedAs, up.DeleteToken, up.Extension); err != nil {
-				_ = writeNormalMessage(typeFail, "Failed to insert file "+up.Id+" into the database: "+err.Error())
-				continue
-			}
-
-			// store on the file system
-			f, err := os.Create(fullPath)
+			// store in the storage backend
+			hash, _, err := s.acquireBlob(r.Context(), bytes.NewReader(up.DataBlob))
 			if err != nil {
-				_ = writeNormalMessage(typeFail, "Failed to create disk file "+up.Id+": "+err.Error())
+				_ = writeNormalMessage(typeFail, "Failed to write to file with id "+up.Id+": "+err.Error())
 				continue
 			}
 
-			_, err = f.Write(up.DataBlob)
-			if err != nil {
-				_ = writeNormalMessage(typeFail, "Failed to write to file with id "+up.Id+": "+err.Error())
+			// insert into THE REAL db
+			if _, err := s.db.Exec(`INSERT INTO "uploads" ("id", "mime", "user", "uploaded_at", "uploaded_as", "delete_token", "ext", "blob") VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, up.Id, mimeType, userName, time.Now().Unix(), up.UploadedAs, up.DeleteToken, up.Extension, hash); err != nil {
+				_ = writeNormalMessage(typeFail, "Failed to insert file "+up.Id+" into the database: "+err.Error())
+				_ = s.releaseBlob(r.Context(), hash)
+				continue
 			}
-
-			f.Close()
 		}
 
 		if len(uploads) < perPage {
@@ -516,44 +517,17 @@ func (s *Server) handleCaptiveUpload(w http.ResponseWriter, r *http.Request) err
 		return err
 	}
 
-	fileId, err := s.getFreeFileId(FileIdLength)
-	if err != nil {
-		fmt.Println(err)
-		return PublicError{http.StatusInternalServerError, "failed to generate id"}
-	}
-
-	mimeType := header.Header.Get("Content-Type")
-	if mimeType == "" {
-		mimeType = "application/octet-stream" // default for binary data
-	}
-
-	ext := path.Ext(header.Filename)
-	diskName := fileId + ext
-
-	// Handle storing the file
-	fullPath := path.Join(s.cfg.FSPath, diskName)
-	f, err := os.Create(fullPath)
+	opts, err := s.parseUploadOptions(userName, r.FormValue)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	n, err := io.Copy(f, uploadedFile)
+	up, n, err := s.storeUpload(r.Context(), userName, header.Filename, header.Header.Get("Content-Type"), uploadedFile, opts)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("User '%s' uploaded file (using a captive upload) '%s' (%s), n=%d\n", userName, header.Filename, diskName, n)
-
-	// Handle storing the upload in the database
-	deleteToken := s.generateDeleteToken(32)
-	if _, err := s.db.Exec(`INSERT INTO "uploads" ("id", "mime", "user", "uploaded_at", "uploaded_as", "delete_token", "ext") VALUES ($1, $2, $3, $4, $5, $6, $7)`, fileId, mimeType, userName, time.Now().Unix(), header.Filename, deleteToken, ext); err != nil {
-		// If we fail the database query we need to delete the file
-		f.Close()
-		_ = os.Remove(fullPath) // if we error here it's already too late
-
-		return err
-	}
+	log.Printf("User '%s' uploaded file (using a captive upload) '%s' (%s), n=%d\n", userName, header.Filename, up.Id+up.Extension, n)
 
 	// Reutrn the user where they used to be
 	returnTo := r.FormValue("return-to")
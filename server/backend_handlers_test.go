@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/liondadev/quick-image-server/config"
+	"github.com/liondadev/quick-image-server/server/storage"
+)
+
+// presigningStore is a backend that can presign urls, and counts how often objects are
+// opened.
+type presigningStore struct {
+	storage.Backend
+	gets int
+}
+
+func (p *presigningStore) Get(ctx context.Context, name string) (storage.Object, error) {
+	p.gets++
+	return p.Backend.Get(ctx, name)
+}
+
+func (p *presigningStore) PresignGet(ctx context.Context, name string, expiry time.Duration, params url.Values) (*url.URL, error) {
+	params.Set("expiry", expiry.String())
+	return &url.URL{Scheme: "https", Host: "bucket.test", Path: "/" + name, RawQuery: params.Encode()}, nil
+}
+
+func TestFileViewPresigns(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.S3.PresignSeconds = 60
+	})
+	store := &presigningStore{Backend: s.store}
+	s.store = store
+
+	newTestKey(t, s, "alice", []string{ScopeUpload}, time.Time{})
+	up := newTestUpload(t, s, "alice", "hello.txt", "text/plain", []byte("hello"), uploadOptions{})
+
+	res := serve(s, httptest.NewRequest(http.MethodGet, "/f/"+up.Id+up.Extension, nil))
+	if res.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusTemporaryRedirect)
+	}
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Host != "bucket.test" || location.Query().Get("expiry") != "1m0s" || location.Query().Get("response-content-type") != "text/plain" {
+		t.Errorf("got redirected to %s, want a presigned url valid for a minute", location)
+	}
+
+	// The client downloads it from the bucket, so there's no need to open it ourselves.
+	if store.gets != 0 {
+		t.Errorf("the object was opened %d times", store.gets)
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/liondadev/quick-image-server/server/storage"
+	"github.com/liondadev/quick-image-server/types"
+)
+
+// Uploads are stored content-addressed: the contents of every file are stored once
+// as a blob named after their SHA-256 hash, and uploads reference the blob. The
+// blobs table keeps count of how many uploads reference each blob, so the blob is
+// only removed when the last upload using it is deleted.
+
+// blobName returns the name of the object a blob is stored as.
+func blobName(hash string) string {
+	return "blobs/" + hash[:2] + "/" + hash
+}
+
+// maxBlobStoreAttempts is how often we try to store a blob without holding the lock,
+// before storing it while holding it because someone keeps releasing the last reference
+// to the same contents at the same time.
+const maxBlobStoreAttempts = 3
+
+// originalName returns the name of the object the original file of an upload is
+// stored as. Uploads from before deduplication still use their id as the name.
+func originalName(up types.Upload) string {
+	if up.Blob == "" {
+		return up.Id + up.Extension
+	}
+
+	return blobName(up.Blob)
+}
+
+// acquireBlob stores everything read from r as a blob, unless it's already stored, and
+// takes a reference to it. Every reference must eventually be given back with releaseBlob.
+func (s *Server) acquireBlob(ctx context.Context, r io.Reader) (hash string, n int64, err error) {
+	// The contents are spooled to a temporary file while we hash them, since we can
+	// only know the name of the blob once we've read everything.
+	tmp, err := os.CreateTemp("", "quick-image-server-blob-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return "", 0, err
+	}
+	hash = hex.EncodeToString(h.Sum(nil))
+
+	// Storing the blob can take a while, so it's done without holding the lock. That's
+	// fine since it's named after its contents, storing it twice just stores the same
+	// thing again. The lock is only needed so a blob that's being released isn't removed
+	// from storage right after we decided it's there, which is checked again before taking
+	// the reference in case that happened while we were storing it.
+	for attempt := 0; attempt < maxBlobStoreAttempts; attempt++ {
+		stored, err := s.takeBlobIfStored(ctx, hash, n)
+		if err != nil {
+			return "", 0, err
+		}
+		if stored {
+			return hash, n, nil
+		}
+
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return "", 0, err
+		}
+		if _, err := s.store.Put(ctx, blobName(hash), tmp); err != nil {
+			return "", 0, fmt.Errorf("store blob: %w", err)
+		}
+	}
+
+	// It keeps being removed right after we store it, so store it while holding the lock,
+	// which nobody can race.
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	if err := s.storeAndTakeBlob(ctx, hash, n, tmp); err != nil {
+		return "", 0, err
+	}
+
+	return hash, n, nil
+}
+
+// takeBlobIfStored takes a reference to a blob if it's in storage, and returns whether it
+// was.
+func (s *Server) takeBlobIfStored(ctx context.Context, hash string, size int64) (bool, error) {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	if _, err := s.store.Stat(ctx, blobName(hash)); err != nil {
+		if errors.Is(err, storage.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if err := s.takeBlob(hash, size); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// storeAndTakeBlob stores a blob and takes a reference to it, holding the lock the whole
+// time.
+func (s *Server) storeAndTakeBlob(ctx context.Context, hash string, size int64, r io.Reader) error {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	if _, err := s.store.Put(ctx, blobName(hash), r); err != nil {
+		return fmt.Errorf("store blob: %w", err)
+	}
+
+	return s.takeBlob(hash, size)
+}
+
+// takeBlob takes a reference to a stored blob. The caller must hold blobMu.
+func (s *Server) takeBlob(hash string, size int64) error {
+	_, err := s.db.Exec(`INSERT INTO "blobs" ("hash", "size", "refs", "created_at") VALUES ($1, $2, 1, $3) ON CONFLICT ("hash") DO UPDATE SET "refs" = "refs" + 1`, hash, size, time.Now().Unix())
+	return err
+}
+
+// releaseBlob gives back a reference to a blob taken by acquireBlob, removing the blob
+// from storage if nothing references it anymore.
+func (s *Server) releaseBlob(ctx context.Context, hash string) error {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	var refs int
+	if err := s.db.Get(&refs, `UPDATE "blobs" SET "refs" = "refs" - 1 WHERE "hash" = $1 RETURNING "refs"`, hash); err != nil {
+		return fmt.Errorf("release blob %s: %w", hash, err)
+	}
+
+	if refs > 0 {
+		return nil
+	}
+
+	if _, err := s.db.Exec(`DELETE FROM "blobs" WHERE "hash" = $1`, hash); err != nil {
+		return err
+	}
+
+	if err := s.store.Delete(ctx, blobName(hash)); err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// DedupeLegacyUploads moves the files of uploads from before deduplication into the
+// blob store, so identical files are only stored once. It's safe to run more than once.
+func (s *Server) DedupeLegacyUploads(ctx context.Context, logf func(format string, args ...any)) error {
+	var uploads []types.Upload
+	if err := s.db.Select(&uploads, `SELECT * FROM "uploads" WHERE "blob" = ''`); err != nil {
+		return err
+	}
+
+	logf("Found %d uploads that aren't deduplicated yet.", len(uploads))
+
+	for _, up := range uploads {
+		legacyName := up.Id + up.Extension
+
+		f, err := s.store.Get(ctx, legacyName)
+		if err != nil {
+			logf("Skipping %s: failed to open %s: %s", up.Id, legacyName, err.Error())
+			continue
+		}
+
+		hash, _, err := s.acquireBlob(ctx, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("acquire blob for %s: %w", up.Id, err)
+		}
+
+		if _, err := s.db.Exec(`UPDATE "uploads" SET "blob" = $1 WHERE "id" = $2`, hash, up.Id); err != nil {
+			_ = s.releaseBlob(ctx, hash)
+			return fmt.Errorf("update upload %s: %w", up.Id, err)
+		}
+
+		if err := s.store.Delete(ctx, legacyName); err != nil && !errors.Is(err, storage.ErrNotExist) {
+			logf("Failed to remove %s after moving it to blob %s: %s", legacyName, hash, err.Error())
+		}
+
+		logf("Moved %s to blob %s.", up.Id, hash)
+	}
+
+	return nil
+}
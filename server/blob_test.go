@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/liondadev/quick-image-server/config"
+	"github.com/liondadev/quick-image-server/server/storage"
+)
+
+// blobRefs returns how many references the blob has, or -1 if it has no row.
+func blobRefs(t *testing.T, s *Server, hash string) int {
+	t.Helper()
+
+	var refs []int
+	if err := s.db.Select(&refs, `SELECT "refs" FROM "blobs" WHERE "hash" = $1`, hash); err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) == 0 {
+		return -1
+	}
+
+	return refs[0]
+}
+
+// blobStored checks if the blob is in storage.
+func blobStored(t *testing.T, s *Server, hash string) bool {
+	t.Helper()
+
+	_, err := s.store.Stat(context.Background(), blobName(hash))
+	if err != nil && !errors.Is(err, storage.ErrNotExist) {
+		t.Fatal(err)
+	}
+
+	return err == nil
+}
+
+func TestBlobsAreShared(t *testing.T) {
+	s := newTestServer(t, nil)
+	newTestKey(t, s, "alice", []string{ScopeUpload}, time.Time{})
+	ctx := context.Background()
+
+	first := newTestUpload(t, s, "alice", "a.txt", "text/plain", []byte("same"), uploadOptions{})
+	second := newTestUpload(t, s, "alice", "b.txt", "text/plain", []byte("same"), uploadOptions{})
+	other := newTestUpload(t, s, "alice", "c.txt", "text/plain", []byte("other"), uploadOptions{})
+
+	if first.Blob != second.Blob || first.Blob == other.Blob {
+		t.Fatalf("got blobs %s, %s and %s, want the first two to be the same", first.Blob, second.Blob, other.Blob)
+	}
+	if refs := blobRefs(t, s, first.Blob); refs != 2 {
+		t.Errorf("the shared blob has %d references, want 2", refs)
+	}
+
+	del := func(id string) {
+		up, derivatives, err := s.deleteUpload(ctx, `DELETE FROM "uploads" WHERE "id" = $1 RETURNING "id", "ext", "blob"`, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.deleteUploadFiles(ctx, up, derivatives); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	del(first.Id)
+	if refs := blobRefs(t, s, first.Blob); refs != 1 || !blobStored(t, s, first.Blob) {
+		t.Fatalf("after deleting one upload, the blob has %d references and is stored: %v", refs, blobStored(t, s, first.Blob))
+	}
+
+	f, err := s.store.Get(ctx, originalName(second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "same" {
+		t.Errorf("the other upload reads %q, want \"same\"", data)
+	}
+
+	del(second.Id)
+	if refs := blobRefs(t, s, first.Blob); refs != -1 || blobStored(t, s, first.Blob) {
+		t.Errorf("after deleting both uploads, the blob has %d references and is stored: %v", refs, blobStored(t, s, first.Blob))
+	}
+	if !blobStored(t, s, other.Blob) {
+		t.Error("an unrelated blob was removed")
+	}
+}
+
+func TestAcquireBlobConcurrently(t *testing.T) {
+	s := newTestServer(t, nil)
+	ctx := context.Background()
+
+	// Taking and releasing references at the same time must never leave a reference
+	// to a blob that isn't stored.
+	var wg sync.WaitGroup
+	hashes := make(chan string, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			hash, _, err := s.acquireBlob(ctx, strings.NewReader("contents"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if i%2 == 0 {
+				if err := s.releaseBlob(ctx, hash); err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			hashes <- hash
+		}()
+	}
+	wg.Wait()
+	close(hashes)
+
+	var hash string
+	for h := range hashes {
+		hash = h
+	}
+	if refs := blobRefs(t, s, hash); refs != 8 {
+		t.Errorf("the blob has %d references, want 8", refs)
+	}
+	if !blobStored(t, s, hash) {
+		t.Error("the blob isn't stored")
+	}
+}
+
+func TestImportSkipsExistingFiles(t *testing.T) {
+	importDir := t.TempDir()
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.BaseImportPath = importDir
+	})
+	key, _ := newTestKey(t, s, "alice", []string{ScopeImport, ScopeUpload}, time.Time{})
+	existing := newTestUpload(t, s, "alice", "mine.txt", "text/plain", []byte("mine"), uploadOptions{})
+
+	legacy, err := sqlx.Open("sqlite", filepath.Join(importDir, "legacy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+
+	legacy.MustExec(`CREATE TABLE "files" ("id" TEXT PRIMARY KEY, "ext" TEXT, "blob" BLOB, "original_filename" TEXT, "delete_token" TEXT)`)
+	legacy.MustExec(`INSERT INTO "files" VALUES ($1, '.txt', 'theirs', 'theirs.txt', 'token'), ('newfile', '.png', 'new', 'new.png', 'token')`, existing.Id)
+
+	csrf := strings.Repeat("a", csrfTokenLength)
+	r := httptest.NewRequest(http.MethodGet, "/import-api?"+url.Values{"fileName": {"legacy.db"}, csrfFieldName: {csrf}}.Encode(), nil)
+	r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: csrf})
+	r.Header.Set("X-Server-Api-Key", key)
+	res := serve(s, r)
+
+	events, _ := io.ReadAll(res.Body)
+	if !bytes.Contains(events, []byte("Skipping "+existing.Id)) {
+		t.Errorf("the existing file wasn't skipped:\n%s", events)
+	}
+
+	var uploads []struct {
+		Id   string `db:"id"`
+		Mime string `db:"mime"`
+		Blob string `db:"blob"`
+	}
+	if err := s.db.Select(&uploads, `SELECT "id", "mime", "blob" FROM "uploads" ORDER BY "id"`); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 2 {
+		t.Fatalf("got %d uploads, want 2: %+v", len(uploads), uploads)
+	}
+	for _, up := range uploads {
+		switch up.Id {
+		case existing.Id:
+			if up.Blob != existing.Blob {
+				t.Error("the existing upload was overwritten")
+			}
+		case "newfile":
+			if up.Mime != "image/png" {
+				t.Errorf("the imported file has mime type %q, want image/png", up.Mime)
+			}
+		default:
+			t.Errorf("unexpected upload %s", up.Id)
+		}
+	}
+	if refs := blobRefs(t, s, existing.Blob); refs != 1 {
+		t.Errorf("the existing blob has %d references, want 1", refs)
+	}
+}
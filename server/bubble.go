@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	_ "embed"
 	"fmt"
 	"github.com/liondadev/quick-image-server/server/bubble"
@@ -14,6 +15,7 @@ import (
 	"io"
 
 	"github.com/ericpauley/go-quantize/quantize"
+	"github.com/liondadev/quick-image-server/types"
 )
 
 // normalizeImage takes a normal image.Image and turns into
@@ -29,30 +31,24 @@ func normalizeImage(img image.Image) draw.Image {
 	return drawImg
 }
 
-// MakeBubbleImage creates one of those discord bubble images with the speech bubble over an image.
-func (s *Server) MakeBubbleImage(mime string, original io.Reader) (image.Image, error) {
-	var src image.Image
+// bubbleVariantPrefix is the prefix of the names bubbles of an upload are stored as, when
+// they're drawn with another mask or position than the default.
+func bubbleVariantPrefix(fileId string) string {
+	return "bubbles/" + fileId + "/"
+}
 
-	switch mime {
-	case "image/jpeg":
-		dec, err := jpeg.Decode(original)
-		if err != nil {
-			return nil, fmt.Errorf("decode jpeg: %w", err)
-		}
-		src = dec
-	case "image/png":
-		dec, err := png.Decode(original)
-		if err != nil {
-			return nil, fmt.Errorf("decode png: %w", err)
-		}
-		src = dec
-	default:
-		return nil, fmt.Errorf("mime type '%s' can't be used to create bubble images", mime)
+// MakeBubbleImage creates one of those discord bubble images with the speech bubble over an image.
+// The drawer decides the mask and where it goes, its Base isn't used.
+func (s *Server) MakeBubbleImage(mime string, original io.Reader, drawer bubble.Drawer) (image.Image, error) {
+	src, err := decodeImage(mime, original, s.maxImagePixels())
+	if err != nil {
+		return nil, fmt.Errorf("mime type '%s' can't be used to create bubble images: %w", mime, err)
 	}
 
 	// Ensure we have a draw.Image, unlike the jpeg library.
 	dst := normalizeImage(src)
-	bubble.StdDrawer.Draw(dst, dst.Bounds(), dst, image.Point{})
+	drawer.Base = nil
+	drawer.Draw(dst, dst.Bounds(), dst, image.Point{})
 
 	return dst, nil
 }
@@ -70,12 +66,103 @@ func (q TransparentQuantizer) Quantize(p color.Palette, m image.Image) color.Pal
 	return palette
 }
 
-// ImageToGif turns an image into a gif.
-func (s *Server) ImageToGif(img image.Image) (io.Reader, error) {
+// ImageToGif turns a bubble image made with the drawer into a gif.
+func (s *Server) ImageToGif(img image.Image, drawer bubble.Drawer) (io.Reader, error) {
+	drawer.Base = draw.FloydSteinberg
 	buff := bytes.Buffer{}
-	if err := gif.Encode(&buff, img, &gif.Options{Quantizer: TransparentQuantizer{quantize.MedianCutQuantizer{}}, Drawer: bubble.Drawer{Base: draw.FloydSteinberg, Mask: bubble.Mask}}); err != nil {
-		return nil, nil
+	if err := gif.Encode(&buff, img, &gif.Options{Quantizer: TransparentQuantizer{quantize.MedianCutQuantizer{}}, Drawer: &drawer}); err != nil {
+		return nil, err
 	}
 
 	return &buff, nil
 }
+
+// MakeAnimatedBubbleGif creates a bubble gif from an animated gif, with the speech bubble over
+// every frame. The timing and loop count of the original are kept, and every frame shares
+// one palette so the bubble stays transparent throughout. Gifs over the animated bubble
+// limits only get the bubble over their first frame.
+func (s *Server) MakeAnimatedBubbleGif(original io.Reader, sourceSize int64, drawer bubble.Drawer) (io.Reader, error) {
+	limits := animationLimits(s.cfg.AnimatedBubbles)
+	if sourceSize > limits.MaxSourceBytes {
+		return s.firstFrameBubbleGif(original, drawer)
+	}
+
+	// We need to read it twice if we end up falling back to the first frame.
+	data, err := io.ReadAll(original)
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := decodeAnimation(data, limits)
+	if err != nil {
+		return nil, err
+	}
+	if g == nil || len(g.Image) < 2 {
+		return s.firstFrameBubbleGif(bytes.NewReader(data), drawer)
+	}
+
+	drawer.Base = draw.FloydSteinberg
+	return encodeSharedPalette(g, nil, &drawer)
+}
+
+// firstFrameBubbleGif creates a bubble gif out of only the first frame of a gif.
+func (s *Server) firstFrameBubbleGif(original io.Reader, drawer bubble.Drawer) (io.Reader, error) {
+	bubbled, err := s.MakeBubbleImage("image/gif", original, drawer)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.ImageToGif(bubbled, drawer)
+}
+
+// generateBubble makes a bubble image of an upload, in the format of ext.
+func (s *Server) generateBubble(ctx context.Context, up types.Upload, ext string, drawer bubble.Drawer) ([]byte, error) {
+	f, err := s.store.Get(ctx, originalName(up))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	enc := new(bytes.Buffer)
+	if ext == ".gif" && up.MimeType == "image/gif" {
+		// Animated gifs get the bubble on every frame.
+		info, err := s.store.Stat(ctx, originalName(up))
+		if err != nil {
+			return nil, err
+		}
+
+		buff, err := s.MakeAnimatedBubbleGif(f, info.Size, drawer)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(enc, buff); err != nil {
+			return nil, err
+		}
+	} else {
+		bubbled, err := s.MakeBubbleImage(up.MimeType, f, drawer)
+		if err != nil {
+			return nil, err
+		}
+
+		switch ext {
+		case ".png":
+			if err := png.Encode(enc, bubbled); err != nil {
+				return nil, err
+			}
+		case ".jpg", ".jpeg":
+			if err := jpeg.Encode(enc, bubbled, &jpeg.Options{Quality: 75}); err != nil { // 75 quality is good enough for most text
+				return nil, err
+			}
+		case ".gif":
+			buff, err := s.ImageToGif(bubbled, drawer)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := io.Copy(enc, buff); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return enc.Bytes(), nil
+}
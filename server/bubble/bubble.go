@@ -1,45 +1,125 @@
 package bubble
 
 import (
-	"bytes"
-	_ "embed"
+	"embed"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/png"
+	"path"
+	"slices"
+	"strings"
+	"sync"
 
 	"github.com/nfnt/resize"
 )
 
-//go:embed bubble_mask.png
-var bubbleMaskBytes []byte
+//go:embed masks/*.png
+var builtinMasks embed.FS
+
+// DefaultMask is the name of the built-in mask used when no other mask is asked for.
+const DefaultMask = "classic"
+
+// Builtin has the masks that are always available, by name.
+var Builtin = NewLibrary()
+
 var Mask *image.Alpha
 
 var StdDrawer *Drawer
 
 func init() {
-	img, err := png.Decode(bytes.NewReader(bubbleMaskBytes))
+	entries, err := builtinMasks.ReadDir("masks")
 	if err != nil {
 		panic(err)
 	}
 
+	for _, entry := range entries {
+		f, err := builtinMasks.Open(path.Join("masks", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			panic(err)
+		}
+
+		Builtin.Add(strings.TrimSuffix(entry.Name(), ".png"), MaskFromImage(img))
+	}
+
+	Mask, _ = Builtin.Get(DefaultMask)
+
+	StdDrawer = New(nil, Mask)
+}
+
+// MaskFromImage turns an image into a mask. The parts of the image that are fully opaque
+// are cut out of the images the mask is drawn over.
+func MaskFromImage(img image.Image) *image.Alpha {
 	alphaImage := image.NewAlpha(img.Bounds())
 	for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
 		for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
 			_, _, _, a := img.At(x, y).RGBA()
 
-			alphaImage.SetAlpha(x, y, color.Alpha{A: uint8(a)})
+			alphaImage.SetAlpha(x, y, color.Alpha{A: uint8(a >> 8)})
 		}
 	}
 
-	Mask = alphaImage
+	return alphaImage
+}
 
-	StdDrawer = New(nil, Mask)
+// Library is a set of masks by name. It's safe to use from multiple goroutines.
+type Library struct {
+	mu    sync.RWMutex
+	masks map[string]*image.Alpha
+}
+
+func NewLibrary() *Library {
+	return &Library{masks: make(map[string]*image.Alpha)}
+}
+
+// Add adds a mask to the library, replacing any mask with the same name.
+func (l *Library) Add(name string, mask *image.Alpha) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.masks[name] = mask
+}
+
+// Get returns the mask with the name.
+func (l *Library) Get(name string) (*image.Alpha, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	mask, ok := l.masks[name]
+	return mask, ok
 }
 
+// Names returns the names of every mask in the library, sorted.
+func (l *Library) Names() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	names := make([]string, 0, len(l.masks))
+	for name := range l.masks {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// Drawer cuts a mask out of the images it draws. It remembers the mask stretched to the
+// last width it drew at, so the frames of a gif don't each resize it again, which means a
+// Drawer can't be used from multiple goroutines at once.
 type Drawer struct {
 	Base draw.Drawer
 	Mask *image.Alpha
+
+	Bottom bool // draw the mask upside down along the bottom, instead of along the top
+	Flip   bool // mirror the mask horizontally
+
+	resized *image.Alpha // Mask stretched across the width it was last drawn at
 }
 
 func New(base draw.Drawer, mask *image.Alpha) *Drawer {
@@ -55,32 +135,50 @@ func New(base draw.Drawer, mask *image.Alpha) *Drawer {
 
 var transparent = color.RGBA{0, 0, 0, 0}
 
-func (d Drawer) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+func (d *Drawer) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
 	// Draw the original one if we haven't already
 	if d.Base != nil {
 		d.Base.Draw(dst, r, src, sp)
 	}
 
-	// Setup our mask
-	maskBounds := d.Mask.Bounds()
-	maskRatio := maskBounds.Dx() / maskBounds.Dy()
-	maskW := r.Dx()
-	maskH := maskW / maskRatio
-	alphaMask := image.NewAlpha(r)
-	resizedMask := resize.Resize(uint(maskW), uint(maskH), d.Mask, resize.Bicubic)
-	draw.Draw(alphaMask, image.Rect(0, 0, maskW, maskH), resizedMask, sp, draw.Src)
+	alphaMask := d.resize(r.Dx())
+	maskW, maskH := alphaMask.Rect.Dx(), alphaMask.Rect.Dy()
+
+	top := r.Min.Y
+	if d.Bottom {
+		top = r.Max.Y - maskH
+	}
 
 	// Mask everything out
-	w, h := maskW, maskH
-	for x := range w + 1 {
-		for y := range h + 1 {
-			alpha := alphaMask.AlphaAt(x, y)
-			col := dst.At(x, y)
-
-			if alpha.A == 255 {
-				col = transparent
-				dst.Set(x, y, col)
+	for x := range maskW {
+		for y := range maskH {
+			mx, my := x, y
+			if d.Flip {
+				mx = maskW - 1 - x
+			}
+			if d.Bottom {
+				my = maskH - 1 - y
+			}
+
+			if alphaMask.AlphaAt(mx, my).A == 255 {
+				dst.Set(r.Min.X+x, top+y, transparent)
 			}
 		}
 	}
 }
+
+// resize returns the mask stretched across the width, keeping its aspect ratio.
+func (d *Drawer) resize(width int) *image.Alpha {
+	maskBounds := d.Mask.Bounds()
+	height := max(1, width*maskBounds.Dy()/maskBounds.Dx())
+	if d.resized != nil && d.resized.Rect == image.Rect(0, 0, width, height) {
+		return d.resized
+	}
+
+	alphaMask := image.NewAlpha(image.Rect(0, 0, width, height))
+	resizedMask := resize.Resize(uint(width), uint(height), d.Mask, resize.Bicubic)
+	draw.Draw(alphaMask, alphaMask.Bounds(), resizedMask, resizedMask.Bounds().Min, draw.Src)
+	d.resized = alphaMask
+
+	return alphaMask
+}
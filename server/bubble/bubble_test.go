@@ -0,0 +1,68 @@
+package bubble
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// halfMask is a mask whose left half is cut out.
+func halfMask(width int, height int) *image.Alpha {
+	mask := image.NewAlpha(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width/2; x++ {
+			mask.SetAlpha(x, y, color.Alpha{0xff})
+		}
+	}
+
+	return mask
+}
+
+func TestDrawerCutsOutMask(t *testing.T) {
+	tests := []struct {
+		name   string
+		drawer Drawer
+		cut    image.Point // a pixel that has to be cut out
+		kept   image.Point // a pixel that has to be kept
+	}{
+		{name: "top", drawer: Drawer{Mask: halfMask(20, 10)}, cut: image.Pt(2, 2), kept: image.Pt(37, 2)},
+		{name: "flipped", drawer: Drawer{Mask: halfMask(20, 10), Flip: true}, cut: image.Pt(37, 2), kept: image.Pt(2, 2)},
+		{name: "bottom", drawer: Drawer{Mask: halfMask(20, 10), Bottom: true}, cut: image.Pt(2, 37), kept: image.Pt(2, 2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Stretched across the width, the mask covers the top 20 pixels.
+			dst := image.NewRGBA(image.Rect(0, 0, 40, 40))
+			draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+
+			tt.drawer.Draw(dst, dst.Bounds(), dst, image.Point{})
+
+			if got := dst.RGBAAt(tt.cut.X, tt.cut.Y); got.A != 0 {
+				t.Errorf("%v wasn't cut out: %v", tt.cut, got)
+			}
+			if got := dst.RGBAAt(tt.kept.X, tt.kept.Y); got.A != 0xff {
+				t.Errorf("%v was cut out: %v", tt.kept, got)
+			}
+		})
+	}
+}
+
+func TestDrawerResizesOncePerWidth(t *testing.T) {
+	d := Drawer{Mask: halfMask(20, 10)}
+	frame := image.NewRGBA(image.Rect(0, 0, 40, 40))
+
+	d.Draw(frame, frame.Bounds(), frame, image.Point{})
+	first := d.resized
+	d.Draw(frame, frame.Bounds(), frame, image.Point{})
+	if d.resized != first {
+		t.Error("the mask was resized again for a frame of the same size")
+	}
+
+	smaller := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	d.Draw(smaller, smaller.Bounds(), smaller, image.Point{})
+	if got := d.resized.Bounds(); got != image.Rect(0, 0, 10, 5) {
+		t.Errorf("got a %v mask for a 10 pixel wide image, want 10x5", got)
+	}
+}
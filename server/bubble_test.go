@@ -0,0 +1,82 @@
+package server
+
+import (
+	"image"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/liondadev/quick-image-server/config"
+)
+
+func TestAnimatedBubble(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits config.AnimationLimits
+		frames int
+	}{
+		{name: "animated", frames: 4},
+		{name: "too many frames", limits: config.AnimationLimits{MaxFrames: 3}, frames: 1},
+		{name: "too many pixels", limits: config.AnimationLimits{MaxPixels: 64 * 48 * 3}, frames: 1},
+		{name: "too big", limits: config.AnimationLimits{MaxSourceBytes: 10}, frames: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(cfg *config.Config) {
+				cfg.AnimatedBubbles = tt.limits
+			})
+			up := newTestUpload(t, s, "alice", "cat.gif", "image/gif", testGIF(t, 64, 48, 4), uploadOptions{})
+
+			res := serve(s, httptest.NewRequest(http.MethodGet, "/bubble/"+up.Id+".gif", nil))
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+			}
+
+			g, err := gif.DecodeAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(g.Image) != tt.frames {
+				t.Fatalf("got %d frames, want %d", len(g.Image), tt.frames)
+			}
+
+			for i, frame := range g.Image {
+				if size := frame.Bounds().Size(); size != image.Pt(64, 48) {
+					t.Errorf("frame %d: got size %s, want 64x48", i, size)
+				}
+				// The bubble is cut out of the top of every frame.
+				if _, _, _, a := frame.At(32, 0).RGBA(); a != 0 {
+					t.Errorf("frame %d: the top isn't transparent", i)
+				}
+				if tt.frames > 1 && g.Delay[i] != 10 {
+					t.Errorf("frame %d: got delay %d, want the delay of the original 10", i, g.Delay[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBubbleAsPNG(t *testing.T) {
+	s := newTestServer(t, nil)
+	up := newTestUpload(t, s, "alice", "cat.gif", "image/gif", testGIF(t, 64, 48, 4), uploadOptions{})
+
+	res := serve(s, httptest.NewRequest(http.MethodGet, "/bubble/"+up.Id+".png", nil))
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("got status %d and type %q, want a png", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	img, err := png.Decode(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, a := img.At(32, 0).RGBA(); a != 0 {
+		t.Error("the top isn't transparent")
+	}
+
+	if res := serve(s, httptest.NewRequest(http.MethodGet, "/bubble/"+up.Id+".webp", nil)); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("webp: got status %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/liondadev/quick-image-server/server/pages"
+	"github.com/liondadev/quick-image-server/types"
+)
+
+// unfurlerUserAgents are parts of the user agents of bots that fetch links to show a
+// preview of them (Discord, Slack, ...). They must never burn a burn-after-reading upload.
+var unfurlerUserAgents = []string{
+	"discordbot",
+	"slackbot",
+	"slack-imgproxy",
+	"twitterbot",
+	"facebookexternalhit",
+	"facebot",
+	"telegrambot",
+	"whatsapp",
+	"linkedinbot",
+	"skypeuripreview",
+	"mattermost",
+	"mastodon",
+	"redditbot",
+	"embedly",
+	"iframely",
+	"pinterest",
+	"vkshare",
+	"applebot",
+	"googlebot",
+	"bingbot",
+}
+
+// isUnfurler checks if a request was made by a bot that only wants a link preview.
+func isUnfurler(r *http.Request) bool {
+	ua := strings.ToLower(r.UserAgent())
+	for _, bot := range unfurlerUserAgents {
+		if strings.Contains(ua, bot) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveBurnAfterRead serves a burn-after-reading upload exactly once, and deletes it
+// afterward. Link unfurlers get a page explaining what the link is instead.
+func (s *Server) serveBurnAfterRead(w http.ResponseWriter, r *http.Request, upload types.Upload) error {
+	if isUnfurler(r) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Robots-Tag", "noindex")
+		return writeHTML(w, r, http.StatusOK, pages.BurnNotice())
+	}
+
+	// HEAD requests (link checkers, clients checking the size first) must not burn it.
+	if r.Method == http.MethodHead {
+		if info, err := s.store.Stat(r.Context(), originalName(upload)); err == nil {
+			w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", upload.MimeType)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	// Deleting the row is what claims the upload. Only one request can delete it, so
+	// only one request gets to see the file.
+	claimed, derivatives, err := s.deleteUpload(r.Context(), `DELETE FROM "uploads" WHERE "id" = $1 AND "burn_after_read" = 1 RETURNING "id", "mime", "uploaded_as", "ext", "blob"`, upload.Id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return PublicError{http.StatusNotFound, "File not found."}
+		}
+
+		return err
+	}
+
+	// The files have to go no matter how serving them goes, even if the client went away
+	// and cancelled the request, since the row that points at them is already gone.
+	defer func() {
+		if err := s.deleteUploadFiles(context.WithoutCancel(r.Context()), claimed, derivatives); err != nil {
+			log.Printf("Failed to delete the files of burnt upload '%s': %s", claimed.Id, err.Error())
+		}
+	}()
+
+	f, err := s.store.Get(r.Context(), originalName(claimed))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", claimed.MimeType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", strings.ReplaceAll(claimed.UploadedAs, "\"", "\\\"")))
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, f); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// uploadExists checks if the upload still has a row.
+func uploadExists(t *testing.T, s *Server, id string) bool {
+	t.Helper()
+
+	var exists bool
+	if err := s.db.Get(&exists, `SELECT EXISTS (SELECT 1 FROM "uploads" WHERE "id" = $1)`, id); err != nil {
+		t.Fatal(err)
+	}
+
+	return exists
+}
+
+func TestBurnAfterRead(t *testing.T) {
+	s := newTestServer(t, nil)
+	up := newTestUpload(t, s, "alice", "secret.txt", "text/plain", []byte("secret"), uploadOptions{BurnAfterRead: true})
+	target := "/f/" + up.Id + up.Extension
+
+	// Link previews and HEAD requests don't burn it.
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)")
+	if res := serve(s, r); res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") == "text/plain" {
+		t.Errorf("unfurler: got status %d and type %q, want the notice page", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	res := serve(s, httptest.NewRequest(http.MethodHead, target, nil))
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Length") != "6" {
+		t.Errorf("head: got status %d and length %q, want 200 and 6", res.StatusCode, res.Header.Get("Content-Length"))
+	}
+
+	// Derivatives would let it be seen without burning it.
+	if res := serve(s, httptest.NewRequest(http.MethodGet, "/thumb/"+up.Id+up.Extension, nil)); res.StatusCode != http.StatusNotFound {
+		t.Errorf("thumbnail: got status %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+
+	if !uploadExists(t, s, up.Id) {
+		t.Fatal("the upload was burnt without being read")
+	}
+
+	// Out of many readers at the same time, exactly one gets to see it.
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		served int
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res := serve(s, httptest.NewRequest(http.MethodGet, target, nil))
+			body, _ := io.ReadAll(res.Body)
+
+			switch res.StatusCode {
+			case http.StatusOK:
+				if string(body) != "secret" {
+					t.Errorf("got %q, want \"secret\"", body)
+				}
+				mu.Lock()
+				served++
+				mu.Unlock()
+			case http.StatusNotFound:
+			default:
+				t.Errorf("got status %d, want 200 or 404", res.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if served != 1 {
+		t.Errorf("the upload was served %d times, want once", served)
+	}
+	if uploadExists(t, s, up.Id) {
+		t.Error("the upload wasn't deleted after being read")
+	}
+	if blobStored(t, s, up.Blob) {
+		t.Error("the file of the upload wasn't deleted after being read")
+	}
+}
+
+func TestBurnClaimsOnce(t *testing.T) {
+	s := newTestServer(t, nil)
+	ctx := context.Background()
+	burning := newTestUpload(t, s, "alice", "secret.txt", "text/plain", []byte("secret"), uploadOptions{BurnAfterRead: true})
+	normal := newTestUpload(t, s, "alice", "normal.txt", "text/plain", []byte("normal"), uploadOptions{})
+
+	claim := func(id string) error {
+		_, _, err := s.deleteUpload(ctx, `DELETE FROM "uploads" WHERE "id" = $1 AND "burn_after_read" = 1 RETURNING "id", "mime", "uploaded_as", "ext", "blob"`, id)
+		return err
+	}
+
+	if err := claim(burning.Id); err != nil {
+		t.Fatalf("first claim: %s", err)
+	}
+	if err := claim(burning.Id); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("second claim: got %v, want sql.ErrNoRows", err)
+	}
+
+	// Only burn-after-reading uploads can be claimed.
+	if err := claim(normal.Id); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("claim a normal upload: got %v, want sql.ErrNoRows", err)
+	}
+	if !uploadExists(t, s, normal.Id) {
+		t.Error("the normal upload was deleted")
+	}
+}
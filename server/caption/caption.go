@@ -0,0 +1,269 @@
+package caption
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// MaxLength is the longest the top or bottom text of a caption can be.
+const MaxLength = 200
+
+const (
+	minFontSize = 10
+	lineSpacing = 1.1 // line height, relative to the font size
+)
+
+var Font *opentype.Font
+
+func init() {
+	f, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		panic(err)
+	}
+
+	Font = f
+}
+
+// Caption is the text drawn over the top and bottom of an image, in the classic meme
+// style: white uppercase text with a black outline.
+type Caption struct {
+	Top    string
+	Bottom string
+}
+
+// Empty returns whether there's no text to draw.
+func (c Caption) Empty() bool {
+	return strings.TrimSpace(c.Top) == "" && strings.TrimSpace(c.Bottom) == ""
+}
+
+// Draw draws the caption over dst. The font size is picked so the text fits the width
+// of the image, and each of the texts takes up at most a quarter of its height.
+func (c Caption) Draw(dst draw.Image) {
+	c.Layout(dst.Bounds()).Draw(dst)
+}
+
+// Layout is a caption laid out for images of one size, so it can be drawn over many of
+// them (like the frames of a gif) without laying it out again.
+type Layout struct {
+	blocks []textBlock
+}
+
+// textBlock is a text as masks of the letters and of their outline.
+type textBlock struct {
+	fill    *image.Alpha
+	outline *image.Alpha
+}
+
+// Layout lays out the caption for images with the bounds.
+func (c Caption) Layout(b image.Rectangle) Layout {
+	margin := max(4, b.Dx()/40)
+	box := image.Rect(b.Min.X+margin, b.Min.Y+margin, b.Max.X-margin, b.Max.Y-margin)
+
+	var l Layout
+	if text := strings.TrimSpace(c.Top); text != "" {
+		if block, ok := layoutText(box, text, false); ok {
+			l.blocks = append(l.blocks, block)
+		}
+	}
+	if text := strings.TrimSpace(c.Bottom); text != "" {
+		if block, ok := layoutText(box, text, true); ok {
+			l.blocks = append(l.blocks, block)
+		}
+	}
+
+	return l
+}
+
+// Draw draws the laid out caption over dst.
+func (l Layout) Draw(dst draw.Image) {
+	black := image.NewUniform(color.Black)
+	for _, block := range l.blocks {
+		draw.DrawMask(dst, block.outline.Bounds(), black, image.Point{}, block.outline, block.outline.Bounds().Min, draw.Over)
+		draw.DrawMask(dst, block.fill.Bounds(), image.White, image.Point{}, block.fill, block.fill.Bounds().Min, draw.Over)
+	}
+}
+
+// layoutText lays out a text along the top (or the bottom) of box.
+func layoutText(box image.Rectangle, text string, bottom bool) (textBlock, bool) {
+	text = strings.ToUpper(text)
+	maxHeight := max(minFontSize, box.Dy()/4)
+
+	// Start big, and shrink until it fits.
+	size := max(minFontSize, box.Dy()/6)
+	var face font.Face
+	var lines []string
+	for {
+		f, err := opentype.NewFace(Font, &opentype.FaceOptions{Size: float64(size), DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return textBlock{}, false
+		}
+
+		lines = wrap(f, text, box.Dx())
+		fits := blockHeight(size, len(lines)) <= maxHeight && widest(f, lines) <= box.Dx()
+		if fits || size <= minFontSize {
+			face = f
+			break
+		}
+
+		f.Close()
+		size = max(minFontSize, size*9/10)
+	}
+	defer face.Close()
+
+	height := blockHeight(size, len(lines))
+	outline := max(1, size/14)
+	block := image.Rect(box.Min.X, box.Min.Y, box.Max.X, box.Min.Y+height)
+	if bottom {
+		block = image.Rect(box.Min.X, box.Max.Y-height, box.Max.X, box.Max.Y)
+	}
+
+	fill := image.NewAlpha(block.Inset(-outline - 1))
+	d := font.Drawer{Dst: fill, Src: image.Opaque, Face: face}
+	ascent := face.Metrics().Ascent
+	for i, line := range lines {
+		width := d.MeasureString(line)
+		d.Dot = fixed.Point26_6{
+			X: fixed.I(block.Min.X) + (fixed.I(block.Dx())-width)/2,
+			Y: fixed.I(block.Min.Y+int(float64(i*size)*lineSpacing)) + ascent,
+		}
+		d.DrawString(line)
+	}
+
+	return textBlock{fill: fill, outline: dilate(fill, outline)}, true
+}
+
+// dilate returns a mask of everything within radius pixels of the opaque parts of mask,
+// with smooth edges. It's made with a distance transform (Felzenszwalb and Huttenlocher,
+// "Distance Transforms of Sampled Functions"), so it takes as long for thick outlines as
+// for thin ones.
+func dilate(mask *image.Alpha, radius int) *image.Alpha {
+	b := mask.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// Squared distances to the nearest opaque pixel. Anything farther away than the edge
+	// of the outline doesn't matter, so they start out there instead of at infinity.
+	far := int32((radius + 1) * (radius + 1))
+	dist := make([]int32, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if mask.Pix[y*mask.Stride+x] < 0x80 {
+				dist[y*w+x] = far
+			}
+		}
+	}
+
+	n := max(w, h)
+	line := make([]int32, n)
+	parabolas := make([]int, n)
+	bounds := make([]float64, n+1)
+	for x := 0; x < w; x++ {
+		distanceTransform(dist[x:], w, h, line, parabolas, bounds)
+	}
+	for y := 0; y < h; y++ {
+		distanceTransform(dist[y*w:], 1, w, line, parabolas, bounds)
+	}
+
+	out := image.NewAlpha(b)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// Fully covered up to the radius, fading out over the pixel after it.
+			a := float64(radius) + 1 - math.Sqrt(float64(dist[y*w+x]))
+			out.Pix[y*out.Stride+x] = uint8(min(max(a, 0), 1) * 0xff)
+		}
+	}
+
+	return out
+}
+
+// distanceTransform does the one-dimensional squared distance transform of the n values
+// of dist that are step apart. The other slices are scratch space for at least n values.
+func distanceTransform(dist []int32, step int, n int, line []int32, parabolas []int, bounds []float64) {
+	for i := 0; i < n; i++ {
+		line[i] = dist[i*step]
+	}
+
+	// intersect returns where the parabolas rooted at p and q < p meet.
+	intersect := func(p int, q int) float64 {
+		return float64(int(line[p])+p*p-int(line[q])-q*q) / float64(2*(p-q))
+	}
+
+	// Find the lower envelope of the parabolas rooted at every value...
+	k := 0
+	parabolas[0] = 0
+	bounds[0], bounds[1] = math.Inf(-1), math.Inf(1)
+	for p := 1; p < n; p++ {
+		at := intersect(p, parabolas[k])
+		for at <= bounds[k] {
+			k--
+			at = intersect(p, parabolas[k])
+		}
+
+		k++
+		parabolas[k] = p
+		bounds[k], bounds[k+1] = at, math.Inf(1)
+	}
+
+	// ...and read the distances off it.
+	k = 0
+	for i := 0; i < n; i++ {
+		for bounds[k+1] < float64(i) {
+			k++
+		}
+
+		d := i - parabolas[k]
+		dist[i*step] = int32(d*d) + line[parabolas[k]]
+	}
+}
+
+// blockHeight returns how high a number of lines are at a font size.
+func blockHeight(size int, lines int) int {
+	if lines == 0 {
+		return 0
+	}
+
+	return int(float64((lines-1)*size)*lineSpacing) + size
+}
+
+// wrap breaks text into lines that fit in width, without breaking words.
+func wrap(face font.Face, text string, width int) []string {
+	var lines []string
+	var line string
+
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+
+		if line != "" && font.MeasureString(face, candidate).Ceil() > width {
+			lines = append(lines, line)
+			line = word
+			continue
+		}
+
+		line = candidate
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// widest returns the width of the widest line.
+func widest(face font.Face, lines []string) int {
+	w := 0
+	for _, line := range lines {
+		w = max(w, font.MeasureString(face, line).Ceil())
+	}
+
+	return w
+}
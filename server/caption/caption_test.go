@@ -0,0 +1,77 @@
+package caption
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// slowDilate is dilate done the obvious way: every pixel is as covered as it is close to
+// the nearest opaque pixel of mask.
+func slowDilate(mask *image.Alpha, radius int) *image.Alpha {
+	b := mask.Bounds()
+	out := image.NewAlpha(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			nearest := math.Inf(1)
+			for yy := b.Min.Y; yy < b.Max.Y; yy++ {
+				for xx := b.Min.X; xx < b.Max.X; xx++ {
+					if mask.AlphaAt(xx, yy).A >= 0x80 {
+						nearest = min(nearest, math.Hypot(float64(x-xx), float64(y-yy)))
+					}
+				}
+			}
+
+			a := float64(radius) + 1 - nearest
+			out.SetAlpha(x, y, color.Alpha{uint8(min(max(a, 0), 1) * 0xff)})
+		}
+	}
+
+	return out
+}
+
+func TestDilate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for _, radius := range []int{1, 2, 5, 9} {
+		mask := image.NewAlpha(image.Rect(3, -2, 40, 25))
+		for i := 0; i < 8; i++ {
+			mask.SetAlpha(3+rng.Intn(37), -2+rng.Intn(27), color.Alpha{0xff})
+		}
+
+		got, want := dilate(mask, radius), slowDilate(mask, radius)
+		if got.Bounds() != want.Bounds() {
+			t.Fatalf("radius %d: got bounds %v, want %v", radius, got.Bounds(), want.Bounds())
+		}
+		for y := want.Rect.Min.Y; y < want.Rect.Max.Y; y++ {
+			for x := want.Rect.Min.X; x < want.Rect.Max.X; x++ {
+				if g, w := got.AlphaAt(x, y).A, want.AlphaAt(x, y).A; g != w {
+					t.Fatalf("radius %d: at %d,%d got alpha %d, want %d", radius, x, y, g, w)
+				}
+			}
+		}
+	}
+}
+
+func TestLayoutDrawsBothTexts(t *testing.T) {
+	b := image.Rect(0, 0, 300, 200)
+	l := Caption{Top: "top text", Bottom: "bottom text"}.Layout(b)
+	if len(l.blocks) != 2 {
+		t.Fatalf("got %d blocks, want 2", len(l.blocks))
+	}
+
+	for i, block := range l.blocks {
+		if block.fill.Bounds() != block.outline.Bounds() {
+			t.Errorf("block %d: fill %v and outline %v don't line up", i, block.fill.Bounds(), block.outline.Bounds())
+		}
+	}
+	if l.blocks[0].fill.Bounds().Min.Y >= l.blocks[1].fill.Bounds().Min.Y {
+		t.Error("the top text isn't above the bottom text")
+	}
+
+	if l := (Caption{Top: "  "}).Layout(b); len(l.blocks) != 0 {
+		t.Errorf("got %d blocks for a blank caption, want 0", len(l.blocks))
+	}
+}
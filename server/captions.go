@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/ericpauley/go-quantize/quantize"
+	"github.com/go-chi/chi/v5"
+	"github.com/liondadev/quick-image-server/server/caption"
+	"github.com/liondadev/quick-image-server/types"
+)
+
+// MakeCaptionImage draws a caption over an image.
+func (s *Server) MakeCaptionImage(mime string, original io.Reader, c caption.Caption) (image.Image, error) {
+	src, err := decodeImage(mime, original, s.maxImagePixels())
+	if err != nil {
+		return nil, fmt.Errorf("mime type '%s' can't be captioned: %w", mime, err)
+	}
+
+	dst := normalizeImage(src)
+	c.Draw(dst)
+
+	return dst, nil
+}
+
+// MakeAnimatedCaptionGif draws a caption over every frame of an animated gif, keeping its
+// timing and loop count. Gifs over the animated caption limits only get their first frame
+// captioned.
+func (s *Server) MakeAnimatedCaptionGif(original io.Reader, sourceSize int64, c caption.Caption) (io.Reader, error) {
+	limits := animationLimits(s.cfg.AnimatedCaptions)
+	if sourceSize > limits.MaxSourceBytes {
+		return s.firstFrameCaptionGif(original, c)
+	}
+
+	// We need to read it twice if we end up falling back to the first frame.
+	data, err := io.ReadAll(original)
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := decodeAnimation(data, limits)
+	if err != nil {
+		return nil, err
+	}
+	if g == nil || len(g.Image) < 2 {
+		return s.firstFrameCaptionGif(bytes.NewReader(data), c)
+	}
+
+	// Every frame is drawn onto the whole canvas, so the caption is laid out once.
+	layout := c.Layout(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	return encodeSharedPalette(g, func(frame *image.RGBA) { layout.Draw(frame) }, draw.FloydSteinberg)
+}
+
+// firstFrameCaptionGif creates a captioned gif out of only the first frame of a gif.
+func (s *Server) firstFrameCaptionGif(original io.Reader, c caption.Caption) (io.Reader, error) {
+	captioned, err := s.MakeCaptionImage("image/gif", original, c)
+	if err != nil {
+		return nil, err
+	}
+
+	buff := new(bytes.Buffer)
+	if err := gif.Encode(buff, captioned, &gif.Options{Quantizer: TransparentQuantizer{quantize.MedianCutQuantizer{}}, Drawer: draw.FloydSteinberg}); err != nil {
+		return nil, err
+	}
+
+	return buff, nil
+}
+
+// handleCaptionView handles people viewing images with a meme caption over them. Like bubbles,
+// the extension in the url decides the format.
+func (s *Server) handleCaptionView(w http.ResponseWriter, r *http.Request) error {
+	requestedFilename, fileId := getFileDetails(r)
+	ext := path.Ext(requestedFilename)
+	if ext != ".gif" && ext != ".png" && ext != ".jpg" && ext != ".jpeg" {
+		return PublicError{http.StatusBadRequest, "Captioned images can only be generated into GIFs, PNGs or JPEGs."}
+	}
+
+	var upload types.Upload
+	if err := s.db.Get(&upload, `SELECT * FROM "uploads" WHERE "id" = $1`, fileId); err != nil {
+		return PublicError{http.StatusNotFound, "File not found."}
+	}
+
+	if isExpired(upload) {
+		return PublicError{http.StatusGone, "This file has expired."}
+	}
+
+	// Derivatives would let people see a one-time file without burning it.
+	if upload.BurnAfterRead {
+		return PublicError{http.StatusNotFound, "File not found."}
+	}
+
+	if ok, err := s.checkAccess(w, r, upload); !ok {
+		return err
+	}
+
+	c := caption.Caption{Top: r.URL.Query().Get("top"), Bottom: r.URL.Query().Get("bottom")}
+	if c.Empty() {
+		return PublicError{http.StatusBadRequest, "There has to be a top or bottom text."}
+	}
+	if len(c.Top) > caption.MaxLength || len(c.Bottom) > caption.MaxLength {
+		return PublicError{http.StatusBadRequest, fmt.Sprintf("The texts can't be longer than %d characters.", caption.MaxLength)}
+	}
+
+	// Like transformations, only texts signed for the file can be drawn, so nobody can
+	// keep us busy drawing endless variants.
+	if !s.verify(r.URL.Query().Get("csig"), "caption", upload.Id, c.Top, c.Bottom) {
+		return PublicError{http.StatusForbidden, "This caption wasn't signed by the owner of the file."}
+	}
+
+	// Captions go in the size bounded cache with the transformed images instead of being
+	// kept forever.
+	sum := sha256.Sum256([]byte(c.Top + "\x00" + c.Bottom))
+	key := "caption-" + hex.EncodeToString(sum[:16]) + ext
+
+	contentType := mime.TypeByExtension(ext)
+	etag := contentETag(upload, "captions/"+key)
+
+	if f, err := s.transforms.Open(upload.Id, key); err == nil {
+		defer f.Close()
+
+		serveContent(w, r, upload, contentType, etag, f)
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if !CanDecode(upload.MimeType) {
+		return PublicError{http.StatusBadRequest, "Captions can't be drawn on this kind of file."}
+	}
+
+	captioned, err := s.derivatives.Do(r.Context(), "caption:"+upload.Id+"/"+key, func() ([]byte, error) {
+		if f, err := s.transforms.Open(upload.Id, key); err == nil {
+			defer f.Close()
+			return io.ReadAll(f)
+		}
+
+		data, err := s.generateCaption(context.Background(), upload, ext, c)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.transforms.Put(upload.Id, key, data); err != nil {
+			return nil, err
+		}
+
+		return data, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	serveContent(w, r, upload, contentType, etag, bytes.NewReader(captioned))
+	return nil
+}
+
+// handleSignCaption handles the owner of a file creating a link to it with a caption.
+func (s *Server) handleSignCaption(w http.ResponseWriter, r *http.Request) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	var up types.Upload
+	if err := s.db.Get(&up, `SELECT "id", "mime", "ext" FROM "uploads" WHERE "id" = $1 AND "user" = $2`, chi.URLParam(r, "fileId"), userName); err != nil {
+		return PublicError{http.StatusNotFound, "File not found."}
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return PublicError{http.StatusBadRequest, "Invalid form."}
+	}
+
+	c := caption.Caption{Top: r.Form.Get("top"), Bottom: r.Form.Get("bottom")}
+	if c.Empty() {
+		return PublicError{http.StatusBadRequest, "There has to be a top or bottom text."}
+	}
+	if len(c.Top) > caption.MaxLength || len(c.Bottom) > caption.MaxLength {
+		return PublicError{http.StatusBadRequest, fmt.Sprintf("The texts can't be longer than %d characters.", caption.MaxLength)}
+	}
+
+	// Gifs stay gifs so they keep moving, everything else becomes a png.
+	ext := ".png"
+	if up.MimeType == "image/gif" {
+		ext = ".gif"
+	}
+	switch format := r.Form.Get("format"); format {
+	case "":
+	case "gif", "png", "jpg", "jpeg":
+		ext = "." + format
+	default:
+		return PublicError{http.StatusBadRequest, "Captioned images can only be generated into GIFs, PNGs or JPEGs."}
+	}
+
+	captionUrl, err := url.JoinPath(s.cfg.BasePath, "/caption/", up.Id+ext)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"top": {c.Top}, "bottom": {c.Bottom}, "csig": {s.sign("caption", up.Id, c.Top, c.Bottom)}}
+	writeJson(w, http.StatusOK, jMap{"url": captionUrl + "?" + query.Encode()})
+	return nil
+}
+
+// generateCaption makes a captioned image of an upload, in the format of ext.
+func (s *Server) generateCaption(ctx context.Context, up types.Upload, ext string, c caption.Caption) ([]byte, error) {
+	f, err := s.store.Get(ctx, originalName(up))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	enc := new(bytes.Buffer)
+	if ext == ".gif" && up.MimeType == "image/gif" {
+		info, err := s.store.Stat(ctx, originalName(up))
+		if err != nil {
+			return nil, err
+		}
+
+		buff, err := s.MakeAnimatedCaptionGif(f, info.Size, c)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(enc, buff); err != nil {
+			return nil, err
+		}
+	} else {
+		captioned, err := s.MakeCaptionImage(up.MimeType, f, c)
+		if err != nil {
+			return nil, err
+		}
+
+		switch ext {
+		case ".png":
+			err = png.Encode(enc, captioned)
+		case ".jpg", ".jpeg":
+			err = jpeg.Encode(enc, captioned, &jpeg.Options{Quality: 85})
+		case ".gif":
+			err = gif.Encode(enc, captioned, &gif.Options{Quantizer: TransparentQuantizer{quantize.MedianCutQuantizer{}}, Drawer: draw.FloydSteinberg})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return enc.Bytes(), nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPNG encodes a gray image of the size as a png.
+func testPNG(t *testing.T, width int, height int) []byte {
+	t.Helper()
+
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+
+	buff := new(bytes.Buffer)
+	if err := png.Encode(buff, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buff.Bytes()
+}
+
+func TestCaptionNeedsSignature(t *testing.T) {
+	s := newTestServer(t, nil)
+	key, _ := newTestKey(t, s, "alice", []string{ScopeReadOwn}, time.Time{})
+	up := newTestUpload(t, s, "alice", "cat.png", "image/png", testPNG(t, 64, 48), uploadOptions{})
+
+	r := httptest.NewRequest(http.MethodPost, "/app/uploads/"+up.Id+"/caption", strings.NewReader(url.Values{"top": {"hello"}, "bottom": {"world"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Server-Api-Key", key)
+	res := serve(s, r)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("sign: got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	var body struct {
+		Url string `json:"url"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	signed, err := url.Parse(body.Url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed.Path != "/caption/"+up.Id+".png" {
+		t.Errorf("got path %q, want /caption/%s.png", signed.Path, up.Id)
+	}
+
+	tampered := signed.Query()
+	tampered.Set("bottom", "something else")
+	unsigned := signed.Query()
+	unsigned.Del("csig")
+
+	tests := []struct {
+		name  string
+		query url.Values
+		want  int
+	}{
+		{name: "signed", query: signed.Query(), want: http.StatusOK},
+		{name: "other text", query: tampered, want: http.StatusForbidden},
+		{name: "no signature", query: unsigned, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := serve(s, httptest.NewRequest(http.MethodGet, signed.Path+"?"+tt.query.Encode(), nil))
+			if res.StatusCode != tt.want {
+				t.Fatalf("got status %d, want %d", res.StatusCode, tt.want)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			img, err := png.Decode(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 48 {
+				t.Errorf("got a %v image, want 64x48", img.Bounds())
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/liondadev/quick-image-server/server/pages"
+)
+
+const (
+	csrfCookieName  = "qis_csrf"
+	csrfFieldName   = "csrf_token"   // the form field forms send the token in
+	csrfHeaderName  = "X-CSRF-Token" // the header scripts send the token in
+	csrfTokenLength = 32
+	csrfCookieAge   = 60 * 60 * 24 * 30 // seconds
+
+	csrfContextKey = "qis::csrf"
+)
+
+// csrfState is what writeHTML needs to give pages the CSRF token.
+type csrfState struct {
+	Token  string // the token from the cookie, or empty if there isn't one yet
+	Secure bool   // if the cookie should only be sent over https
+}
+
+// preHandleCSRF protects requests that change something from cross-site request forgery,
+// using a token that has to be sent both in a cookie and in the form (or the X-CSRF-Token
+// header). Requests with an API key header are exempt, since browsers never send those on
+// their own.
+func (s *Server) preHandleCSRF(next http.Handler) http.Handler {
+	return FrontendHandlerWithError(func(w http.ResponseWriter, r *http.Request) error {
+		st := &csrfState{Secure: s.secureCookies(r)}
+		if cook, err := r.Cookie(csrfCookieName); err == nil && len(cook.Value) == csrfTokenLength {
+			st.Token = cook.Value
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		default:
+			if r.Header.Get("X-Server-Api-Key") != "" {
+				break
+			}
+
+			token := r.Header.Get(csrfHeaderName)
+			if token == "" {
+				if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+					_ = r.ParseMultipartForm(1024 * 8) // the same as the upload handlers, so the form is only parsed once
+				}
+				token = r.PostFormValue(csrfFieldName)
+			}
+
+			if !st.valid(token) {
+				return PublicError{http.StatusForbidden, "The form has expired, go back, reload the page and try again."}
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfContextKey, st)))
+		return nil
+	})
+}
+
+// valid reports if token matches the token in the cookie.
+func (st *csrfState) valid(token string) bool {
+	return st.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(st.Token)) == 1
+}
+
+// checkCSRFToken reports if a token sent some other way, like in the query of a request
+// that can't have headers or a body, is valid. Requests with an API key header always are.
+func checkCSRFToken(r *http.Request, token string) bool {
+	if r.Header.Get("X-Server-Api-Key") != "" {
+		return true
+	}
+
+	st, ok := r.Context().Value(csrfContextKey).(*csrfState)
+	return ok && st.valid(token)
+}
+
+// pageContext returns the context pages are rendered with, which has the CSRF token in it.
+// If the client doesn't have a token yet, it gets one in a cookie.
+func pageContext(w http.ResponseWriter, r *http.Request) context.Context {
+	st, ok := r.Context().Value(csrfContextKey).(*csrfState)
+	if !ok {
+		return r.Context()
+	}
+
+	if st.Token == "" {
+		st.Token = secretString(csrfTokenLength)
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookieName,
+			Value:    st.Token,
+			Path:     "/",
+			MaxAge:   csrfCookieAge,
+			HttpOnly: true,
+			Secure:   st.Secure,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	return pages.WithCSRFToken(r.Context(), st.Token)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSRFToken(t *testing.T) {
+	s := newTestServer(t, nil)
+	token := strings.Repeat("a", csrfTokenLength)
+	other := strings.Repeat("b", csrfTokenLength)
+
+	tests := []struct {
+		name   string
+		cookie string // the token in the cookie, if any
+		form   string // the token in the form, if any
+		header string // the token in the X-CSRF-Token header, if any
+		want   int
+	}{
+		{name: "no token", want: http.StatusForbidden},
+		{name: "no cookie", form: token, want: http.StatusForbidden},
+		{name: "only the cookie", cookie: token, want: http.StatusForbidden},
+		{name: "mismatched form token", cookie: token, form: other, want: http.StatusForbidden},
+		{name: "mismatched header", cookie: token, header: other, want: http.StatusForbidden},
+		{name: "short cookie", cookie: "a", form: "a", want: http.StatusForbidden},
+		// Past the check, the login page complains about the missing API key.
+		{name: "form token", cookie: token, form: token, want: http.StatusBadRequest},
+		{name: "header", cookie: token, header: token, want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			if tt.form != "" {
+				form.Set(csrfFieldName, tt.form)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/app/login", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				r.Header.Set(csrfHeaderName, tt.header)
+			}
+
+			if res := serve(s, r); res.StatusCode != tt.want {
+				t.Errorf("got status %d, want %d", res.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSRFExemptsAPIKeys(t *testing.T) {
+	s := newTestServer(t, nil)
+	key, _ := newTestKey(t, s, "alice", []string{ScopeUpload}, time.Time{})
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	fw, err := mw.CreateFormFile("upload", "hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("hello"))
+	mw.Close()
+
+	// Browsers can't send the header cross-site without asking first, so uploading with
+	// it doesn't need a token.
+	r := httptest.NewRequest(http.MethodPost, "/upload", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("X-Server-Api-Key", key)
+
+	if res := serve(s, r); res.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+)
+
+const defaultMaxImagePixels = 64 << 20
+
+// DecodeFunc decodes an image. For animated formats, it only decodes the first frame.
+type DecodeFunc func(r io.Reader) (image.Image, error)
+
+// DecodeConfigFunc decodes only the dimensions and color model of an image.
+type DecodeConfigFunc func(r io.Reader) (image.Config, error)
+
+// errImageTooLarge is returned when an image has more pixels than we're willing to decode.
+var errImageTooLarge = PublicError{http.StatusUnprocessableEntity, "This image is too big to be processed."}
+
+type decoder struct {
+	decode DecodeFunc
+	config DecodeConfigFunc
+}
+
+// decoders maps mime types to the functions that decode them.
+var decoders = map[string]decoder{}
+
+// RegisterDecoder makes uploads with the mime type usable for thumbnails, bubbles and
+// transformations. The config function is used to check the size of an image before
+// decoding it. It isn't safe to call once the server is running, so it should be called
+// from init.
+func RegisterDecoder(mime string, decode DecodeFunc, decodeConfig DecodeConfigFunc) {
+	decoders[mime] = decoder{decode, decodeConfig}
+}
+
+func init() {
+	RegisterDecoder("image/jpeg", jpeg.Decode, jpeg.DecodeConfig)
+	RegisterDecoder("image/png", png.Decode, png.DecodeConfig)
+	RegisterDecoder("image/gif", gif.Decode, gif.DecodeConfig)
+	RegisterDecoder("image/webp", webp.Decode, webp.DecodeConfig)
+	RegisterDecoder("image/bmp", bmp.Decode, bmp.DecodeConfig)
+	RegisterDecoder("image/x-ms-bmp", bmp.Decode, bmp.DecodeConfig)
+	RegisterDecoder("image/tiff", tiff.Decode, tiff.DecodeConfig)
+}
+
+// CanDecode returns whether there's a decoder for the mime type.
+func CanDecode(mime string) bool {
+	_, ok := decoders[mime]
+	return ok
+}
+
+// maxImagePixels returns the biggest image we decode, in pixels.
+func (s *Server) maxImagePixels() int64 {
+	if s.cfg.MaxImagePixels > 0 {
+		return s.cfg.MaxImagePixels
+	}
+
+	return defaultMaxImagePixels
+}
+
+// decodeImage decodes an upload with the decoder for its mime type. Images with more than
+// maxPixels pixels are refused with errImageTooLarge before they're decoded.
+func decodeImage(mime string, r io.Reader, maxPixels int64) (image.Image, error) {
+	dec, ok := decoders[mime]
+	if !ok {
+		return nil, fmt.Errorf("no decoder for mime type '%s'", mime)
+	}
+
+	// Whatever the config function reads is kept so it can be read again by the decoder.
+	head := new(bytes.Buffer)
+	cfg, err := dec.config(io.TeeReader(r, head))
+	if err != nil {
+		return nil, fmt.Errorf("decode %s config: %w", mime, err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxPixels {
+		return nil, fmt.Errorf("%dx%d is more than %d pixels: %w", cfg.Width, cfg.Height, maxPixels, errImageTooLarge)
+	}
+
+	img, err := dec.decode(io.MultiReader(head, r))
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", mime, err)
+	}
+
+	return img, nil
+}
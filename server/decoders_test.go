@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// encodeTestImage encodes a width by height image with the encoder.
+func encodeTestImage(t *testing.T, width int, height int, encode func(w io.Writer, img image.Image) error) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+
+	buff := new(bytes.Buffer)
+	if err := encode(buff, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buff.Bytes()
+}
+
+// testImageEncoders encode images as every format there's a decoder for, by mime type.
+var testImageEncoders = map[string]func(w io.Writer, img image.Image) error{
+	"image/jpeg":     func(w io.Writer, img image.Image) error { return jpeg.Encode(w, img, nil) },
+	"image/png":      png.Encode,
+	"image/gif":      func(w io.Writer, img image.Image) error { return gif.Encode(w, img, nil) },
+	"image/webp":     func(w io.Writer, img image.Image) error { return nativewebp.Encode(w, img, nil) },
+	"image/bmp":      bmp.Encode,
+	"image/x-ms-bmp": bmp.Encode,
+	"image/tiff":     func(w io.Writer, img image.Image) error { return tiff.Encode(w, img, nil) },
+}
+
+func TestDecodeImage(t *testing.T) {
+	for mime, encode := range testImageEncoders {
+		t.Run(mime, func(t *testing.T) {
+			if !CanDecode(mime) {
+				t.Fatal("there's no decoder for it")
+			}
+
+			// The config is read from the same reader first, so the decoder must still
+			// get all of it.
+			img, err := decodeImage(mime, bytes.NewReader(encodeTestImage(t, 30, 20, encode)), 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := img.Bounds().Size(); got != image.Pt(30, 20) {
+				t.Errorf("got size %s, want 30x20", got)
+			}
+
+			_, err = decodeImage(mime, bytes.NewReader(encodeTestImage(t, 30, 20, encode)), 599)
+			if !errors.Is(err, errImageTooLarge) {
+				t.Errorf("over the pixel limit: got %v, want errImageTooLarge", err)
+			}
+		})
+	}
+
+	if CanDecode("text/plain") {
+		t.Error("text can be decoded")
+	}
+	if _, err := decodeImage("text/plain", bytes.NewReader([]byte("hello")), 1000); err == nil {
+		t.Error("decoded text")
+	}
+}
+
+func TestThumbnailFormats(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	for mime, encode := range testImageEncoders {
+		t.Run(mime, func(t *testing.T) {
+			up := newTestUpload(t, s, "alice", "image", mime, encodeTestImage(t, 64, 48, encode), uploadOptions{})
+
+			res := serve(s, httptest.NewRequest(http.MethodGet, "/thumb/"+up.Id+up.Extension, nil))
+			if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "image/png" {
+				t.Fatalf("got status %d and type %q, want a png thumbnail", res.StatusCode, res.Header.Get("Content-Type"))
+			}
+			if _, err := png.Decode(res.Body); err != nil {
+				t.Errorf("the thumbnail isn't a png: %s", err)
+			}
+		})
+	}
+}
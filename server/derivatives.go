@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/liondadev/quick-image-server/server/storage"
+	"github.com/liondadev/quick-image-server/types"
+)
+
+// recordDerivative adds a derivative that was just stored to the registry of the upload
+// it was generated from. It returns false if the upload doesn't exist (anymore), in
+// which case nothing is recorded.
+func (s *Server) recordDerivative(ctx context.Context, fileId string, name string, size int64) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO "derivatives" ("name", "upload", "size", "created_at") SELECT $1, $2, $3, $4 WHERE EXISTS (SELECT 1 FROM "uploads" WHERE "id" = $2)`, name, fileId, size, time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// deleteUpload runs query, a DELETE on the uploads table returning the "id", "ext" and
+// "blob" of the deleted upload (plus whatever else the caller needs), and removes the
+// upload's derivatives from the registry in the same transaction. It returns the deleted
+// upload and the names of its registered derivatives, or sql.ErrNoRows if query didn't
+// delete anything.
+func (s *Server) deleteUpload(ctx context.Context, query string, args ...any) (types.Upload, []string, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return types.Upload{}, nil, err
+	}
+	defer tx.Rollback()
+
+	var up types.Upload
+	if err := tx.GetContext(ctx, &up, query, args...); err != nil {
+		return types.Upload{}, nil, err
+	}
+
+	var derivatives []string
+	if err := tx.SelectContext(ctx, &derivatives, `DELETE FROM "derivatives" WHERE "upload" = $1 RETURNING "name"`, up.Id); err != nil {
+		return types.Upload{}, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return types.Upload{}, nil, err
+	}
+
+	return up, derivatives, nil
+}
+
+// derivativeOwner returns the id of the upload a stored object was generated from, or
+// false if the object isn't a derivative (originals, blobs, ...). Captions are cached with
+// the transformed images now, but older ones may still be stored.
+func derivativeOwner(name string) (string, bool) {
+	for _, prefix := range []string{"bubbles/", "captions/"} {
+		if rest, ok := strings.CutPrefix(name, prefix); ok {
+			id, _, found := strings.Cut(rest, "/")
+			return id, found && id != ""
+		}
+	}
+
+	if strings.Contains(name, "/") {
+		return "", false
+	}
+
+	id, rest, _ := strings.Cut(name, ".")
+	if strings.HasPrefix(rest, "thumbnail.") || strings.HasPrefix(rest, "bubble.") {
+		return id, id != ""
+	}
+
+	return "", false
+}
+
+// SweepDerivatives deletes every stored derivative whose upload no longer exists, and
+// registers the derivatives of existing uploads that were generated before there was a
+// registry, so deleting those uploads cleans them up too. Registry entries of files
+// that are gone are dropped. If dryRun is set, only what would be done is logged.
+func (s *Server) SweepDerivatives(ctx context.Context, dryRun bool, logf func(format string, args ...any)) error {
+	// Uploads are looked up after listing, so derivatives of uploads made while we list
+	// aren't mistaken for orphans.
+	start := time.Now()
+	var objects []storage.Info
+	if err := s.store.List(ctx, "", func(info storage.Info) error {
+		// Files that are still being written by the local backend.
+		if strings.HasPrefix(path.Base(info.Name), ".tmp-") {
+			return nil
+		}
+
+		objects = append(objects, info)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var ids []string
+	if err := s.db.SelectContext(ctx, &ids, `SELECT "id" FROM "uploads"`); err != nil {
+		return err
+	}
+	uploads := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		uploads[id] = true
+	}
+
+	var entries []struct {
+		Name      string `db:"name"`
+		CreatedAt int64  `db:"created_at"`
+	}
+	if err := s.db.SelectContext(ctx, &entries, `SELECT "name", "created_at" FROM "derivatives"`); err != nil {
+		return err
+	}
+	registered := make(map[string]int64, len(entries))
+	for _, e := range entries {
+		registered[e.Name] = e.CreatedAt
+	}
+
+	var deleted, adopted int
+	var freed int64
+	for _, info := range objects {
+		id, ok := derivativeOwner(info.Name)
+		if !ok {
+			continue
+		}
+
+		_, stored := registered[info.Name]
+		delete(registered, info.Name)
+
+		if uploads[id] {
+			if stored {
+				continue
+			}
+
+			adopted++
+			if dryRun {
+				logf("Would register %s as a derivative of %s.", info.Name, id)
+				continue
+			}
+
+			if _, err := s.recordDerivative(ctx, id, info.Name, info.Size); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		deleted++
+		freed += info.Size
+		if dryRun {
+			logf("Would delete orphaned derivative %s (%d bytes).", info.Name, info.Size)
+			continue
+		}
+
+		if err := s.store.Delete(ctx, info.Name); err != nil && !errors.Is(err, storage.ErrNotExist) {
+			return err
+		}
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM "derivatives" WHERE "name" = $1`, info.Name); err != nil {
+			return err
+		}
+
+		logf("Deleted orphaned derivative %s (%d bytes).", info.Name, info.Size)
+	}
+
+	// Whatever is left is registered but isn't stored, unless it was stored after we listed.
+	var stale int
+	for name, createdAt := range registered {
+		if createdAt >= start.Unix() {
+			continue
+		}
+
+		stale++
+		if dryRun {
+			logf("Would drop %s from the registry, it isn't stored.", name)
+			continue
+		}
+
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM "derivatives" WHERE "name" = $1`, name); err != nil {
+			return err
+		}
+	}
+
+	logf("Orphaned derivatives: %d (%d bytes), unregistered derivatives: %d, stale registry entries: %d.", deleted, freed, adopted, stale)
+	return nil
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liondadev/quick-image-server/config"
+	"github.com/liondadev/quick-image-server/server/storage"
+)
+
+// registeredDerivatives returns the names of the registered derivatives of an upload.
+func registeredDerivatives(t *testing.T, s *Server, fileId string) []string {
+	t.Helper()
+
+	var names []string
+	if err := s.db.Select(&names, `SELECT "name" FROM "derivatives" WHERE "upload" = $1 ORDER BY "name"`, fileId); err != nil {
+		t.Fatal(err)
+	}
+
+	return names
+}
+
+// objectStored checks if an object is in storage.
+func objectStored(t *testing.T, s *Server, name string) bool {
+	t.Helper()
+
+	_, err := s.store.Stat(context.Background(), name)
+	if err != nil && !errors.Is(err, storage.ErrNotExist) {
+		t.Fatal(err)
+	}
+
+	return err == nil
+}
+
+func TestDerivativeOwner(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		ok   bool
+	}{
+		{name: "abc.thumbnail.480x270.contain.png", id: "abc", ok: true},
+		{name: "abc.thumbnail.png", id: "abc", ok: true},
+		{name: "abc.bubble.gif", id: "abc", ok: true},
+		{name: "bubbles/abc/default-bottom.gif", id: "abc", ok: true},
+		{name: "captions/abc/0123.png", id: "abc", ok: true},
+		{name: "abc.png"},
+		{name: "blobs/ab/abcdef"},
+		{name: "bubbles/abc"},
+		{name: "masks/alice/cat.png"},
+	}
+
+	for _, tt := range tests {
+		id, ok := derivativeOwner(tt.name)
+		if ok != tt.ok || (ok && id != tt.id) {
+			t.Errorf("derivativeOwner(%q) = %q, %v, want %q, %v", tt.name, id, ok, tt.id, tt.ok)
+		}
+	}
+}
+
+func TestDeleteRemovesDerivatives(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.Transform.Presets = []string{"w=32&format=png"}
+	})
+	up := newTestUpload(t, s, "alice", "cat.png", "image/png", testPNG(t, 64, 48), uploadOptions{})
+
+	for _, target := range []string{
+		"/thumb/" + up.Id + up.Extension,
+		"/thumb/small/" + up.Id + up.Extension,
+		"/bubble/" + up.Id + ".gif",
+		"/bubble/" + up.Id + ".png?pos=bottom",
+		"/i/" + up.Id + up.Extension + "?w=32&format=png",
+	} {
+		if res := serve(s, httptest.NewRequest(http.MethodGet, target, nil)); res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d, want %d", target, res.StatusCode, http.StatusOK)
+		}
+	}
+
+	derivatives := registeredDerivatives(t, s, up.Id)
+	if len(derivatives) != 4 {
+		t.Fatalf("got derivatives %q, want the thumbnails and bubbles", derivatives)
+	}
+	for _, name := range derivatives {
+		if !objectStored(t, s, name) {
+			t.Errorf("%s is registered but not stored", name)
+		}
+	}
+
+	res := serve(s, httptest.NewRequest(http.MethodGet, "/delete/"+up.Id+"/"+up.DeleteToken, nil))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("delete: got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	for _, name := range derivatives {
+		if objectStored(t, s, name) {
+			t.Errorf("%s is still stored", name)
+		}
+	}
+	if left := registeredDerivatives(t, s, up.Id); len(left) != 0 {
+		t.Errorf("derivatives %q are still registered", left)
+	}
+	if _, err := s.transforms.Open(up.Id, (transformParams{Width: 32, Fit: "contain", Format: "png"}).cacheKey()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the transformed image is still cached: %v", err)
+	}
+}
+
+func TestRecordDerivativeOfDeletedUpload(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	recorded, err := s.recordDerivative(context.Background(), "gone", "gone.thumbnail.png", 10)
+	if err != nil || recorded {
+		t.Errorf("got %v %v, want nothing recorded", recorded, err)
+	}
+}
+
+func TestSweepDerivatives(t *testing.T) {
+	s := newTestServer(t, nil)
+	ctx := context.Background()
+	up := newTestUpload(t, s, "alice", "cat.png", "image/png", testPNG(t, 64, 48), uploadOptions{})
+
+	put := func(name string) {
+		if _, err := s.store.Put(ctx, name, strings.NewReader("derivative")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orphans := []string{"gone.thumbnail.480x270.contain.png", "gone.bubble.gif", "bubbles/gone/default-bottom.gif", "captions/gone/0123.png"}
+	for _, name := range orphans {
+		put(name)
+	}
+	// A derivative of an upload from before the registry.
+	unregistered := up.Id + ".bubble.gif"
+	put(unregistered)
+	// Objects that aren't derivatives.
+	others := []string{"legacy.png", "masks/alice/cat.png"}
+	for _, name := range others {
+		put(name)
+	}
+	// A derivative that's registered but not stored.
+	if _, err := s.db.Exec(`INSERT INTO "derivatives" ("name", "upload", "size", "created_at") VALUES ($1, $2, 10, $3)`, up.Id+".thumbnail.1x1.contain.png", up.Id, time.Now().Add(-time.Hour).Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged []string
+	logf := func(format string, args ...any) { logged = append(logged, format) }
+
+	if err := s.SweepDerivatives(ctx, true, logf); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range orphans {
+		if !objectStored(t, s, name) {
+			t.Errorf("a dry run deleted %s", name)
+		}
+	}
+	if got := registeredDerivatives(t, s, up.Id); len(got) != 1 {
+		t.Errorf("a dry run changed the registry to %q", got)
+	}
+	if len(logged) == 0 {
+		t.Error("a dry run didn't log what it would do")
+	}
+
+	if err := s.SweepDerivatives(ctx, false, logf); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range orphans {
+		if objectStored(t, s, name) {
+			t.Errorf("orphan %s wasn't deleted", name)
+		}
+	}
+	for _, name := range append(others, unregistered, originalName(up)) {
+		if !objectStored(t, s, name) {
+			t.Errorf("%s was deleted", name)
+		}
+	}
+	if got := registeredDerivatives(t, s, up.Id); !slices.Equal(got, []string{unregistered}) {
+		t.Errorf("got registered derivatives %q, want only %s", got, unregistered)
+	}
+}
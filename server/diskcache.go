@@ -0,0 +1,167 @@
+package server
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// diskCache is a size bounded cache of files on the local disk. Files are kept in
+// groups (one folder each), so everything cached for an upload can be thrown away at
+// once. When the cache grows past its limit, the least recently used files are removed.
+type diskCache struct {
+	dir string
+	max int64
+
+	mu     sync.Mutex
+	size   int64
+	loaded bool // whether size has been counted from what's already on disk
+}
+
+func newDiskCache(dir string, max int64) *diskCache {
+	return &diskCache{dir: dir, max: max}
+}
+
+func (c *diskCache) path(group, key string) string {
+	return filepath.Join(c.dir, filepath.Base(group), filepath.Base(key))
+}
+
+// Open opens a cached file, or returns an error satisfying errors.Is(err, fs.ErrNotExist)
+// if it isn't cached.
+func (c *diskCache) Open(group, key string) (*os.File, error) {
+	p := c.path(group, key)
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// The modification time doubles as the last time the file was used.
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+
+	return f, nil
+}
+
+// Put stores data in the cache, evicting old files if the cache grows too big.
+func (c *diskCache) Put(group, key string, data []byte) error {
+	p := c.path(group, key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so nobody can open a half written file.
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.load()
+
+	if info, err := os.Stat(p); err == nil {
+		c.size -= info.Size()
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+	c.size += int64(len(data))
+
+	if c.size > c.max {
+		c.evict()
+	}
+
+	return nil
+}
+
+// Purge removes everything cached in a group.
+func (c *diskCache) Purge(group string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dir := filepath.Join(c.dir, filepath.Base(group))
+	if c.loaded {
+		_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				if info, err := d.Info(); err == nil {
+					c.size -= info.Size()
+				}
+			}
+			return nil
+		})
+	}
+
+	return os.RemoveAll(dir)
+}
+
+type cachedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// files lists every file in the cache. c.mu must be held.
+func (c *diskCache) files() []cachedFile {
+	var files []cachedFile
+	_ = filepath.WalkDir(c.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+
+		if info, err := d.Info(); err == nil {
+			files = append(files, cachedFile{p, info.Size(), info.ModTime()})
+		}
+		return nil
+	})
+
+	return files
+}
+
+// load counts the size of the files that were already cached before we started. c.mu must be held.
+func (c *diskCache) load() {
+	if c.loaded {
+		return
+	}
+
+	for _, f := range c.files() {
+		c.size += f.size
+	}
+	c.loaded = true
+}
+
+// evict removes the least recently used files until the cache is comfortably under its
+// limit, so we don't have to walk it again for every new file. c.mu must be held.
+func (c *diskCache) evict() {
+	files := c.files()
+	slices.SortFunc(files, func(a, b cachedFile) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	target := c.max / 10 * 9
+	for _, f := range files {
+		if c.size <= target {
+			break
+		}
+
+		if err := os.Remove(f.path); err == nil {
+			c.size -= f.size
+		}
+	}
+}
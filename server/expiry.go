@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liondadev/quick-image-server/types"
+)
+
+// parseExpiresIn parses how long an upload should stay around for. It's either a number
+// of seconds, a go duration like "1h30m", or a number of days like "7d".
+func parseExpiresIn(str string) (time.Duration, error) {
+	if secs, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+
+	if days, ok := strings.CutSuffix(str, "d"); ok {
+		n, err := strconv.ParseInt(days, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(str)
+}
+
+// parseExpiresAt parses when an upload should expire, either as a unix timestamp or in
+// the RFC 3339 format.
+func parseExpiresAt(str string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, str)
+}
+
+// uploadExpiry works out when a new upload expires from the expires_in and expires_at
+// fields, falling back to the default of the user. A zero time means it never expires.
+func (s *Server) uploadExpiry(userName string, expiresIn string, expiresAt string) (time.Time, error) {
+	now := time.Now()
+
+	switch {
+	case expiresIn != "" && expiresAt != "":
+		return time.Time{}, PublicError{http.StatusBadRequest, "Only one of expires_in and expires_at can be given."}
+	case expiresAt != "":
+		at, err := parseExpiresAt(expiresAt)
+		if err != nil {
+			return time.Time{}, PublicError{http.StatusBadRequest, "Invalid expires_at, it must be a unix timestamp or an RFC 3339 time."}
+		}
+		if !at.After(now) {
+			return time.Time{}, PublicError{http.StatusBadRequest, "expires_at must be in the future."}
+		}
+
+		return at, nil
+	case expiresIn == "never":
+		return time.Time{}, nil
+	case expiresIn != "":
+		dur, err := parseExpiresIn(expiresIn)
+		if err != nil || dur <= 0 {
+			return time.Time{}, PublicError{http.StatusBadRequest, "Invalid expires_in, it must be a positive number of seconds or a duration like 12h or 7d."}
+		}
+
+		return now.Add(dur), nil
+	}
+
+	def, ok := s.cfg.DefaultExpiry[userName]
+	if !ok || def == "" {
+		return time.Time{}, nil
+	}
+
+	dur, err := parseExpiresIn(def)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid default expiry for user '%s': %w", userName, err)
+	}
+
+	return now.Add(dur), nil
+}
+
+// isExpired checks if an upload has expired, but maybe hasn't been reaped yet.
+func isExpired(up types.Upload) bool {
+	return up.ExpiresAt != 0 && up.ExpiresAt <= uint64(time.Now().Unix())
+}
+
+// StartReaper starts a goroutine that deletes expired uploads, sessions and unfinished tus
+// uploads every interval, until ctx is cancelled.
+func (s *Server) StartReaper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.reapExpiredUploads(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("Failed to reap expired uploads: %s", err.Error())
+			}
+			if err := s.reapExpiredSessions(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("Failed to reap expired sessions: %s", err.Error())
+			}
+			if err := s.reapExpiredTusUploads(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("Failed to reap expired tus uploads: %s", err.Error())
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// reapExpiredUploads deletes every upload that has expired, along with its files.
+func (s *Server) reapExpiredUploads(ctx context.Context) error {
+	var ids []string
+	if err := s.db.Select(&ids, `SELECT "id" FROM "uploads" WHERE "expires_at" != 0 AND "expires_at" <= $1`, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		up, derivatives, err := s.deleteUpload(ctx, `DELETE FROM "uploads" WHERE "id" = $1 RETURNING "id", "ext", "blob"`, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			// Someone might have deleted it in the meantime, which is fine.
+			if !errors.Is(err, sql.ErrNoRows) {
+				log.Printf("Failed to delete expired upload '%s': %s", id, err.Error())
+			}
+			continue
+		}
+
+		if err := s.deleteUploadFiles(ctx, up, derivatives); err != nil {
+			log.Printf("Failed to delete the files of expired upload '%s': %s", id, err.Error())
+			continue
+		}
+
+		log.Printf("Reaped expired upload '%s'.", id)
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liondadev/quick-image-server/config"
+)
+
+func TestParseExpiresIn(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{in: "90", want: 90 * time.Second},
+		{in: "1h30m", want: 90 * time.Minute},
+		{in: "7d", want: 7 * 24 * time.Hour},
+		{in: "-5", want: -5 * time.Second},
+		{in: "xd", err: true},
+		{in: "soon", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseExpiresIn(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("parseExpiresIn(%q) = %s, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestUploadExpiry(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.DefaultExpiry = map[string]string{"alice": "1d", "broken": "whenever"}
+	})
+	now := time.Now()
+	future := now.Add(time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name      string
+		user      string
+		expiresIn string
+		expiresAt string
+		want      time.Duration // from now, roughly, or 0 for never
+		status    int           // of the PublicError, if any
+	}{
+		{name: "no expiry", user: "bob"},
+		{name: "default", user: "alice", want: 24 * time.Hour},
+		{name: "never overrides the default", user: "alice", expiresIn: "never"},
+		{name: "expires in", user: "bob", expiresIn: "2h", want: 2 * time.Hour},
+		{name: "expires at unix", user: "bob", expiresAt: strconv.FormatInt(future.Unix(), 10), want: time.Hour},
+		{name: "expires at rfc 3339", user: "bob", expiresAt: future.Format(time.RFC3339), want: time.Hour},
+		{name: "both", user: "bob", expiresIn: "2h", expiresAt: future.Format(time.RFC3339), status: http.StatusBadRequest},
+		{name: "in the past", user: "bob", expiresAt: now.Add(-time.Hour).Format(time.RFC3339), status: http.StatusBadRequest},
+		{name: "not positive", user: "bob", expiresIn: "0", status: http.StatusBadRequest},
+		{name: "invalid", user: "bob", expiresIn: "soon", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.uploadExpiry(tt.user, tt.expiresIn, tt.expiresAt)
+			if tt.status != 0 {
+				var pe PublicError
+				if !errors.As(err, &pe) || pe.Code != tt.status {
+					t.Errorf("got %v, want a public error with status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.want == 0 {
+				if !got.IsZero() {
+					t.Errorf("expires at %s, want never", got)
+				}
+				return
+			}
+			if d := got.Sub(now); d < tt.want-time.Minute || d > tt.want+time.Minute {
+				t.Errorf("expires in %s, want %s", d, tt.want)
+			}
+		})
+	}
+
+	// A broken config is our fault, not the client's.
+	if _, err := s.uploadExpiry("broken", "", ""); err == nil {
+		t.Error("an invalid default expiry was accepted")
+	} else if errors.As(err, new(PublicError)) {
+		t.Errorf("got a public error for an invalid default expiry: %v", err)
+	}
+}
+
+// expireUpload makes an upload expire a second ago.
+func expireUpload(t *testing.T, s *Server, id string) {
+	t.Helper()
+
+	if _, err := s.db.Exec(`UPDATE "uploads" SET "expires_at" = $1 WHERE "id" = $2`, time.Now().Add(-time.Second).Unix(), id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpiredUploads(t *testing.T) {
+	s := newTestServer(t, nil)
+	newTestKey(t, s, "alice", []string{ScopeUpload}, time.Time{})
+
+	expired := newTestUpload(t, s, "alice", "old.txt", "text/plain", []byte("shared"), uploadOptions{ExpiresAt: time.Now().Add(time.Hour)})
+	kept := newTestUpload(t, s, "alice", "new.txt", "text/plain", []byte("shared"), uploadOptions{ExpiresAt: time.Now().Add(time.Hour)})
+	forever := newTestUpload(t, s, "alice", "forever.txt", "text/plain", []byte("forever"), uploadOptions{})
+	expireUpload(t, s, expired.Id)
+
+	// It's gone as soon as it expires, even if it hasn't been reaped yet.
+	for _, target := range []string{"/f/" + expired.Id + ".txt", "/thumb/" + expired.Id + ".txt"} {
+		if res := serve(s, httptest.NewRequest(http.MethodGet, target, nil)); res.StatusCode != http.StatusGone {
+			t.Errorf("%s: got status %d, want %d", target, res.StatusCode, http.StatusGone)
+		}
+	}
+	if res := serve(s, httptest.NewRequest(http.MethodGet, "/f/"+kept.Id+".txt", nil)); res.StatusCode != http.StatusOK {
+		t.Errorf("an upload that hasn't expired: got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	logs := new(bytes.Buffer)
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(logs)
+
+	if err := s.reapExpiredUploads(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var left []string
+	if err := s.db.Select(&left, `SELECT "id" FROM "uploads" ORDER BY "id"`); err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 2 || !slices.Contains(left, kept.Id) || !slices.Contains(left, forever.Id) {
+		t.Errorf("got uploads %q after reaping, want %s and %s", left, kept.Id, forever.Id)
+	}
+	if refs := blobRefs(t, s, kept.Blob); refs != 1 || !blobStored(t, s, kept.Blob) {
+		t.Errorf("the blob of the upload that's left has %d references", refs)
+	}
+	if !strings.Contains(logs.String(), "Reaped expired upload '"+expired.Id+"'") {
+		t.Errorf("reaping wasn't logged: %s", logs)
+	}
+
+	// Failing to delete an upload is worth knowing about.
+	expireUpload(t, s, kept.Id)
+	if _, err := s.db.Exec(`DROP TABLE "derivatives"`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reapExpiredUploads(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "Failed to delete expired upload '"+kept.Id+"'") {
+		t.Errorf("the failure wasn't logged: %s", logs)
+	}
+}
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"context"
 	"database/sql"
 	"errors"
 	"log"
@@ -22,7 +21,7 @@ func (h FrontendHandlerWithError) ServeHTTP(w http.ResponseWriter, r *http.Reque
 	defer func() {
 		if err := recover(); err != nil {
 			log.Printf("Recovered from panic while handling frontend request for (%s) %s: %s", r.RemoteAddr, r.RequestURI, err)
-			_ = writeHTML(w, http.StatusInternalServerError, pages.Error("PANIC", "500 - Internal Server Error", "Unrecoverable Server Panic"))
+			_ = writeHTML(w, r, http.StatusInternalServerError, pages.Error("PANIC", "500 - Internal Server Error", "Unrecoverable Server Panic"))
 		}
 	}()
 
@@ -33,26 +32,33 @@ func (h FrontendHandlerWithError) ServeHTTP(w http.ResponseWriter, r *http.Reque
 		var perr PublicError
 		if errors.As(err, &perr) {
 			log.Printf("Encountered public error when serving frontend request for (%s) %s: %s", r.RemoteAddr, r.RequestURI, err.Error())
-			_ = writeHTML(w, perr.Code, pages.Error(dur, strconv.Itoa(perr.Code)+" - "+http.StatusText(perr.Code), perr.Message))
+			_ = writeHTML(w, r, perr.Code, pages.Error(dur, strconv.Itoa(perr.Code)+" - "+http.StatusText(perr.Code), perr.Message))
 
 			return
 		}
 
 		log.Printf("Encountered error when serving frontend request for (%s) %s: %s", r.RemoteAddr, r.RequestURI, err.Error())
-		_ = writeHTML(w, http.StatusInternalServerError, pages.Error(dur, "500 - Internal Server Error", "Internal Server Error"))
+		_ = writeHTML(w, r, http.StatusInternalServerError, pages.Error(dur, "500 - Internal Server Error", "Internal Server Error"))
 
 		return
 	}
 }
 
-func writeHTML(w http.ResponseWriter, status int, html templ.Component) error {
+func writeHTML(w http.ResponseWriter, r *http.Request, status int, html templ.Component) error {
+	ctx := pageContext(w, r) // before the header is written, since it might set a cookie
+
 	w.Header().Set("Content-Type", "text/html")
 	w.WriteHeader(status)
-	return html.Render(context.Background(), w)
+	return html.Render(ctx, w)
+}
+
+// renderLoginPage renders the login page, with an error to show on it.
+func (s *Server) renderLoginPage(w http.ResponseWriter, r *http.Request, status int, errText string) error {
+	return writeHTML(w, r, status, pages.Login(errText, s.oidcButtonLabel()))
 }
 
 func (s *Server) handleLoginPage(w http.ResponseWriter, r *http.Request) error {
-	return writeHTML(w, http.StatusOK, pages.Login(""))
+	return s.renderLoginPage(w, r, http.StatusOK, "")
 }
 
 func (s *Server) handlePostLoginPage(w http.ResponseWriter, r *http.Request) error {
@@ -63,23 +69,26 @@ func (s *Server) handlePostLoginPage(w http.ResponseWriter, r *http.Request) err
 
 	apiKey := r.FormValue("api_key")
 	if apiKey == "" {
-		return writeHTML(w, http.StatusBadRequest, pages.Login("Please enter an API key."))
+		return s.renderLoginPage(w, r, http.StatusBadRequest, "Please enter an API key.")
 	}
 
-	_, ok := s.cfg.Users[apiKey]
+	key, ok, err := s.authenticateAPIKey(r.Context(), apiKey)
+	if err != nil {
+		return err
+	}
 	if !ok {
-		return writeHTML(w, http.StatusBadRequest, pages.Login("Invalid API Key."))
+		return s.renderLoginPage(w, r, http.StatusBadRequest, "Invalid API Key.")
+	}
+
+	// The session can do what the key can, for as long as the key can.
+	if err := s.createSession(w, r, key.User, key.Id, key.Scopes, key.ExpiresAt); err != nil {
+		return err
 	}
 
-	exp := time.Now().Add(time.Hour * 24 * 30)
-	http.SetCookie(w, &http.Cookie{
-		Name:    "qis_api_key",
-		Value:   apiKey,
-		Path:    "/",
-		Expires: exp,
-	})
+	// Browsers from before sessions still have the key itself in a cookie.
+	http.SetCookie(w, &http.Cookie{Name: "qis_api_key", Value: "", Path: "/", MaxAge: -1})
 
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	http.Redirect(w, r, "/app", http.StatusSeeOther)
 	return nil
 }
 
@@ -98,7 +107,7 @@ func (s *Server) handleDashboardPage(w http.ResponseWriter, r *http.Request) err
 
 	// Collect the recent uploads
 	uploads := make([]types.Upload, 16)
-	if err := s.db.Select(&uploads, `SELECT "id", "mime", "user", "uploaded_at", "uploaded_as", "ext", "delete_token" FROM "uploads" WHERE "user" = $1 ORDER BY "uploaded_at" DESC LIMIT 16;`, userName); err != nil {
+	if err := s.db.Select(&uploads, `SELECT "id", "mime", "user", "uploaded_at", "uploaded_as", "ext", "delete_token", "expires_at", "burn_after_read", "password_hash", "visibility" FROM "uploads" WHERE "user" = $1 ORDER BY "uploaded_at" DESC LIMIT 16;`, userName); err != nil {
 		return err
 	}
 
@@ -106,10 +115,10 @@ func (s *Server) handleDashboardPage(w http.ResponseWriter, r *http.Request) err
 		lastUpload = uploads[0].Timestamp
 	}
 
-	return writeHTML(w, http.StatusOK, pages.Dashboard(userName, map[string]string{
+	return writeHTML(w, r, http.StatusOK, pages.Dashboard(userName, map[string]string{
 		"Total Uploads": strconv.Itoa(totalUploads),
 		"Last Upload":   time.Unix(int64(lastUpload), 0).Format(time.RFC1123),
-	}, uploads))
+	}, uploads, s.thumbnailSizes()))
 }
 
 func (s *Server) handleUploadsPage(w http.ResponseWriter, r *http.Request) error {
@@ -130,16 +139,16 @@ func (s *Server) handleUploadsPage(w http.ResponseWriter, r *http.Request) error
 	uploads := make([]types.Upload, 4*10)
 	if query != "" {
 		// This query is more expensive, even if we escape things properly.
-		if err := s.db.Select(&uploads, `SELECT "id", "mime", "user", "uploaded_at", "uploaded_as", "ext", "delete_token" FROM "uploads" WHERE "user" = $1 AND ("id" LIKE '%' || $2 || '%' OR "uploaded_as" LIKE '%' || $2 || '%' OR "mime" = $2 OR "ext" LIKE '%' || $2 || '%') ORDER BY "uploaded_at" DESC LIMIT 40 OFFSET $3;`, userName, query, (pageNum-1)*40); err != nil {
+		if err := s.db.Select(&uploads, `SELECT "id", "mime", "user", "uploaded_at", "uploaded_as", "ext", "delete_token", "expires_at", "burn_after_read", "password_hash", "visibility" FROM "uploads" WHERE "user" = $1 AND ("id" LIKE '%' || $2 || '%' OR "uploaded_as" LIKE '%' || $2 || '%' OR "mime" = $2 OR "ext" LIKE '%' || $2 || '%') ORDER BY "uploaded_at" DESC LIMIT 40 OFFSET $3;`, userName, query, (pageNum-1)*40); err != nil {
 			return err
 		}
 	} else {
-		if err := s.db.Select(&uploads, `SELECT "id", "mime", "user", "uploaded_at", "uploaded_as", "ext", "delete_token" FROM "uploads" WHERE "user" = $1 ORDER BY "uploaded_at" DESC LIMIT 40 OFFSET $2;`, userName, (pageNum-1)*40); err != nil {
+		if err := s.db.Select(&uploads, `SELECT "id", "mime", "user", "uploaded_at", "uploaded_as", "ext", "delete_token", "expires_at", "burn_after_read", "password_hash", "visibility" FROM "uploads" WHERE "user" = $1 ORDER BY "uploaded_at" DESC LIMIT 40 OFFSET $2;`, userName, (pageNum-1)*40); err != nil {
 			return err
 		}
 	}
 
-	return writeHTML(w, http.StatusOK, pages.Uploads(userName, uploads, query, pageNum))
+	return writeHTML(w, r, http.StatusOK, pages.Uploads(userName, uploads, s.thumbnailSizes(), query, pageNum))
 }
 
 func (s *Server) handleImportPage(w http.ResponseWriter, r *http.Request) error {
@@ -148,5 +157,5 @@ func (s *Server) handleImportPage(w http.ResponseWriter, r *http.Request) error
 		panic("user in middleware but not in context key?")
 	}
 
-	return writeHTML(w, http.StatusOK, pages.Import(userName))
+	return writeHTML(w, r, http.StatusOK, pages.Import(userName))
 }
@@ -1,6 +1,7 @@
 package server
 
 import (
+	cryptorand "crypto/rand"
 	"errors"
 	"math/rand/v2"
 )
@@ -15,11 +16,7 @@ func (s *Server) internalGetFreeFileId(n int, depth int) (string, error) {
 	}
 
 	// generate our id
-	id := make([]byte, n)
-	for idx := 0; idx < len(id); idx++ {
-		id[idx] = chars[rand.IntN(len(chars))]
-	}
-	idStr := string(id)
+	idStr := randomString(n)
 
 	if err := s.db.Get(&(struct{}{}), `SELECT "id" FROM "uploads" WHERE "id" = $1 LIMIT 1`, idStr); err == nil {
 		return s.internalGetFreeFileId(n, depth+1)
@@ -35,9 +32,37 @@ func (s *Server) getFreeFileId(n int) (string, error) {
 }
 
 func (s *Server) generateDeleteToken(n int) string {
+	return randomString(n)
+}
+
+// randomString generates a random string of length n out of chars.
+func randomString(n int) string {
 	id := make([]byte, n)
 	for idx := 0; idx < len(id); idx++ {
 		id[idx] = chars[rand.IntN(len(chars))]
 	}
 	return string(id)
 }
+
+// secretString generates a random string of length n out of chars, that's unpredictable
+// enough to be used as a secret like an API key.
+func secretString(n int) string {
+	out := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(out) < n {
+		if _, err := cryptorand.Read(buf); err != nil {
+			panic(err) // never happens on supported platforms
+		}
+
+		for _, b := range buf {
+			// Bytes past the last multiple of len(chars) would make some characters more likely.
+			if int(b) >= 256-256%len(chars) || len(out) == n {
+				continue
+			}
+
+			out = append(out, chars[int(b)%len(chars)])
+		}
+	}
+
+	return string(out)
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/liondadev/quick-image-server/server/pages"
+	"github.com/liondadev/quick-image-server/types"
+)
+
+const maxKeyLabelLength = 64
+
+// renderKeysPage renders the API key management page of a user, with a new key or an
+// error to show above it.
+func (s *Server) renderKeysPage(w http.ResponseWriter, r *http.Request, status int, newKey string, errText string) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	keys, err := s.ListAPIKeys(r.Context(), userName)
+	if err != nil {
+		return err
+	}
+
+	// Sessions remember the key that was used to log in.
+	currentId := ""
+	if key, ok := r.Context().Value(AuthenticatedKeyContextKey).(types.APIKey); ok {
+		currentId = key.Id
+	} else if sess, ok := r.Context().Value(AuthenticatedSessionContextKey).(types.Session); ok {
+		currentId = sess.KeyId
+	}
+
+	scopes, _ := r.Context().Value(AuthenticatedScopesContextKey).(string)
+	manageable := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		manageable[k.Id] = scopesCover(scopes, k.Scopes)
+	}
+
+	w.Header().Set("Cache-Control", "no-store") // the page can have a new key on it
+	return writeHTML(w, r, status, pages.Keys(userName, keys, manageable, currentId, grantableScopes(scopes), newKey, errText))
+}
+
+// manageableAPIKey returns the API key with the id of the user a request is authenticated
+// as, if the key or session it's authenticated with has every scope of it. Otherwise a key
+// that can only read would be able to revoke the keys that can do more.
+func (s *Server) manageableAPIKey(r *http.Request, userName string, id string) (types.APIKey, error) {
+	k, err := s.GetAPIKey(r.Context(), userName, id)
+	if err != nil {
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			return types.APIKey{}, PublicError{http.StatusNotFound, "API key not found."}
+		}
+
+		return types.APIKey{}, err
+	}
+
+	scopes, _ := r.Context().Value(AuthenticatedScopesContextKey).(string)
+	if !scopesCover(scopes, k.Scopes) {
+		return types.APIKey{}, PublicError{http.StatusForbidden, "This API key has scopes that you don't have, so you can't change it."}
+	}
+
+	return k, nil
+}
+
+func (s *Server) handleKeysPage(w http.ResponseWriter, r *http.Request) error {
+	return s.renderKeysPage(w, r, http.StatusOK, "", "")
+}
+
+func (s *Server) handleCreateKey(w http.ResponseWriter, r *http.Request) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return PublicError{http.StatusBadRequest, "Invalid form."}
+	}
+
+	label := r.PostFormValue("label")
+	if len(label) > maxKeyLabelLength {
+		return s.renderKeysPage(w, r, http.StatusBadRequest, "", "Labels can't be longer than 64 characters.")
+	}
+
+	var expiresAt time.Time
+	if expiresIn := r.PostFormValue("expires_in"); expiresIn != "" {
+		dur, err := parseExpiresIn(expiresIn)
+		if err != nil || dur <= 0 {
+			return s.renderKeysPage(w, r, http.StatusBadRequest, "", "Invalid expiry.")
+		}
+
+		expiresAt = time.Now().Add(dur)
+	}
+
+	// Keys can't be used to get scopes they don't have themselves.
+	for _, scope := range r.PostForm["scope"] {
+		if !hasScope(r, scope) {
+			return s.renderKeysPage(w, r, http.StatusForbidden, "", "You can't give a key scopes that you don't have.")
+		}
+	}
+
+	key, _, err := s.CreateAPIKey(r.Context(), userName, label, r.PostForm["scope"], expiresAt)
+	if err != nil {
+		if errors.Is(err, ErrInvalidScopes) {
+			return s.renderKeysPage(w, r, http.StatusBadRequest, "", "Pick at least one scope for the key.")
+		}
+
+		return err
+	}
+
+	return s.renderKeysPage(w, r, http.StatusOK, key, "")
+}
+
+func (s *Server) handleLabelKey(w http.ResponseWriter, r *http.Request) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	label := r.PostFormValue("label")
+	if len(label) > maxKeyLabelLength {
+		return s.renderKeysPage(w, r, http.StatusBadRequest, "", "Labels can't be longer than 64 characters.")
+	}
+
+	k, err := s.manageableAPIKey(r, userName, chi.URLParam(r, "keyId"))
+	if err != nil {
+		return err
+	}
+
+	if err := s.LabelAPIKey(r.Context(), userName, k.Id, label); err != nil {
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			return PublicError{http.StatusNotFound, "API key not found."}
+		}
+
+		return err
+	}
+
+	http.Redirect(w, r, "/app/keys", http.StatusSeeOther)
+	return nil
+}
+
+func (s *Server) handleRevokeKey(w http.ResponseWriter, r *http.Request) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	k, err := s.manageableAPIKey(r, userName, chi.URLParam(r, "keyId"))
+	if err != nil {
+		return err
+	}
+
+	if err := s.RevokeAPIKey(r.Context(), userName, k.Id); err != nil {
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			return PublicError{http.StatusNotFound, "API key not found."}
+		}
+
+		return err
+	}
+
+	http.Redirect(w, r, "/app/keys", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keyRequest sends a form to the key management routes, authenticated with key.
+func keyRequest(s *Server, key string, target string, form url.Values) *http.Response {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Server-Api-Key", key)
+
+	return serve(s, r)
+}
+
+func TestScopes(t *testing.T) {
+	if got, err := parseScopes([]string{ScopeImport, ScopeUpload, ScopeImport}); err != nil || got != "upload import" {
+		t.Errorf("parse scopes: got %q %v, want \"upload import\"", got, err)
+	}
+	for _, scopes := range [][]string{nil, {}, {"upload", "root"}} {
+		if _, err := parseScopes(scopes); !errors.Is(err, ErrInvalidScopes) {
+			t.Errorf("parse %q: got %v, want ErrInvalidScopes", scopes, err)
+		}
+	}
+
+	if !scopesInclude("admin", ScopeDeleteOwn) || scopesInclude("upload read-own", ScopeDeleteOwn) {
+		t.Error("only admin should include every scope")
+	}
+
+	if got := grantableScopes("read-own upload"); !slices.Equal(got, []string{ScopeUpload, ScopeReadOwn}) {
+		t.Errorf("got grantable scopes %q, want upload and read-own", got)
+	}
+	if got := grantableScopes("admin"); !slices.Equal(got, Scopes) {
+		t.Errorf("got grantable scopes %q for admin, want all of them", got)
+	}
+
+	tests := []struct {
+		scopes string
+		want   string
+		covers bool
+	}{
+		{scopes: "upload read-own", want: "upload", covers: true},
+		{scopes: "upload read-own", want: "read-own upload", covers: true},
+		{scopes: "upload read-own", want: "upload import", covers: false},
+		{scopes: "upload read-own", want: "admin", covers: false},
+		{scopes: "admin", want: "upload delete-own admin", covers: true},
+	}
+	for _, tt := range tests {
+		if got := scopesCover(tt.scopes, tt.want); got != tt.covers {
+			t.Errorf("scopesCover(%q, %q) = %v, want %v", tt.scopes, tt.want, got, tt.covers)
+		}
+	}
+}
+
+func TestKeysWithoutAdmin(t *testing.T) {
+	s := newTestServer(t, nil)
+	key, current := newTestKey(t, s, "alice", []string{ScopeUpload, ScopeReadOwn}, time.Time{})
+	ctx := context.Background()
+
+	r := httptest.NewRequest(http.MethodGet, "/app/keys", nil)
+	r.Header.Set("X-Server-Api-Key", key)
+	if res := serve(s, r); res.StatusCode != http.StatusOK {
+		t.Fatalf("keys page: got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	for _, scopes := range [][]string{{ScopeDeleteOwn}, {ScopeUpload, ScopeAdmin}} {
+		res := keyRequest(s, key, "/app/keys", url.Values{"scope": scopes})
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("create a key with %q: got status %d, want %d", scopes, res.StatusCode, http.StatusForbidden)
+		}
+	}
+
+	if res := keyRequest(s, key, "/app/keys", url.Values{"scope": {ScopeReadOwn}, "label": {"reader"}}); res.StatusCode != http.StatusOK {
+		t.Fatalf("create a key with fewer scopes: got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	keys, err := s.ListAPIKeys(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+	reader := keys[0]
+	if reader.Id == current.Id {
+		reader = keys[1]
+	}
+	if reader.Scopes != ScopeReadOwn || reader.Label != "reader" {
+		t.Errorf("got a key with scopes %q and label %q", reader.Scopes, reader.Label)
+	}
+
+	// Another user's admin key can't be touched at all, and a key with more scopes only by
+	// keys that have them too.
+	_, admin, err := s.CreateAPIKey(ctx, "alice", "admin", []string{ScopeAdmin}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestKey(t, s, "bob", []string{ScopeAdmin}, time.Time{})
+	bobKeys, err := s.ListAPIKeys(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{name: "label a key with more scopes", target: "/app/keys/" + admin.Id + "/label", want: http.StatusForbidden},
+		{name: "revoke a key with more scopes", target: "/app/keys/" + admin.Id + "/revoke", want: http.StatusForbidden},
+		{name: "revoke a key of someone else", target: "/app/keys/" + bobKeys[0].Id + "/revoke", want: http.StatusNotFound},
+		{name: "label a key with fewer scopes", target: "/app/keys/" + reader.Id + "/label", want: http.StatusSeeOther},
+		{name: "revoke a key with fewer scopes", target: "/app/keys/" + reader.Id + "/revoke", want: http.StatusSeeOther},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := keyRequest(s, key, tt.target, url.Values{"label": {"renamed"}})
+			if res.StatusCode != tt.want {
+				t.Errorf("got status %d, want %d", res.StatusCode, tt.want)
+			}
+		})
+	}
+
+	if k, err := s.GetAPIKey(ctx, "alice", admin.Id); err != nil || k.Label != "admin" {
+		t.Errorf("the admin key was changed: %+v %v", k, err)
+	}
+	if _, err := s.GetAPIKey(ctx, "bob", bobKeys[0].Id); err != nil {
+		t.Errorf("the key of bob was revoked: %v", err)
+	}
+	if _, err := s.GetAPIKey(ctx, "alice", reader.Id); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("the key with fewer scopes wasn't revoked: %v", err)
+	}
+}
+
+func TestAdminManagesEveryKey(t *testing.T) {
+	s := newTestServer(t, nil)
+	key, _ := newTestKey(t, s, "alice", []string{ScopeAdmin}, time.Time{})
+
+	_, other, err := s.CreateAPIKey(context.Background(), "alice", "", []string{ScopeUpload, ScopeImport}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := keyRequest(s, key, "/app/keys", url.Values{"scope": Scopes}); res.StatusCode != http.StatusOK {
+		t.Errorf("create a key with every scope: got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if res := keyRequest(s, key, "/app/keys/"+other.Id+"/revoke", nil); res.StatusCode != http.StatusSeeOther {
+		t.Errorf("revoke: got status %d, want %d", res.StatusCode, http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/liondadev/quick-image-server/server/bubble"
+	"github.com/liondadev/quick-image-server/types"
+)
+
+const (
+	maxMaskBytes     = 1 << 20
+	maxMaskDimension = 2048
+)
+
+var maskNameRegexp = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// bubbleMask is a mask that bubbles can be drawn with.
+type bubbleMask struct {
+	// Key identifies the contents of the mask, so bubbles drawn with different masks
+	// (or different versions of a mask with the same name) are cached separately.
+	Key   string
+	Alpha *image.Alpha
+}
+
+// maskKey returns the key of a mask stored as a blob.
+func maskKey(hash string) string {
+	return "m" + hash[:16]
+}
+
+// LoadBubbleMasks loads the masks from the config, which every user can draw bubbles with.
+func (s *Server) LoadBubbleMasks() error {
+	s.configMasks = make(map[string]bubbleMask, len(s.cfg.BubbleMasks))
+
+	for name, p := range s.cfg.BubbleMasks {
+		if !maskNameRegexp.MatchString(name) {
+			return fmt.Errorf("bubble mask '%s' has an invalid name", name)
+		}
+
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return fmt.Errorf("bubble mask '%s': %w", name, err)
+		}
+
+		hash, mask, err := decodeMask(data)
+		if err != nil {
+			return fmt.Errorf("bubble mask '%s': %w", name, err)
+		}
+
+		s.configMasks[name] = bubbleMask{Key: maskKey(hash), Alpha: mask}
+	}
+
+	return nil
+}
+
+// decodeMask decodes a mask image, returning the hash of its contents with it.
+func decodeMask(data []byte) (string, *image.Alpha, error) {
+	// A small file can still claim to be huge, so the size is checked before decoding.
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, fmt.Errorf("decode mask: %w", err)
+	}
+
+	if cfg.Width < 1 || cfg.Height < 1 || cfg.Width > maxMaskDimension || cfg.Height > maxMaskDimension {
+		return "", nil, fmt.Errorf("masks can't be bigger than %dx%d", maxMaskDimension, maxMaskDimension)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, fmt.Errorf("decode mask: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), bubble.MaskFromImage(img), nil
+}
+
+// resolveMask finds the mask with the name for drawing bubbles over an upload of owner.
+// The owner's own masks come first, then the masks from the config and then the built-in
+// ones. An empty name is the default mask.
+func (s *Server) resolveMask(ctx context.Context, owner string, name string) (bubbleMask, error) {
+	if name == "" {
+		name = bubble.DefaultMask
+	}
+
+	var userMask types.BubbleMask
+	err := s.db.Get(&userMask, `SELECT * FROM "bubble_masks" WHERE "user" = $1 AND "name" = $2`, owner, name)
+	if err == nil {
+		mask, err := s.userMaskAlpha(ctx, userMask.Blob)
+		if err != nil {
+			return bubbleMask{}, err
+		}
+
+		return bubbleMask{Key: maskKey(userMask.Blob), Alpha: mask}, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return bubbleMask{}, err
+	}
+
+	if mask, ok := s.configMasks[name]; ok {
+		return mask, nil
+	}
+
+	if mask, ok := bubble.Builtin.Get(name); ok {
+		return bubbleMask{Key: name, Alpha: mask}, nil
+	}
+
+	return bubbleMask{}, PublicError{http.StatusNotFound, "Mask not found."}
+}
+
+// userMaskAlpha loads a mask uploaded by a user. Masks are only decoded the first time
+// they're used.
+func (s *Server) userMaskAlpha(ctx context.Context, hash string) (*image.Alpha, error) {
+	if mask, ok := s.maskCache.Load(hash); ok {
+		return mask.(*image.Alpha), nil
+	}
+
+	f, err := s.store.Get(ctx, blobName(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	_, mask, err := decodeMask(data)
+	if err != nil {
+		return nil, err
+	}
+
+	s.maskCache.Store(hash, mask)
+	return mask, nil
+}
+
+// handleUploadMask handles users uploading a mask (or replacing one of theirs with the same
+// name). Fully opaque parts of the image are cut out of the bubble images drawn with it.
+func (s *Server) handleUploadMask(w http.ResponseWriter, r *http.Request) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxMaskBytes+1024*8)
+	if err := r.ParseMultipartForm(1024 * 8); err != nil {
+		return PublicError{http.StatusBadRequest, "Invalid form, masks can't be bigger than 1 MiB."}
+	}
+
+	name := r.FormValue("name")
+	if !maskNameRegexp.MatchString(name) {
+		return PublicError{http.StatusBadRequest, "Mask names can only have 1-32 lowercase letters, numbers, dashes and underscores."}
+	}
+
+	uploadedFile, _, err := r.FormFile("upload")
+	if err != nil {
+		return PublicError{http.StatusBadRequest, "No mask image uploaded."}
+	}
+	defer uploadedFile.Close()
+
+	data, err := io.ReadAll(io.LimitReader(uploadedFile, maxMaskBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxMaskBytes {
+		return PublicError{http.StatusRequestEntityTooLarge, "Masks can't be bigger than 1 MiB."}
+	}
+
+	if _, _, err := decodeMask(data); err != nil {
+		return PublicError{http.StatusBadRequest, "The mask isn't a valid image: " + err.Error()}
+	}
+
+	hash, _, err := s.acquireBlob(r.Context(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	var old string
+	if err := s.db.Get(&old, `SELECT "blob" FROM "bubble_masks" WHERE "user" = $1 AND "name" = $2`, userName, name); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		_ = s.releaseBlob(r.Context(), hash)
+		return err
+	}
+
+	if _, err := s.db.Exec(`INSERT INTO "bubble_masks" ("user", "name", "blob", "created_at") VALUES ($1, $2, $3, $4) ON CONFLICT ("user", "name") DO UPDATE SET "blob" = excluded."blob", "created_at" = excluded."created_at"`, userName, name, hash, time.Now().Unix()); err != nil {
+		_ = s.releaseBlob(r.Context(), hash)
+		return err
+	}
+
+	if old != "" {
+		s.maskCache.Delete(old)
+		if err := s.releaseBlob(r.Context(), old); err != nil {
+			log.Printf("Failed to release the old blob of mask '%s' of '%s': %s", name, userName, err.Error())
+		}
+	}
+
+	log.Printf("User '%s' uploaded bubble mask '%s'", userName, name)
+
+	writeJson(w, http.StatusCreated, jMap{"name": name})
+	return nil
+}
+
+// handleListMasks lists every mask a user can draw bubbles with.
+func (s *Server) handleListMasks(w http.ResponseWriter, r *http.Request) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	var userMasks []types.BubbleMask
+	if err := s.db.Select(&userMasks, `SELECT * FROM "bubble_masks" WHERE "user" = $1 ORDER BY "name"`, userName); err != nil {
+		return err
+	}
+
+	masks := make([]jMap, 0, len(userMasks)+len(s.configMasks))
+	for _, m := range userMasks {
+		masks = append(masks, jMap{"name": m.Name, "source": "user"})
+	}
+	for name := range s.configMasks {
+		masks = append(masks, jMap{"name": name, "source": "config"})
+	}
+	for _, name := range bubble.Builtin.Names() {
+		masks = append(masks, jMap{"name": name, "source": "builtin"})
+	}
+
+	writeJson(w, http.StatusOK, jMap{"masks": masks})
+	return nil
+}
+
+// handleDeleteMask handles users deleting one of their masks.
+func (s *Server) handleDeleteMask(w http.ResponseWriter, r *http.Request) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	var hash string
+	if err := s.db.Get(&hash, `DELETE FROM "bubble_masks" WHERE "user" = $1 AND "name" = $2 RETURNING "blob"`, userName, chi.URLParam(r, "name")); err != nil {
+		return PublicError{http.StatusNotFound, "Mask not found."}
+	}
+
+	s.maskCache.Delete(hash)
+	if err := s.releaseBlob(r.Context(), hash); err != nil {
+		return err
+	}
+
+	writeJson(w, http.StatusOK, jMap{"message": "Mask Deleted"})
+	return nil
+}
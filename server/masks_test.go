@@ -0,0 +1,51 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// pngClaimingSize returns a tiny png whose header says it's width by height pixels.
+func pngClaimingSize(t *testing.T, width uint32, height uint32) []byte {
+	t.Helper()
+
+	buff := new(bytes.Buffer)
+	if err := png.Encode(buff, image.NewAlpha(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buff.Bytes()
+
+	// The IHDR chunk comes right after the 8 byte signature: length, type, width, height,
+	// then the rest of the header and the crc of everything after the length.
+	ihdr := data[8:]
+	binary.BigEndian.PutUint32(ihdr[8:], width)
+	binary.BigEndian.PutUint32(ihdr[12:], height)
+	binary.BigEndian.PutUint32(ihdr[21:], crc32.ChecksumIEEE(ihdr[4:21]))
+
+	return data
+}
+
+func TestDecodeMask(t *testing.T) {
+	small := new(bytes.Buffer)
+	if err := png.Encode(small, image.NewAlpha(image.Rect(0, 0, 30, 20))); err != nil {
+		t.Fatal(err)
+	}
+
+	_, mask, err := decodeMask(small.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mask.Bounds() != image.Rect(0, 0, 30, 20) {
+		t.Errorf("got a %v mask, want 30x20", mask.Bounds())
+	}
+
+	for _, size := range [][2]uint32{{maxMaskDimension + 1, 1}, {1, maxMaskDimension + 1}, {1 << 30, 1 << 30}} {
+		if _, _, err := decodeMask(pngClaimingSize(t, size[0], size[1])); err == nil {
+			t.Errorf("a %dx%d mask was decoded", size[0], size[1])
+		}
+	}
+}
@@ -3,60 +3,87 @@ package server
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 )
 
 const (
 	AuthenticatedUserAPIKeyContextKey = "qis::api_key"
 	AuthenticatedUserContextKey       = "qis::authenticated_user"
+	AuthenticatedScopesContextKey     = "qis::authenticated_scopes"  // space separated scopes the request has
+	AuthenticatedKeyContextKey        = "qis::authenticated_key"     // the types.APIKey the request was authenticated with, if any
+	AuthenticatedSessionContextKey    = "qis::authenticated_session" // the types.Session the request was authenticated with, if any
 )
 
 // preHandleAuthentication sets the context with the key AuthenticatedUserContextKey to be either the
-// name of the authenticated user, or an empty string if the user isn't authenticated.
+// name of the authenticated user, or an empty string if the user isn't authenticated. API clients
+// authenticate with the X-Server-Api-Key header, and the dashboard with a session cookie.
 func (s *Server) preHandleAuthentication(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var apiKey string
-		// check header
-		h := r.Header.Get("X-Server-Api-Key")
-		if h != "" {
-			apiKey = h
-		}
+	return HandlerWithError(func(w http.ResponseWriter, r *http.Request) error {
+		ctx := context.WithValue(r.Context(), AuthenticatedUserAPIKeyContextKey, "")
+		ctx = context.WithValue(ctx, AuthenticatedUserContextKey, "")
+		ctx = context.WithValue(ctx, AuthenticatedScopesContextKey, "")
 
-		// check cookie - for the frontend
-		cook, err := r.Cookie("qis_api_key")
-		if err == nil {
-			apiKey = cook.Value
-		}
+		if apiKey := r.Header.Get("X-Server-Api-Key"); apiKey != "" {
+			key, ok, err := s.authenticateAPIKey(r.Context(), apiKey)
+			if err != nil {
+				return err
+			}
 
-		user, ok := s.cfg.Users[apiKey]
-		if !ok {
-			ctx := context.WithValue(r.Context(), AuthenticatedUserAPIKeyContextKey, "")
-			ctx = context.WithValue(ctx, AuthenticatedUserContextKey, "")
-			next.ServeHTTP(w, r.WithContext(ctx))
+			if ok {
+				ctx = context.WithValue(ctx, AuthenticatedUserAPIKeyContextKey, apiKey)
+				ctx = context.WithValue(ctx, AuthenticatedUserContextKey, key.User)
+				ctx = context.WithValue(ctx, AuthenticatedScopesContextKey, key.Scopes)
+				ctx = context.WithValue(ctx, AuthenticatedKeyContextKey, key)
+			}
+		} else if cook, err := r.Cookie(sessionCookieName); err == nil {
+			sess, ok, err := s.authenticateSession(r.Context(), cook.Value)
+			if err != nil {
+				return err
+			}
 
-			return
+			if ok {
+				ctx = context.WithValue(ctx, AuthenticatedUserContextKey, sess.User)
+				ctx = context.WithValue(ctx, AuthenticatedScopesContextKey, sess.Scopes)
+				ctx = context.WithValue(ctx, AuthenticatedSessionContextKey, sess)
+			}
 		}
 
-		ctx := context.WithValue(r.Context(), AuthenticatedUserAPIKeyContextKey, apiKey)
-		ctx = context.WithValue(ctx, AuthenticatedUserContextKey, user)
 		next.ServeHTTP(w, r.WithContext(ctx))
+
+		return nil
 	})
 }
 
-func (s *Server) preHandleRequireAuthentication(next http.Handler) http.Handler {
-	return HandlerWithError(func(w http.ResponseWriter, r *http.Request) error {
-		username := r.Context().Value(AuthenticatedUserContextKey)
-		if username == nil {
-			return errors.New("attempted to require authentication when the prehandleauthentication middleware isn't called")
-		}
+// preHandleRequireAuthentication makes sure the request is authenticated with a key that
+// has scope, or with any key if scope is empty. Requests that aren't authenticated at all
+// are sent to the login page.
+func (s *Server) preHandleRequireAuthentication(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return HandlerWithError(func(w http.ResponseWriter, r *http.Request) error {
+			username := r.Context().Value(AuthenticatedUserContextKey)
+			if username == nil {
+				return errors.New("attempted to require authentication when the prehandleauthentication middleware isn't called")
+			}
 
-		if username == "" {
-			http.Redirect(w, r, "/app/login", http.StatusTemporaryRedirect)
-			return nil
-		}
+			if username == "" {
+				http.Redirect(w, r, "/app/login", http.StatusTemporaryRedirect)
+				return nil
+			}
 
-		next.ServeHTTP(w, r)
+			if scope != "" && !hasScope(r, scope) {
+				return PublicError{http.StatusForbidden, fmt.Sprintf("You need the '%s' scope for this, which the API key you used doesn't have.", scope)}
+			}
 
-		return nil
-	})
+			next.ServeHTTP(w, r)
+
+			return nil
+		})
+	}
+}
+
+// hasScope checks if the request was authenticated with a key or session that has scope.
+func hasScope(r *http.Request, scope string) bool {
+	scopes, _ := r.Context().Value(AuthenticatedScopesContextKey).(string)
+	return scopesInclude(scopes, scope)
 }
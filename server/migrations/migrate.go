@@ -0,0 +1,183 @@
+// Package migrations keeps track of, and applies, the changes to the database schema.
+// Every migration has a version number, and the versions that have been applied are
+// stored in the "schema_migrations" table.
+package migrations
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Migration is a single, numbered, change to the database schema.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sqlx.Tx) error
+	Down    func(tx *sqlx.Tx) error
+}
+
+// Status is whether a migration has been applied to a database.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Exec returns a migration step that executes each of the statements in order.
+func Exec(stmts ...string) func(tx *sqlx.Tx) error {
+	return func(tx *sqlx.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// Latest returns the version of the newest migration.
+func Latest() int {
+	if len(All) == 0 {
+		return 0
+	}
+
+	return All[len(All)-1].Version
+}
+
+// ensureTable creates the table we keep track of applied migrations in.
+func ensureTable(db *sqlx.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS "schema_migrations" ("version" INTEGER PRIMARY KEY, "name" TEXT, "applied_at" INTEGER)`)
+	return err
+}
+
+// applied returns when each applied migration version was applied.
+func applied(db *sqlx.DB) (map[int]time.Time, error) {
+	if err := ensureTable(db); err != nil {
+		return nil, fmt.Errorf("create migrations table: %w", err)
+	}
+
+	var rows []struct {
+		Version   int   `db:"version"`
+		AppliedAt int64 `db:"applied_at"`
+	}
+	if err := db.Select(&rows, `SELECT "version", "applied_at" FROM "schema_migrations"`); err != nil {
+		return nil, err
+	}
+
+	versions := make(map[int]time.Time, len(rows))
+	for _, row := range rows {
+		versions[row.Version] = time.Unix(row.AppliedAt, 0)
+	}
+
+	return versions, nil
+}
+
+// Current returns the version of the newest applied migration, or 0 if none are applied.
+func Current(db *sqlx.DB) (int, error) {
+	versions, err := applied(db)
+	if err != nil {
+		return 0, err
+	}
+
+	current := 0
+	for v := range versions {
+		current = max(current, v)
+	}
+
+	return current, nil
+}
+
+// List returns every known migration and whether it has been applied.
+func List(db *sqlx.DB) ([]Status, error) {
+	versions, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(All))
+	for _, m := range All {
+		at, ok := versions[m.Version]
+		statuses = append(statuses, Status{Migration: m, Applied: ok, AppliedAt: at})
+	}
+
+	return statuses, nil
+}
+
+// Migrate applies or reverts migrations until the database is at the target version.
+// Every migration runs in its own transaction, so a failing migration leaves the
+// database at the version before it.
+func Migrate(db *sqlx.DB, target int, logf func(format string, args ...any)) error {
+	if target < 0 || (target > 0 && !slices.ContainsFunc(All, func(m Migration) bool { return m.Version == target })) {
+		return fmt.Errorf("unknown migration version %d", target)
+	}
+
+	versions, err := applied(db)
+	if err != nil {
+		return err
+	}
+
+	// Apply everything up to the target that isn't applied yet, oldest first.
+	for _, m := range All {
+		if m.Version > target {
+			break
+		}
+		if _, ok := versions[m.Version]; ok {
+			continue
+		}
+
+		logf("Applying migration %03d (%s)", m.Version, m.Name)
+		if err := run(db, m, m.Up, true); err != nil {
+			return fmt.Errorf("apply migration %03d (%s): %w", m.Version, m.Name, err)
+		}
+	}
+
+	// Revert everything after the target that is applied, newest first.
+	for i := len(All) - 1; i >= 0; i-- {
+		m := All[i]
+		if m.Version <= target {
+			break
+		}
+		if _, ok := versions[m.Version]; !ok {
+			continue
+		}
+
+		if m.Down == nil {
+			return fmt.Errorf("migration %03d (%s) can't be reverted", m.Version, m.Name)
+		}
+
+		logf("Reverting migration %03d (%s)", m.Version, m.Name)
+		if err := run(db, m, m.Down, false); err != nil {
+			return fmt.Errorf("revert migration %03d (%s): %w", m.Version, m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// run runs a single step of a migration and records it in a transaction.
+func run(db *sqlx.DB, m Migration, step func(tx *sqlx.Tx) error, up bool) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := step(tx); err != nil {
+		return err
+	}
+
+	if up {
+		_, err = tx.Exec(`INSERT INTO "schema_migrations" ("version", "name", "applied_at") VALUES ($1, $2, $3)`, m.Version, m.Name, time.Now().Unix())
+	} else {
+		_, err = tx.Exec(`DELETE FROM "schema_migrations" WHERE "version" = $1`, m.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,175 @@
+package migrations
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/jmoiron/sqlx"
+)
+
+func newTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+
+	db, err := sqlx.Open("sqlite", filepath.Join(t.TempDir(), "database.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func discard(string, ...any) {}
+
+func tableExists(t *testing.T, db *sqlx.DB, name string) bool {
+	t.Helper()
+
+	var exists bool
+	if err := db.Get(&exists, `SELECT EXISTS (SELECT 1 FROM "sqlite_master" WHERE "type" = 'table' AND "name" = $1)`, name); err != nil {
+		t.Fatal(err)
+	}
+
+	return exists
+}
+
+func currentVersion(t *testing.T, db *sqlx.DB) int {
+	t.Helper()
+
+	v, err := Current(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return v
+}
+
+func TestVersionsAreOrdered(t *testing.T) {
+	for i, m := range All {
+		if m.Version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", m.Name, m.Version, i+1)
+		}
+		if m.Up == nil {
+			t.Errorf("migration %03d (%s) has no up step", m.Version, m.Name)
+		}
+	}
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := Migrate(db, Latest(), discard); err != nil {
+		t.Fatal(err)
+	}
+	if v := currentVersion(t, db); v != Latest() {
+		t.Fatalf("at version %d after migrating, want %d", v, Latest())
+	}
+
+	statuses, err := List(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range statuses {
+		if !st.Applied || st.AppliedAt.IsZero() {
+			t.Errorf("migration %03d (%s) isn't applied", st.Version, st.Name)
+		}
+	}
+
+	// Migrating again does nothing.
+	if err := Migrate(db, Latest(), func(format string, args ...any) {
+		t.Errorf("migrated an up to date database: "+format, args...)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every migration can be reverted, and applied again after.
+	if err := Migrate(db, 0, discard); err != nil {
+		t.Fatal(err)
+	}
+	if v := currentVersion(t, db); v != 0 {
+		t.Errorf("at version %d after reverting everything, want 0", v)
+	}
+	if tableExists(t, db, "uploads") {
+		t.Error("the uploads table is still there after reverting everything")
+	}
+
+	if err := Migrate(db, Latest(), discard); err != nil {
+		t.Fatal(err)
+	}
+	if v := currentVersion(t, db); v != Latest() {
+		t.Errorf("at version %d after migrating again, want %d", v, Latest())
+	}
+}
+
+func TestMigrateToVersion(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := Migrate(db, 2, discard); err != nil {
+		t.Fatal(err)
+	}
+	if v := currentVersion(t, db); v != 2 {
+		t.Errorf("at version %d, want 2", v)
+	}
+	if !tableExists(t, db, "tus_uploads") || tableExists(t, db, "blobs") {
+		t.Error("got the wrong tables for version 2")
+	}
+
+	if err := Migrate(db, Latest()+1, discard); err == nil {
+		t.Error("migrated to a version that doesn't exist")
+	}
+	if err := Migrate(db, -1, discard); err == nil {
+		t.Error("migrated to a negative version")
+	}
+}
+
+func TestMigrateExistingDatabase(t *testing.T) {
+	db := newTestDB(t)
+
+	// Databases from before migrations were tracked already have the uploads table.
+	if _, err := db.Exec(`CREATE TABLE "uploads" ("id" TEXT PRIMARY KEY, "mime" TEXT, "user" TEXT, "uploaded_at" INTEGER, "uploaded_as" TEXT, "delete_token" TEXT, "ext" TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO "uploads" ("id", "mime", "user", "uploaded_at", "uploaded_as", "delete_token", "ext") VALUES ('abc', 'image/png', 'alice', 1, 'a.png', 'token', '.png')`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(db, Latest(), discard); err != nil {
+		t.Fatal(err)
+	}
+
+	var user string
+	if err := db.Get(&user, `SELECT "user" FROM "uploads" WHERE "id" = 'abc'`); err != nil || user != "alice" {
+		t.Errorf("the existing upload is gone: %q %v", user, err)
+	}
+}
+
+func TestMigrateFailureRollsBack(t *testing.T) {
+	db := newTestDB(t)
+
+	all := All
+	t.Cleanup(func() { All = all })
+	All = append(slices.Clone(all), Migration{
+		Version: Latest() + 1,
+		Name:    "broken",
+		Up:      Exec(`CREATE TABLE "half_done" ("id" TEXT)`, `THIS IS NOT SQL`),
+	})
+
+	if err := Migrate(db, Latest(), discard); err == nil {
+		t.Fatal("a broken migration was applied")
+	}
+	if v := currentVersion(t, db); v != Latest()-1 {
+		t.Errorf("at version %d, want the version before the broken one %d", v, Latest()-1)
+	}
+	if tableExists(t, db, "half_done") {
+		t.Error("the broken migration was partly applied")
+	}
+
+	// It can't be reverted either, since it has no down step.
+	if _, err := db.Exec(`INSERT INTO "schema_migrations" ("version", "name", "applied_at") VALUES ($1, 'broken', 0)`, Latest()); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(db, Latest()-1, discard); err == nil {
+		t.Error("reverted a migration without a down step")
+	}
+}
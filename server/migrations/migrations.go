@@ -0,0 +1,189 @@
+package migrations
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// All is every migration, ordered by version. Migrations that have been released must
+// never be changed, add a new one instead.
+//
+// The first few migrations existed before migrations were tracked, so they are written
+// to also work on databases that already have their changes.
+var All = []Migration{
+	{
+		Version: 1,
+		Name:    "create uploads",
+		Up:      Exec(`CREATE TABLE IF NOT EXISTS "uploads" ("id" TEXT PRIMARY KEY, "mime" TEXT, "user" TEXT, "uploaded_at" INTEGER, "uploaded_as" TEXT, "delete_token" TEXT, "ext" TEXT)`),
+		Down:    Exec(`DROP TABLE "uploads"`),
+	},
+	{
+		Version: 2,
+		Name:    "create tus uploads",
+		Up:      Exec(`CREATE TABLE IF NOT EXISTS "tus_uploads" ("id" TEXT PRIMARY KEY, "user" TEXT, "length" INTEGER, "offset" INTEGER, "metadata" TEXT, "created_at" INTEGER, "file_id" TEXT)`),
+		Down:    Exec(`DROP TABLE "tus_uploads"`),
+	},
+	{
+		Version: 3,
+		Name:    "content-addressed blobs",
+		Up: func(tx *sqlx.Tx) error {
+			if err := Exec(`CREATE TABLE IF NOT EXISTS "blobs" ("hash" TEXT PRIMARY KEY, "size" INTEGER, "refs" INTEGER, "created_at" INTEGER)`)(tx); err != nil {
+				return err
+			}
+
+			return addColumn(tx, "uploads", "blob", `TEXT NOT NULL DEFAULT ''`)
+		},
+		Down: Exec(
+			`ALTER TABLE "uploads" DROP COLUMN "blob"`,
+			`DROP TABLE "blobs"`,
+		),
+	},
+	{
+		Version: 4,
+		Name:    "upload expiration",
+		Up: Exec(
+			`ALTER TABLE "uploads" ADD COLUMN "expires_at" INTEGER NOT NULL DEFAULT 0`,
+			`CREATE INDEX "uploads_expires_at" ON "uploads" ("expires_at") WHERE "expires_at" != 0`,
+		),
+		Down: Exec(
+			`DROP INDEX "uploads_expires_at"`,
+			`ALTER TABLE "uploads" DROP COLUMN "expires_at"`,
+		),
+	},
+	{
+		Version: 5,
+		Name:    "burn after reading",
+		Up:      Exec(`ALTER TABLE "uploads" ADD COLUMN "burn_after_read" INTEGER NOT NULL DEFAULT 0`),
+		Down:    Exec(`ALTER TABLE "uploads" DROP COLUMN "burn_after_read"`),
+	},
+	{
+		Version: 6,
+		Name:    "upload passwords",
+		Up:      Exec(`ALTER TABLE "uploads" ADD COLUMN "password_hash" TEXT NOT NULL DEFAULT ''`),
+		Down:    Exec(`ALTER TABLE "uploads" DROP COLUMN "password_hash"`),
+	},
+	{
+		Version: 7,
+		Name:    "upload visibility",
+		Up:      Exec(`ALTER TABLE "uploads" ADD COLUMN "visibility" TEXT NOT NULL DEFAULT 'public'`),
+		Down:    Exec(`ALTER TABLE "uploads" DROP COLUMN "visibility"`),
+	},
+	{
+		Version: 8,
+		Name:    "bubble masks",
+		Up:      Exec(`CREATE TABLE IF NOT EXISTS "bubble_masks" ("user" TEXT NOT NULL, "name" TEXT NOT NULL, "blob" TEXT NOT NULL, "created_at" INTEGER, PRIMARY KEY ("user", "name"))`),
+		Down:    Exec(`DROP TABLE "bubble_masks"`),
+	},
+	{
+		Version: 9,
+		Name:    "derivative registry",
+		Up: Exec(
+			`CREATE TABLE IF NOT EXISTS "derivatives" ("name" TEXT PRIMARY KEY, "upload" TEXT NOT NULL, "size" INTEGER, "created_at" INTEGER)`,
+			`CREATE INDEX "derivatives_upload" ON "derivatives" ("upload")`,
+		),
+		Down: Exec(
+			`DROP INDEX "derivatives_upload"`,
+			`DROP TABLE "derivatives"`,
+		),
+	},
+	{
+		Version: 10,
+		Name:    "users and api keys",
+		Up: Exec(
+			`CREATE TABLE IF NOT EXISTS "users" ("name" TEXT PRIMARY KEY, "created_at" INTEGER)`,
+			`CREATE TABLE IF NOT EXISTS "api_keys" ("id" TEXT PRIMARY KEY, "user" TEXT NOT NULL, "hash" TEXT NOT NULL UNIQUE, "prefix" TEXT NOT NULL, "label" TEXT NOT NULL DEFAULT '', "created_at" INTEGER, "last_used_at" INTEGER NOT NULL DEFAULT 0)`,
+			`CREATE INDEX "api_keys_user" ON "api_keys" ("user")`,
+			`CREATE TABLE IF NOT EXISTS "settings" ("key" TEXT PRIMARY KEY, "value" TEXT NOT NULL)`,
+		),
+		Down: Exec(
+			`DROP TABLE "settings"`,
+			`DROP INDEX "api_keys_user"`,
+			`DROP TABLE "api_keys"`,
+			`DROP TABLE "users"`,
+		),
+	},
+	{
+		Version: 11,
+		Name:    "api key scopes and expiry",
+		Up: Exec(
+			// Keys from before scopes could do everything.
+			`ALTER TABLE "api_keys" ADD COLUMN "scopes" TEXT NOT NULL DEFAULT 'upload read-own delete-own import admin'`,
+			`ALTER TABLE "api_keys" ADD COLUMN "expires_at" INTEGER NOT NULL DEFAULT 0`,
+		),
+		Down: Exec(
+			`ALTER TABLE "api_keys" DROP COLUMN "expires_at"`,
+			`ALTER TABLE "api_keys" DROP COLUMN "scopes"`,
+		),
+	},
+	{
+		Version: 12,
+		Name:    "sessions",
+		Up: Exec(
+			`CREATE TABLE IF NOT EXISTS "sessions" ("id" TEXT PRIMARY KEY, "hash" TEXT NOT NULL UNIQUE, "user" TEXT NOT NULL, "key_id" TEXT NOT NULL DEFAULT '', "scopes" TEXT NOT NULL, "created_at" INTEGER, "last_seen_at" INTEGER, "user_agent" TEXT NOT NULL DEFAULT '', "ip" TEXT NOT NULL DEFAULT '')`,
+			`CREATE INDEX "sessions_user" ON "sessions" ("user")`,
+		),
+		Down: Exec(
+			`DROP INDEX "sessions_user"`,
+			`DROP TABLE "sessions"`,
+		),
+	},
+	{
+		Version: 13,
+		Name:    "oidc identities",
+		Up: Exec(
+			`CREATE TABLE IF NOT EXISTS "oidc_identities" ("issuer" TEXT NOT NULL, "subject" TEXT NOT NULL, "user" TEXT NOT NULL, "created_at" INTEGER, PRIMARY KEY ("issuer", "subject"))`,
+			`CREATE INDEX "oidc_identities_user" ON "oidc_identities" ("user")`,
+		),
+		Down: Exec(
+			`DROP INDEX "oidc_identities_user"`,
+			`DROP TABLE "oidc_identities"`,
+		),
+	},
+	{
+		Version: 14,
+		Name:    "tus upload password hashes",
+		Up: Exec(
+			`ALTER TABLE "tus_uploads" ADD COLUMN "password_hash" TEXT NOT NULL DEFAULT ''`,
+		),
+		Down: Exec(
+			`ALTER TABLE "tus_uploads" DROP COLUMN "password_hash"`,
+		),
+	},
+	{
+		Version: 15,
+		Name:    "session expiry",
+		Up: Exec(
+			`ALTER TABLE "sessions" ADD COLUMN "expires_at" INTEGER NOT NULL DEFAULT 0`,
+			// Sessions made before this keep working after their key expires, so end them now.
+			`UPDATE "sessions" SET "expires_at" = (SELECT "expires_at" FROM "api_keys" WHERE "api_keys"."id" = "sessions"."key_id") WHERE "key_id" != '' AND EXISTS (SELECT 1 FROM "api_keys" WHERE "api_keys"."id" = "sessions"."key_id")`,
+		),
+		Down: Exec(
+			`ALTER TABLE "sessions" DROP COLUMN "expires_at"`,
+		),
+	},
+	{
+		Version: 16,
+		Name:    "tus upload activity",
+		Up: Exec(
+			`ALTER TABLE "tus_uploads" ADD COLUMN "updated_at" INTEGER NOT NULL DEFAULT 0`,
+			`UPDATE "tus_uploads" SET "updated_at" = "created_at"`,
+		),
+		Down: Exec(
+			`ALTER TABLE "tus_uploads" DROP COLUMN "updated_at"`,
+		),
+	},
+}
+
+// addColumn adds a column to a table, unless the table already has it.
+func addColumn(tx *sqlx.Tx, table string, column string, definition string) error {
+	var exists bool
+	if err := tx.Get(&exists, `SELECT COUNT(*) > 0 FROM pragma_table_info($1) WHERE "name" = $2`, table, column); err != nil {
+		return err
+	}
+
+	if exists {
+		return nil
+	}
+
+	_, err := tx.Exec(`ALTER TABLE "` + table + `" ADD COLUMN "` + column + `" ` + definition)
+	return err
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcCookieName   = "qis_oidc"
+	oidcCookiePath   = "/app/login/oidc"
+	oidcCookieAge    = 10 * 60 // seconds someone has to log in at the identity provider
+	oidcStateLength  = 32
+	oidcDiscoverTime = 10 * time.Second
+
+	defaultOIDCUsernameClaim = "preferred_username"
+	defaultOIDCButtonLabel   = "Log in with SSO"
+)
+
+var defaultOIDCScopes = []string{oidc.ScopeOpenID, "profile", "email"}
+
+// defaultOIDCSessionScopes is what people that log in with the identity provider can do
+// unless the config says otherwise. Admin isn't included, it isn't needed to manage their
+// own keys and sessions, and the keys they create can only have these scopes.
+var defaultOIDCSessionScopes = []string{ScopeUpload, ScopeReadOwn, ScopeDeleteOwn, ScopeImport}
+
+// ErrOIDCNotEnabled is returned when linking identities while OIDC isn't configured.
+var ErrOIDCNotEnabled = errors.New("oidc isn't configured")
+
+// oidcClient is what's needed to log someone in with the identity provider.
+type oidcClient struct {
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	scopes   string // the scopes sessions get
+}
+
+// oidcEnabled reports if people can log into the dashboard with an identity provider.
+func (s *Server) oidcEnabled() bool {
+	return s.cfg.OIDC.Issuer != "" && s.cfg.OIDC.ClientID != ""
+}
+
+// oidcButtonLabel returns the text of the login button, or an empty string if logging
+// in with an identity provider isn't enabled.
+func (s *Server) oidcButtonLabel() string {
+	if !s.oidcEnabled() {
+		return ""
+	}
+
+	if s.cfg.OIDC.ButtonLabel != "" {
+		return s.cfg.OIDC.ButtonLabel
+	}
+
+	return defaultOIDCButtonLabel
+}
+
+// oidcClient returns the client for the identity provider. The provider is discovered the
+// first time it's needed, so the server can start while it's down. If that fails, it's
+// tried again the next time.
+func (s *Server) oidcClient(ctx context.Context) (*oidcClient, error) {
+	s.oidcMu.Lock()
+	defer s.oidcMu.Unlock()
+
+	if s.oidc != nil {
+		return s.oidc, nil
+	}
+
+	cfg := s.cfg.OIDC
+
+	sessionScopes := cfg.SessionScopes
+	if len(sessionScopes) == 0 {
+		sessionScopes = defaultOIDCSessionScopes
+	}
+	scopeStr, err := parseScopes(sessionScopes)
+	if err != nil {
+		return nil, fmt.Errorf("oidc session_scopes: %w", err)
+	}
+
+	redirectUrl := cfg.RedirectURL
+	if redirectUrl == "" {
+		if redirectUrl, err = url.JoinPath(s.cfg.BasePath, "/app/login/oidc/callback"); err != nil {
+			return nil, err
+		}
+	}
+
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultOIDCScopes
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, oidcDiscoverTime)
+	defer cancel()
+
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discover oidc provider %s: %w", cfg.Issuer, err)
+	}
+
+	s.oidc = &oidcClient{
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirectUrl,
+			Scopes:       scopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		scopes:   scopeStr,
+	}
+
+	return s.oidc, nil
+}
+
+// oidcUsername returns the user name a new user gets from the claims of an ID token.
+func (s *Server) oidcUsername(claims map[string]any) (string, error) {
+	claim := s.cfg.OIDC.UsernameClaim
+	if claim == "" {
+		claim = defaultOIDCUsernameClaim
+	}
+
+	name, _ := claims[claim].(string)
+	if name == "" {
+		return "", fmt.Errorf("the ID token has no %q claim", claim)
+	}
+
+	// Anyone could claim someone else's email if it wasn't checked.
+	if claim == "email" {
+		if verified, _ := claims["email_verified"].(bool); !verified {
+			return "", errors.New("the email in the ID token isn't verified")
+		}
+	}
+
+	return name, nil
+}
+
+// oidcIdentityUser returns the user an account at the identity provider is linked to.
+func (s *Server) oidcIdentityUser(ctx context.Context, issuer string, subject string) (string, bool, error) {
+	var user string
+	if err := s.db.GetContext(ctx, &user, `SELECT "user" FROM "oidc_identities" WHERE "issuer" = $1 AND "subject" = $2`, issuer, subject); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", false, nil
+		}
+
+		return "", false, err
+	}
+
+	return user, true, nil
+}
+
+// provisionOIDCUser creates a new user for an account at the identity provider and links
+// them. It returns ErrUserExists if there already is a user with the name, since claims
+// like the user name can often be changed by anyone at the identity provider.
+func (s *Server) provisionOIDCUser(ctx context.Context, name string, issuer string, subject string) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := createUser(ctx, tx, name); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO "oidc_identities" ("issuer", "subject", "user", "created_at") VALUES ($1, $2, $3, $4)`, issuer, subject, name, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// LinkOIDCIdentity lets the account with the subject (the sub claim) at the configured
+// identity provider log in as an existing user. An account can only be linked to one user,
+// so linking it again moves it.
+func (s *Server) LinkOIDCIdentity(ctx context.Context, user string, subject string) error {
+	if !s.oidcEnabled() {
+		return ErrOIDCNotEnabled
+	}
+
+	exists, err := s.userExists(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+
+	_, err = s.db.ExecContext(ctx, `INSERT INTO "oidc_identities" ("issuer", "subject", "user", "created_at") VALUES ($1, $2, $3, $4) ON CONFLICT ("issuer", "subject") DO UPDATE SET "user" = excluded."user", "created_at" = excluded."created_at"`, s.cfg.OIDC.Issuer, subject, user, time.Now().Unix())
+	return err
+}
+
+// UnlinkOIDCIdentities removes every identity provider account that's linked to a user,
+// and logs out the sessions they made. It returns how many were linked.
+func (s *Server) UnlinkOIDCIdentities(ctx context.Context, user string) (int64, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM "oidc_identities" WHERE "user" = $1`, user)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	// Sessions that weren't made with an API key were made by the identity provider.
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "sessions" WHERE "user" = $1 AND "key_id" = ''`, user); err != nil {
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
+
+// handleOIDCLogin sends someone to the identity provider to log in.
+func (s *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) error {
+	if !s.oidcEnabled() {
+		return PublicError{http.StatusNotFound, "Logging in with SSO isn't enabled."}
+	}
+
+	client, err := s.oidcClient(r.Context())
+	if err != nil {
+		log.Printf("Failed to set up OIDC login: %s", err)
+		return s.renderLoginPage(w, r, http.StatusBadGateway, "The identity provider can't be reached, try again later.")
+	}
+
+	state := secretString(oidcStateLength)
+	nonce := secretString(oidcStateLength)
+	verifier := oauth2.GenerateVerifier()
+
+	// The login can only be finished in the browser that started it.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    strings.Join([]string{state, nonce, verifier, s.sign("oidc", state, nonce, verifier)}, "."),
+		Path:     oidcCookiePath,
+		MaxAge:   oidcCookieAge,
+		HttpOnly: true,
+		Secure:   s.secureCookies(r),
+		SameSite: http.SameSiteLaxMode, // sent when the identity provider redirects back
+	})
+
+	http.Redirect(w, r, client.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+	return nil
+}
+
+// handleOIDCCallback finishes logging in after the identity provider sends someone back.
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) error {
+	if !s.oidcEnabled() {
+		return PublicError{http.StatusNotFound, "Logging in with SSO isn't enabled."}
+	}
+
+	var state, nonce, verifier string
+	if cook, err := r.Cookie(oidcCookieName); err == nil {
+		if parts := strings.Split(cook.Value, "."); len(parts) == 4 && s.verify(parts[3], "oidc", parts[0], parts[1], parts[2]) {
+			state, nonce, verifier = parts[0], parts[1], parts[2]
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    "",
+		Path:     oidcCookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := r.URL.Query()
+	if query.Get("error") != "" {
+		log.Printf("Identity provider refused OIDC login: %s %s", query.Get("error"), query.Get("error_description"))
+		return s.renderLoginPage(w, r, http.StatusUnauthorized, "The identity provider didn't log you in.")
+	}
+	if state == "" || query.Get("state") != state {
+		return s.renderLoginPage(w, r, http.StatusBadRequest, "The login has expired, try again.")
+	}
+
+	client, err := s.oidcClient(r.Context())
+	if err != nil {
+		log.Printf("Failed to set up OIDC login: %s", err)
+		return s.renderLoginPage(w, r, http.StatusBadGateway, "The identity provider can't be reached, try again later.")
+	}
+
+	token, err := client.oauth.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		log.Printf("Failed to exchange OIDC code: %s", err)
+		return s.renderLoginPage(w, r, http.StatusBadGateway, "The identity provider didn't log you in.")
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		log.Printf("Identity provider didn't return an ID token")
+		return s.renderLoginPage(w, r, http.StatusBadGateway, "The identity provider didn't log you in.")
+	}
+
+	idToken, err := client.verifier.Verify(r.Context(), rawIdToken)
+	if err != nil {
+		log.Printf("Invalid OIDC ID token: %s", err)
+		return s.renderLoginPage(w, r, http.StatusBadGateway, "The identity provider didn't log you in.")
+	}
+	if idToken.Nonce != nonce {
+		log.Printf("OIDC ID token has the wrong nonce")
+		return s.renderLoginPage(w, r, http.StatusBadRequest, "The login has expired, try again.")
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return err
+	}
+
+	// Accounts are matched by their subject, which the identity provider never gives to
+	// anyone else, instead of by claims that may be changed.
+	userName, linked, err := s.oidcIdentityUser(r.Context(), idToken.Issuer, idToken.Subject)
+	if err != nil {
+		return err
+	}
+	if !linked {
+		if !s.cfg.OIDC.AutoProvision {
+			log.Printf("OIDC subject %s isn't linked to a user", idToken.Subject)
+			return s.renderLoginPage(w, r, http.StatusForbidden, fmt.Sprintf("Your account isn't linked to a user here. Ask an admin to link your account (%s).", idToken.Subject))
+		}
+
+		if userName, err = s.oidcUsername(claims); err != nil {
+			log.Printf("Can't get the user name of OIDC subject %s: %s", idToken.Subject, err)
+			return s.renderLoginPage(w, r, http.StatusForbidden, "Your account can't be used here.")
+		}
+
+		if err := s.provisionOIDCUser(r.Context(), userName, idToken.Issuer, idToken.Subject); err != nil {
+			if errors.Is(err, ErrUserExists) {
+				log.Printf("OIDC subject %s wants the name of existing user %s", idToken.Subject, userName)
+				return s.renderLoginPage(w, r, http.StatusForbidden, fmt.Sprintf("There already is a user named %s. Ask an admin to link your account (%s).", userName, idToken.Subject))
+			}
+			if errors.Is(err, ErrInvalidUserName) {
+				return s.renderLoginPage(w, r, http.StatusForbidden, "Your account can't be used here.")
+			}
+
+			return err
+		}
+		log.Printf("Created user %s for OIDC subject %s.", userName, idToken.Subject)
+	}
+
+	// Sessions from the identity provider weren't made with an API key.
+	if err := s.createSession(w, r, userName, "", client.scopes, 0); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/app", http.StatusSeeOther)
+	return nil
+}
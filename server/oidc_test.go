@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"maps"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liondadev/quick-image-server/config"
+)
+
+const testOIDCClientID = "quick-image-server"
+
+// testIdP is an OpenID Connect identity provider that gives out ID tokens with whatever
+// claims a test asks for. Logging in at it is skipped, tests go to the callback with a
+// code from code right away.
+type testIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]map[string]any // code -> claims of the ID token it's exchanged for
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdP{key: key, codes: make(map[string]map[string]any)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, jMap{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, jMap{"keys": []jMap{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		claims, ok := idp.codes[r.PostFormValue("code")]
+		delete(idp.codes, r.PostFormValue("code"))
+		idp.mu.Unlock()
+
+		if !ok {
+			writeJson(w, http.StatusBadRequest, jMap{"error": "invalid_grant"})
+			return
+		}
+
+		writeJson(w, http.StatusOK, jMap{
+			"access_token": randomString(16),
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idp.sign(t, claims),
+		})
+	})
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+// code returns a code that's exchanged for an ID token with the claims, on top of the
+// ones every ID token has.
+func (idp *testIdP) code(claims map[string]any) string {
+	now := time.Now()
+	all := map[string]any{
+		"iss": idp.URL,
+		"aud": testOIDCClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	maps.Copy(all, claims)
+
+	code := randomString(16)
+	idp.mu.Lock()
+	idp.codes[code] = all
+	idp.mu.Unlock()
+
+	return code
+}
+
+// sign creates a JWT of the claims, signed with RS256.
+func (idp *testIdP) sign(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Error(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// newOIDCTestServer creates a server that logs people in with the identity provider,
+// creating users for them.
+func newOIDCTestServer(t *testing.T, idp *testIdP) *Server {
+	return newTestServer(t, func(cfg *config.Config) {
+		cfg.OIDC = config.OIDCConfig{Issuer: idp.URL, ClientID: testOIDCClientID, AutoProvision: true}
+	})
+}
+
+// startOIDCLogin starts logging in, returning the cookie the browser gets and the state
+// and nonce the identity provider is sent.
+func startOIDCLogin(t *testing.T, s *Server) (cookie *http.Cookie, state string, nonce string) {
+	t.Helper()
+
+	res := serve(s, httptest.NewRequest(http.MethodGet, "/app/login/oidc", nil))
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("start login: got status %d, want %d", res.StatusCode, http.StatusFound)
+	}
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookie = responseCookie(res, oidcCookieName)
+	if cookie == nil {
+		t.Fatal("start login didn't set a cookie")
+	}
+
+	return cookie, location.Query().Get("state"), location.Query().Get("nonce")
+}
+
+// finishOIDCLogin comes back from the identity provider with the query.
+func finishOIDCLogin(s *Server, cookie *http.Cookie, query url.Values) *http.Response {
+	r := httptest.NewRequest(http.MethodGet, "/app/login/oidc/callback?"+query.Encode(), nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+
+	return serve(s, r)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	s := newOIDCTestServer(t, idp)
+
+	cookie, state, nonce := startOIDCLogin(t, s)
+	code := idp.code(map[string]any{"sub": "alice-sub", "preferred_username": "alice", "nonce": nonce})
+
+	res := finishOIDCLogin(s, cookie, url.Values{"state": {state}, "code": {code}})
+	if res.StatusCode != http.StatusSeeOther {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusSeeOther)
+	}
+
+	session := responseCookie(res, sessionCookieName)
+	if session == nil {
+		t.Fatal("no session cookie was set")
+	}
+
+	sess, ok, err := s.authenticateSession(context.Background(), session.Value)
+	if err != nil || !ok {
+		t.Fatalf("authenticate session: %v %v", ok, err)
+	}
+	if sess.User != "alice" {
+		t.Errorf("logged in as %q, want alice", sess.User)
+	}
+	if scopesInclude(sess.Scopes, ScopeAdmin) {
+		t.Errorf("the session has the admin scope by default: %q", sess.Scopes)
+	}
+
+	// Without admin, they can still manage their own keys and sessions.
+	for _, page := range []string{"/app/keys", "/app/sessions"} {
+		r := httptest.NewRequest(http.MethodGet, page, nil)
+		r.AddCookie(session)
+		if res := serve(s, r); res.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %d, want %d", page, res.StatusCode, http.StatusOK)
+		}
+	}
+
+	createKey := func(scopes ...string) int {
+		r := newFormRequest("/app/keys", url.Values{"scope": scopes}, secretString(csrfTokenLength))
+		r.AddCookie(session)
+		return serve(s, r).StatusCode
+	}
+	if status := createKey(ScopeUpload, ScopeReadOwn); status != http.StatusOK {
+		t.Errorf("create a key: got status %d, want %d", status, http.StatusOK)
+	}
+	if status := createKey(ScopeAdmin); status != http.StatusForbidden {
+		t.Errorf("create an admin key: got status %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestOIDCWrongState(t *testing.T) {
+	idp := newTestIdP(t)
+	s := newOIDCTestServer(t, idp)
+
+	tests := []struct {
+		name       string
+		noCookie   bool
+		wrongState bool
+	}{
+		{name: "wrong state", wrongState: true},
+		{name: "no cookie", noCookie: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cookie, state, nonce := startOIDCLogin(t, s)
+			code := idp.code(map[string]any{"sub": "alice-sub", "preferred_username": "alice", "nonce": nonce})
+
+			if tt.wrongState {
+				state = secretString(oidcStateLength)
+			}
+			if tt.noCookie {
+				cookie = nil
+			}
+
+			res := finishOIDCLogin(s, cookie, url.Values{"state": {state}, "code": {code}})
+			if res.StatusCode != http.StatusBadRequest {
+				t.Errorf("got status %d, want %d", res.StatusCode, http.StatusBadRequest)
+			}
+			if responseCookie(res, sessionCookieName) != nil {
+				t.Error("a session cookie was set")
+			}
+		})
+	}
+}
+
+func TestOIDCWrongNonce(t *testing.T) {
+	idp := newTestIdP(t)
+	s := newOIDCTestServer(t, idp)
+
+	cookie, state, _ := startOIDCLogin(t, s)
+	// An ID token from another login, that an attacker could have gotten.
+	code := idp.code(map[string]any{"sub": "alice-sub", "preferred_username": "alice", "nonce": secretString(oidcStateLength)})
+
+	res := finishOIDCLogin(s, cookie, url.Values{"state": {state}, "code": {code}})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+	if responseCookie(res, sessionCookieName) != nil {
+		t.Error("a session cookie was set")
+	}
+
+	if exists, err := s.userExists(context.Background(), "alice"); err != nil || exists {
+		t.Errorf("a user was created: %v %v", exists, err)
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/liondadev/quick-image-server/types"
+)
+
+// contentETag returns a strong etag for the contents of an upload, or for one of its
+// derivatives if variant (like "thumbnail.png") isn't empty. Uploads from before
+// deduplication don't have a hash, so they don't get an etag.
+func contentETag(up types.Upload, variant string) string {
+	if up.Blob == "" {
+		return ""
+	}
+
+	if variant == "" {
+		return `"` + up.Blob + `"`
+	}
+
+	// Derivatives are generated from the original, so they only change when it does.
+	sum := sha256.Sum256([]byte(up.Blob + "\x00" + variant))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// serveContent serves the contents of an upload (or one of its derivatives), with
+// support for range requests and conditional requests using etag and the time it was
+// uploaded.
+func serveContent(w http.ResponseWriter, r *http.Request, up types.Upload, contentType string, etag string, content io.ReadSeeker) {
+	setCacheControlHeaders(w, up)
+	w.Header().Set("Content-Type", contentType)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	http.ServeContent(w, r, "", time.Unix(int64(up.Timestamp), 0), content)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/liondadev/quick-image-server/types"
+)
+
+func TestServeContent(t *testing.T) {
+	s := newTestServer(t, nil)
+	up := newTestUpload(t, s, "alice", "hello.txt", "text/plain", []byte("hello world"), uploadOptions{})
+	target := "/f/" + up.Id + up.Extension
+	etag := contentETag(up, "")
+	modified := time.Unix(int64(up.Timestamp), 0).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		status  int
+		body    string
+		range_  string // the Content-Range header
+	}{
+		{name: "everything", status: http.StatusOK, body: "hello world"},
+		{name: "range", headers: map[string]string{"Range": "bytes=6-10"}, status: http.StatusPartialContent, body: "world", range_: "bytes 6-10/11"},
+		{name: "suffix range", headers: map[string]string{"Range": "bytes=-5"}, status: http.StatusPartialContent, body: "world", range_: "bytes 6-10/11"},
+		{name: "unsatisfiable range", headers: map[string]string{"Range": "bytes=20-30"}, status: http.StatusRequestedRangeNotSatisfiable, range_: "bytes */11"},
+		{name: "matching etag", headers: map[string]string{"If-None-Match": etag}, status: http.StatusNotModified},
+		{name: "other etag", headers: map[string]string{"If-None-Match": `"other"`}, status: http.StatusOK, body: "hello world"},
+		{name: "not modified since", headers: map[string]string{"If-Modified-Since": modified}, status: http.StatusNotModified},
+		{name: "range if it didn't change", headers: map[string]string{"Range": "bytes=0-4", "If-Range": etag}, status: http.StatusPartialContent, body: "hello", range_: "bytes 0-4/11"},
+		{name: "range if it changed", headers: map[string]string{"Range": "bytes=0-4", "If-Range": `"other"`}, status: http.StatusOK, body: "hello world"},
+		{name: "head", method: http.MethodHead, status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			r := httptest.NewRequest(method, target, nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			res := serve(s, r)
+			body, _ := io.ReadAll(res.Body)
+			if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+				body = nil // net/http explains why, which we don't care about
+			}
+			if res.StatusCode != tt.status || string(body) != tt.body {
+				t.Errorf("got status %d and %q, want %d and %q", res.StatusCode, body, tt.status, tt.body)
+			}
+			if got := res.Header.Get("Content-Range"); got != tt.range_ {
+				t.Errorf("got Content-Range %q, want %q", got, tt.range_)
+			}
+			if tt.status != http.StatusRequestedRangeNotSatisfiable && res.Header.Get("ETag") != etag {
+				t.Errorf("got ETag %q, want %q", res.Header.Get("ETag"), etag)
+			}
+			if method == http.MethodHead && res.Header.Get("Content-Length") != "11" {
+				t.Errorf("got Content-Length %q, want 11", res.Header.Get("Content-Length"))
+			}
+		})
+	}
+}
+
+func TestThumbnailETag(t *testing.T) {
+	s := newTestServer(t, nil)
+	up := newTestUpload(t, s, "alice", "cat.png", "image/png", testPNG(t, 64, 48), uploadOptions{})
+	target := "/thumb/" + up.Id + up.Extension
+
+	res := serve(s, httptest.NewRequest(http.MethodGet, target, nil))
+	etag := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("got status %d and ETag %q", res.StatusCode, etag)
+	}
+	if etag == contentETag(up, "") {
+		t.Error("the thumbnail has the ETag of the original")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("If-None-Match", etag)
+	if res := serve(s, r); res.StatusCode != http.StatusNotModified {
+		t.Errorf("got status %d, want %d", res.StatusCode, http.StatusNotModified)
+	}
+}
+
+func TestContentETag(t *testing.T) {
+	up := types.Upload{Blob: "abc"}
+
+	if got := contentETag(up, ""); got != `"abc"` {
+		t.Errorf("original: got %s, want \"abc\"", got)
+	}
+	if a, b := contentETag(up, "thumbnail.png"), contentETag(up, "thumbnail.webp"); a == b || a == `"abc"` {
+		t.Errorf("derivatives got %s and %s, want different etags", a, b)
+	}
+	if other := contentETag(types.Upload{Blob: "def"}, "thumbnail.png"); other == contentETag(up, "thumbnail.png") {
+		t.Error("derivatives of other contents got the same etag")
+	}
+
+	// Uploads from before deduplication have nothing to base an etag on.
+	if got := contentETag(types.Upload{}, ""); got != "" {
+		t.Errorf("legacy upload: got %s, want no etag", got)
+	}
+}
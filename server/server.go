@@ -7,11 +7,15 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"runtime"
+	"sync"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/jmoiron/sqlx"
 	"github.com/liondadev/quick-image-server/config"
+	"github.com/liondadev/quick-image-server/server/migrations"
+	"github.com/liondadev/quick-image-server/server/storage"
 )
 
 //go:embed assets/*
@@ -60,59 +64,132 @@ func (h HandlerWithError) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type Server struct {
-	db  *sqlx.DB
-	cfg *config.Config
-	mux *chi.Mux
+	db    *sqlx.DB
+	cfg   *config.Config
+	mux   *chi.Mux
+	store storage.Backend
+
+	secret []byte // used to sign cookies and links
+
+	tusLocks sync.Map   // tus upload id -> *sync.Mutex
+	blobMu   sync.Mutex // held while taking or releasing blob references
+
+	transforms  *diskCache  // transformed images, grouped by upload id
+	derivatives *workerPool // generates thumbnails, bubbles and other derivatives
+
+	configMasks map[string]bubbleMask // bubble masks from the config, by name
+	maskCache   sync.Map              // blob hash -> *image.Alpha of masks uploaded by users
+
+	oidcMu sync.Mutex
+	oidc   *oidcClient // discovered the first time someone logs in with the identity provider
 }
 
-// New creates a new server instance from the config and database instance.
-func New(cfg *config.Config, db *sqlx.DB) *Server {
-	return &Server{
-		cfg: cfg,
-		db:  db,
+// New creates a new server instance from the config, database instance and the
+// storage backend files are kept in.
+func New(cfg *config.Config, db *sqlx.DB, store storage.Backend) *Server {
+	s := &Server{
+		cfg:    cfg,
+		db:     db,
+		store:  store,
+		secret: serverSecret(cfg.Secret),
+	}
+
+	workers := cfg.DerivativeWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	queue := cfg.DerivativeQueue
+	if queue <= 0 {
+		queue = defaultDerivativeQueue
+	}
+	s.derivatives = newWorkerPool(workers, queue)
+
+	cacheBytes := cfg.Transform.CacheMaxBytes
+	if cacheBytes <= 0 {
+		cacheBytes = defaultTransformCacheBytes
 	}
+	s.transforms = newDiskCache(s.transformCachePath(), cacheBytes)
+
+	return s
 }
 
 func (s *Server) SetupHTTP() error {
 	mux := chi.NewMux()
 
 	mux.Use(middleware.RealIP)
-	mux.Use(middleware.Compress(5))
 	mux.Use(middleware.Recoverer)
 	mux.Use(middleware.CleanPath)
-
-	// API Routes
-	mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication).Handle("POST /upload", HandlerWithError(s.handleFileUpload))
-	mux.With(s.preHandleAuthentication).Handle("GET /import-api", http.HandlerFunc(s.handleRunImport))
-	mux.Handle("GET /f/{file}", FrontendHandlerWithError(s.handleFileView))
-	mux.Handle("GET /bubble/{file}", FrontendHandlerWithError(s.handleBubbleView)) // view image as speech bubble gif
-	mux.Handle("GET /thumb/{file}", FrontendHandlerWithError(s.handleThumbnailView))
-	mux.Handle("GET /delete/{fileId}/{deleteToken}", HandlerWithError(s.handleDeleteFile))
-	mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication).Handle("POST /captive-upload", HandlerWithError(s.handleCaptiveUpload))
-
-	// Frontend Routes
-	mux.Handle("POST /", http.RedirectHandler("/app", http.StatusSeeOther))
-	mux.Handle("GET /", http.RedirectHandler("/app", http.StatusTemporaryRedirect))
-	mux.Handle("GET /app/login", FrontendHandlerWithError(s.handleLoginPage))
-	mux.Handle("POST /app/login", FrontendHandlerWithError(s.handlePostLoginPage))
-	mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication).Handle("GET /app", FrontendHandlerWithError(s.handleDashboardPage))
-	mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication).Handle("GET /app/uploads", FrontendHandlerWithError(s.handleUploadsPage))
-	mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication).Handle("GET /app/import", FrontendHandlerWithError(s.handleImportPage))
-
-	// Redirects favicon to /assets/favicon.ico
-	mux.Handle("GET /favicon.ico", HandlerWithError(func(w http.ResponseWriter, r *http.Request) error {
-		path, err := url.JoinPath(s.cfg.BasePath, "/assets/img/favicon.ico")
-		if err != nil {
-			return err
-		}
-		http.Redirect(w, r, path, http.StatusPermanentRedirect)
-
-		return nil
-	}))
-
-	// Static Assets
-	httpFs := http.FileServerFS(assetFs)
-	mux.Mount("/assets/", httpFs)
+	mux.Use(middleware.GetHead) // so clients can check the size of a file before downloading it
+	mux.Use(s.preHandleCSRF)
+
+	// File Routes - these aren't compressed, since that breaks range requests and etags.
+	mux.With(s.preHandleAuthentication).Handle("GET /f/{file}", FrontendHandlerWithError(s.handleFileView))
+	mux.With(s.preHandleAuthentication).Handle("GET /bubble/{file}", FrontendHandlerWithError(s.handleBubbleView)) // view image as speech bubble gif
+	mux.With(s.preHandleAuthentication).Handle("GET /thumb/{file}", FrontendHandlerWithError(s.handleThumbnailView))
+	mux.With(s.preHandleAuthentication).Handle("GET /thumb/{size}/{file}", FrontendHandlerWithError(s.handleThumbnailView))
+	mux.With(s.preHandleAuthentication).Handle("GET /caption/{file}", FrontendHandlerWithError(s.handleCaptionView)) // image with meme captions
+	mux.With(s.preHandleAuthentication).Handle("GET /i/{file}", FrontendHandlerWithError(s.handleTransformView))     // resized and converted images
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(middleware.Compress(5))
+
+		// API Routes
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeUpload)).Handle("POST /upload", HandlerWithError(s.handleFileUpload))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeImport)).Handle("GET /import-api", http.HandlerFunc(s.handleRunImport))
+		mux.Handle("POST /f/{file}", FrontendHandlerWithError(s.handleUnlockFile)) // unlock password protected files
+		mux.Handle("GET /delete/{fileId}/{deleteToken}", FrontendHandlerWithError(s.handleConfirmDelete))
+		mux.Handle("POST /delete/{fileId}/{deleteToken}", HandlerWithError(s.handleDeleteFile))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeUpload)).Handle("POST /captive-upload", HandlerWithError(s.handleCaptiveUpload))
+
+		// Resumable uploads (tus)
+		mux.With(s.preHandleTus).Handle("OPTIONS /tus", HandlerWithError(s.handleTusOptions))
+		mux.With(s.preHandleTus).With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeUpload)).Handle("POST /tus", HandlerWithError(s.handleTusCreate))
+		mux.With(s.preHandleTus).With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeUpload)).Handle("HEAD /tus/{uploadId}", HandlerWithError(s.handleTusHead))
+		mux.With(s.preHandleTus).With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeUpload)).Handle("PATCH /tus/{uploadId}", HandlerWithError(s.handleTusPatch))
+		mux.With(s.preHandleTus).With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeUpload)).Handle("DELETE /tus/{uploadId}", HandlerWithError(s.handleTusTerminate))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeUpload)).Handle("GET /tus/{uploadId}", HandlerWithError(s.handleTusStatus))
+
+		// Frontend Routes
+		mux.Handle("POST /", http.RedirectHandler("/app", http.StatusSeeOther))
+		mux.Handle("GET /", http.RedirectHandler("/app", http.StatusTemporaryRedirect))
+		mux.Handle("GET /app/login", FrontendHandlerWithError(s.handleLoginPage))
+		mux.Handle("POST /app/login", FrontendHandlerWithError(s.handlePostLoginPage))
+		mux.Handle("GET /app/login/oidc", FrontendHandlerWithError(s.handleOIDCLogin))
+		mux.Handle("GET /app/login/oidc/callback", FrontendHandlerWithError(s.handleOIDCCallback))
+		mux.Handle("GET /app/logout", FrontendHandlerWithError(s.handleLogout))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeReadOwn)).Handle("GET /app", FrontendHandlerWithError(s.handleDashboardPage))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeReadOwn)).Handle("GET /app/uploads", FrontendHandlerWithError(s.handleUploadsPage))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeImport)).Handle("GET /app/import", FrontendHandlerWithError(s.handleImportPage))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeUpload)).Handle("POST /app/uploads/{fileId}/password", HandlerWithError(s.handleSetFilePassword))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeUpload)).Handle("POST /app/uploads/{fileId}/visibility", HandlerWithError(s.handleSetFileVisibility))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeReadOwn)).Handle("POST /app/uploads/{fileId}/share", HandlerWithError(s.handleCreateShareLink))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeReadOwn)).Handle("POST /app/uploads/{fileId}/transform", HandlerWithError(s.handleSignTransform))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeReadOwn)).Handle("POST /app/uploads/{fileId}/caption", HandlerWithError(s.handleSignCaption))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeReadOwn)).Handle("GET /app/masks", HandlerWithError(s.handleListMasks))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeUpload)).Handle("POST /app/masks", HandlerWithError(s.handleUploadMask))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication(ScopeDeleteOwn)).Handle("DELETE /app/masks/{name}", HandlerWithError(s.handleDeleteMask))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication("")).Handle("GET /app/keys", FrontendHandlerWithError(s.handleKeysPage))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication("")).Handle("POST /app/keys", FrontendHandlerWithError(s.handleCreateKey))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication("")).Handle("POST /app/keys/{keyId}/label", FrontendHandlerWithError(s.handleLabelKey))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication("")).Handle("POST /app/keys/{keyId}/revoke", FrontendHandlerWithError(s.handleRevokeKey))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication("")).Handle("GET /app/sessions", FrontendHandlerWithError(s.handleSessionsPage))
+		mux.With(s.preHandleAuthentication).With(s.preHandleRequireAuthentication("")).Handle("POST /app/sessions/{sessionId}/revoke", FrontendHandlerWithError(s.handleRevokeSession))
+
+		// Redirects favicon to /assets/favicon.ico
+		mux.Handle("GET /favicon.ico", HandlerWithError(func(w http.ResponseWriter, r *http.Request) error {
+			path, err := url.JoinPath(s.cfg.BasePath, "/assets/img/favicon.ico")
+			if err != nil {
+				return err
+			}
+			http.Redirect(w, r, path, http.StatusPermanentRedirect)
+
+			return nil
+		}))
+
+		// Static Assets
+		httpFs := http.FileServerFS(assetFs)
+		mux.Mount("/assets/", httpFs)
+	})
 
 	// Not found handler
 	mux.NotFound(FrontendHandlerWithError(s.handleNotFound).ServeHTTP)
@@ -140,13 +217,8 @@ func (s *Server) Run(addr string) error {
 	return http.ListenAndServe(addr, s.mux)
 }
 
-// ApplyMigrations creates all the SQL tables and stuff needed for the service to work.
+// ApplyMigrations brings the database schema up to date by applying every migration
+// that hasn't been applied yet.
 func (s *Server) ApplyMigrations() error {
-	// 001 - create database
-	stmt := `CREATE TABLE IF NOT EXISTS "uploads" ("id" TEXT PRIMARY KEY, "mime" TEXT, "user" TEXT, "uploaded_at" INTEGER, "uploaded_as" TEXT, "delete_token" TEXT, "ext" TEXT)`
-	if _, err := s.db.Exec(stmt); err != nil {
-		return fmt.Errorf("create initial schema: %w", err)
-	}
-
-	return nil
+	return migrations.Migrate(s.db, migrations.Latest(), log.Printf)
 }
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/jmoiron/sqlx"
+	"github.com/liondadev/quick-image-server/config"
+	"github.com/liondadev/quick-image-server/server/storage"
+	"github.com/liondadev/quick-image-server/types"
+)
+
+// newTestServer creates a server with an empty database and storage in a temporary
+// directory. configure can change the config before the server is created.
+func newTestServer(t *testing.T, configure func(cfg *config.Config)) *Server {
+	t.Helper()
+	dir := t.TempDir()
+
+	cfg := config.New()
+	cfg.DatabasePath = filepath.Join(dir, "database.db")
+	cfg.FSPath = filepath.Join(dir, "store")
+	cfg.TusPath = filepath.Join(dir, "tus")
+	cfg.Transform.CachePath = filepath.Join(dir, "transform")
+	cfg.BasePath = "http://qis.test"
+	cfg.Secret = "test secret"
+	if configure != nil {
+		configure(cfg)
+	}
+
+	db, err := sqlx.Open("sqlite", cfg.DatabasePath)
+	if err != nil {
+		t.Fatalf("open database: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store, err := storage.NewLocal(cfg.FSPath)
+	if err != nil {
+		t.Fatalf("create storage: %s", err)
+	}
+
+	s := New(cfg, db, store)
+	if err := s.ApplyMigrations(); err != nil {
+		t.Fatalf("apply migrations: %s", err)
+	}
+	if err := s.SetupHTTP(); err != nil {
+		t.Fatalf("setup http: %s", err)
+	}
+
+	return s
+}
+
+// newTestKey creates a user and an API key for them with the scopes, which expires at
+// expiresAt unless it's zero.
+func newTestKey(t *testing.T, s *Server, user string, scopes []string, expiresAt time.Time) (string, types.APIKey) {
+	t.Helper()
+
+	if err := s.CreateUser(context.Background(), user); err != nil {
+		t.Fatalf("create user: %s", err)
+	}
+
+	key, k, err := s.CreateAPIKey(context.Background(), user, "test", scopes, expiresAt)
+	if err != nil {
+		t.Fatalf("create api key: %s", err)
+	}
+
+	return key, k
+}
+
+// newTestUpload stores data as an upload of user with the options.
+func newTestUpload(t *testing.T, s *Server, user string, name string, mimeType string, data []byte, opts uploadOptions) types.Upload {
+	t.Helper()
+
+	if opts.Visibility == "" {
+		opts.Visibility = types.VisibilityPublic
+	}
+
+	up, _, err := s.storeUpload(context.Background(), user, name, mimeType, bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatalf("store upload: %s", err)
+	}
+
+	return up
+}
+
+// serve sends a request through every route and middleware of the server.
+func serve(s *Server, r *http.Request) *http.Response {
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, r)
+	return rec.Result()
+}
+
+// newFormRequest creates a POST request with a form, and the CSRF token both in the form
+// and the cookie unless it's empty.
+func newFormRequest(target string, form url.Values, csrfToken string) *http.Request {
+	if csrfToken != "" {
+		form.Set(csrfFieldName, csrfToken)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if csrfToken != "" {
+		r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: csrfToken})
+	}
+
+	return r
+}
+
+// responseCookie returns the cookie with the name a response sets, or nil if it doesn't
+// set one or only clears it.
+func responseCookie(res *http.Response, name string) *http.Cookie {
+	for _, c := range res.Cookies() {
+		if c.Name == name && c.Value != "" && c.MaxAge >= 0 {
+			return c
+		}
+	}
+
+	return nil
+}
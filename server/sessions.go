@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/liondadev/quick-image-server/server/pages"
+	"github.com/liondadev/quick-image-server/types"
+)
+
+const (
+	sessionCookieName     = "qis_session"
+	sessionTokenLength    = 48
+	sessionIdLength       = 12
+	maxSessionAgentLength = 256
+
+	defaultSessionIdleHours = 24 * 7
+	defaultSessionMaxHours  = 24 * 30
+)
+
+// sessionTimeouts returns how long a session can go unused, and how long it can last at most.
+func (s *Server) sessionTimeouts() (idle time.Duration, max time.Duration) {
+	idleHours := s.cfg.SessionIdleHours
+	if idleHours <= 0 {
+		idleHours = defaultSessionIdleHours
+	}
+
+	maxHours := s.cfg.SessionMaxHours
+	if maxHours <= 0 {
+		maxHours = defaultSessionMaxHours
+	}
+
+	return time.Duration(idleHours) * time.Hour, time.Duration(maxHours) * time.Hour
+}
+
+// sessionExpired checks if a session has gone unused for too long, is too old, or the
+// key it was made with has expired.
+func (s *Server) sessionExpired(sess types.Session, now time.Time) bool {
+	idle, max := s.sessionTimeouts()
+
+	if sess.ExpiresAt != 0 && sess.ExpiresAt <= uint64(now.Unix()) {
+		return true
+	}
+
+	return now.After(time.Unix(int64(sess.LastSeenAt), 0).Add(idle)) || now.After(time.Unix(int64(sess.CreatedAt), 0).Add(max))
+}
+
+// secureCookies checks if cookies should only be sent over https.
+func (s *Server) secureCookies(r *http.Request) bool {
+	return r.TLS != nil || strings.HasPrefix(s.cfg.BasePath, "https://")
+}
+
+// createSession logs a user into the dashboard with the scopes they get, by giving them a
+// session cookie. The session ends at expiresAt (a unix timestamp) unless it's 0, which is
+// how sessions made with a key don't outlive it.
+func (s *Server) createSession(w http.ResponseWriter, r *http.Request, user string, keyId string, scopes string, expiresAt uint64) error {
+	token := secretString(sessionTokenLength)
+	now := time.Now()
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr // RealIP leaves just the address
+	}
+
+	agent := r.UserAgent()
+	if len(agent) > maxSessionAgentLength {
+		agent = agent[:maxSessionAgentLength]
+	}
+
+	if _, err := s.db.ExecContext(r.Context(), `INSERT INTO "sessions" ("id", "hash", "user", "key_id", "scopes", "created_at", "last_seen_at", "user_agent", "ip", "expires_at") VALUES ($1, $2, $3, $4, $5, $6, $6, $7, $8, $9)`, randomString(sessionIdLength), hashToken(token), user, keyId, scopes, now.Unix(), agent, ip, expiresAt); err != nil {
+		return err
+	}
+
+	_, max := s.sessionTimeouts()
+	cookieExpires := now.Add(max)
+	if expiresAt != 0 && time.Unix(int64(expiresAt), 0).Before(cookieExpires) {
+		cookieExpires = time.Unix(int64(expiresAt), 0)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  cookieExpires,
+		HttpOnly: true,
+		Secure:   s.secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+// authenticateSession finds the session with the token from a session cookie. It returns
+// false if there's no such session, or if it has expired.
+func (s *Server) authenticateSession(ctx context.Context, token string) (types.Session, bool, error) {
+	if token == "" {
+		return types.Session{}, false, nil
+	}
+
+	// Session tokens are long and random, so looking them up by their hash doesn't give
+	// anything away.
+	var sess types.Session
+	if err := s.db.GetContext(ctx, &sess, `SELECT * FROM "sessions" WHERE "hash" = $1`, hashToken(token)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.Session{}, false, nil
+		}
+
+		return types.Session{}, false, err
+	}
+
+	now := time.Now()
+	if s.sessionExpired(sess, now) {
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM "sessions" WHERE "id" = $1`, sess.Id); err != nil {
+			return types.Session{}, false, err
+		}
+
+		return types.Session{}, false, nil
+	}
+
+	if now.Sub(time.Unix(int64(sess.LastSeenAt), 0)) > lastUsedInterval {
+		if _, err := s.db.ExecContext(ctx, `UPDATE "sessions" SET "last_seen_at" = $1 WHERE "id" = $2`, now.Unix(), sess.Id); err != nil {
+			return types.Session{}, false, err
+		}
+		sess.LastSeenAt = uint64(now.Unix())
+	}
+
+	return sess, true, nil
+}
+
+// reapExpiredSessions deletes every session that has expired.
+func (s *Server) reapExpiredSessions(ctx context.Context) error {
+	idle, max := s.sessionTimeouts()
+	now := time.Now()
+
+	_, err := s.db.ExecContext(ctx, `DELETE FROM "sessions" WHERE "last_seen_at" <= $1 OR "created_at" <= $2 OR ("expires_at" != 0 AND "expires_at" <= $3)`, now.Add(-idle).Unix(), now.Add(-max).Unix(), now.Unix())
+	return err
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	if cook, err := r.Cookie(sessionCookieName); err == nil {
+		if _, err := s.db.ExecContext(r.Context(), `DELETE FROM "sessions" WHERE "hash" = $1`, hashToken(cook.Value)); err != nil {
+			return err
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, "/app/login", http.StatusSeeOther)
+	return nil
+}
+
+func (s *Server) handleSessionsPage(w http.ResponseWriter, r *http.Request) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	var sessions []types.Session
+	if err := s.db.SelectContext(r.Context(), &sessions, `SELECT * FROM "sessions" WHERE "user" = $1 ORDER BY "last_seen_at" DESC`, userName); err != nil {
+		return err
+	}
+
+	// Expired sessions might not have been reaped yet.
+	now := time.Now()
+	active := sessions[:0]
+	for _, sess := range sessions {
+		if !s.sessionExpired(sess, now) {
+			active = append(active, sess)
+		}
+	}
+
+	current, _ := r.Context().Value(AuthenticatedSessionContextKey).(types.Session)
+
+	return writeHTML(w, r, http.StatusOK, pages.Sessions(userName, active, current.Id))
+}
+
+func (s *Server) handleRevokeSession(w http.ResponseWriter, r *http.Request) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	res, err := s.db.ExecContext(r.Context(), `DELETE FROM "sessions" WHERE "user" = $1 AND "id" = $2`, userName, chi.URLParam(r, "sessionId"))
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return PublicError{http.StatusNotFound, "Session not found."}
+	}
+
+	http.Redirect(w, r, "/app/sessions", http.StatusSeeOther)
+	return nil
+}
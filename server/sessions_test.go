@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionEndsWithItsKey(t *testing.T) {
+	s := newTestServer(t, nil)
+	keyExpiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	key, k := newTestKey(t, s, "alice", []string{ScopeReadOwn}, keyExpiry)
+
+	res := serve(s, newFormRequest("/app/login", url.Values{"api_key": {key}}, strings.Repeat("a", csrfTokenLength)))
+	if res.StatusCode != http.StatusSeeOther {
+		t.Fatalf("login: got status %d, want %d", res.StatusCode, http.StatusSeeOther)
+	}
+
+	cookie := responseCookie(res, sessionCookieName)
+	if cookie == nil {
+		t.Fatal("login didn't set a session cookie")
+	}
+	if cookie.Expires.After(keyExpiry) {
+		t.Errorf("the session cookie expires at %s, after the key at %s", cookie.Expires, keyExpiry)
+	}
+
+	dashboard := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/app", nil)
+		r.AddCookie(cookie)
+		return serve(s, r).StatusCode
+	}
+
+	if status := dashboard(); status != http.StatusOK {
+		t.Fatalf("dashboard: got status %d, want %d", status, http.StatusOK)
+	}
+
+	sess, ok, err := s.authenticateSession(context.Background(), cookie.Value)
+	if err != nil || !ok {
+		t.Fatalf("authenticate session: %v %v", ok, err)
+	}
+	if sess.ExpiresAt != k.ExpiresAt {
+		t.Errorf("the session expires at %d, want the expiry of its key %d", sess.ExpiresAt, k.ExpiresAt)
+	}
+	if s.sessionExpired(sess, keyExpiry.Add(-time.Second)) {
+		t.Error("the session expired before its key")
+	}
+	if !s.sessionExpired(sess, keyExpiry) {
+		t.Error("the session outlived its key")
+	}
+
+	// Pretend the hour has passed, the session has a copy of when the key expires.
+	past := time.Now().Add(-time.Second).Unix()
+	if _, err := s.db.Exec(`UPDATE "api_keys" SET "expires_at" = $1 WHERE "id" = $2`, past, k.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec(`UPDATE "sessions" SET "expires_at" = $1 WHERE "id" = $2`, past, sess.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := dashboard(); status != http.StatusTemporaryRedirect {
+		t.Fatalf("dashboard after the key expired: got status %d, want a redirect to the login page", status)
+	}
+
+	var left int
+	if err := s.db.Get(&left, `SELECT COUNT(*) FROM "sessions" WHERE "id" = $1`, sess.Id); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Error("the expired session wasn't deleted")
+	}
+}
+
+// login logs in with the API key, returning the session cookie.
+func login(t *testing.T, s *Server, key string) *http.Cookie {
+	t.Helper()
+
+	res := serve(s, newFormRequest("/app/login", url.Values{"api_key": {key}}, strings.Repeat("a", csrfTokenLength)))
+	cookie := responseCookie(res, sessionCookieName)
+	if res.StatusCode != http.StatusSeeOther || cookie == nil {
+		t.Fatalf("login: got status %d and cookie %v", res.StatusCode, cookie)
+	}
+
+	return cookie
+}
+
+func TestSessionsWithoutAdmin(t *testing.T) {
+	s := newTestServer(t, nil)
+	aliceKey, _ := newTestKey(t, s, "alice", []string{ScopeReadOwn}, time.Time{})
+	bobKey, _ := newTestKey(t, s, "bob", []string{ScopeAdmin}, time.Time{})
+
+	current := login(t, s, aliceKey)
+	other := login(t, s, aliceKey)
+	bobs := login(t, s, bobKey)
+
+	sessionId := func(cookie *http.Cookie) string {
+		sess, ok, err := s.authenticateSession(context.Background(), cookie.Value)
+		if err != nil || !ok {
+			t.Fatalf("authenticate session: %v %v", ok, err)
+		}
+		return sess.Id
+	}
+	otherId, bobsId := sessionId(other), sessionId(bobs)
+
+	r := httptest.NewRequest(http.MethodGet, "/app/sessions", nil)
+	r.AddCookie(current)
+	if res := serve(s, r); res.StatusCode != http.StatusOK {
+		t.Fatalf("sessions page: got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	revoke := func(id string) int {
+		csrf := strings.Repeat("a", csrfTokenLength)
+		r := newFormRequest("/app/sessions/"+id+"/revoke", url.Values{}, csrf)
+		r.AddCookie(current)
+		return serve(s, r).StatusCode
+	}
+
+	if status := revoke(bobsId); status != http.StatusNotFound {
+		t.Errorf("revoke a session of someone else: got status %d, want %d", status, http.StatusNotFound)
+	}
+	if _, ok, err := s.authenticateSession(context.Background(), bobs.Value); err != nil || !ok {
+		t.Errorf("the session of bob was revoked: %v %v", ok, err)
+	}
+
+	if status := revoke(otherId); status != http.StatusSeeOther {
+		t.Errorf("revoke another session: got status %d, want %d", status, http.StatusSeeOther)
+	}
+	if _, ok, err := s.authenticateSession(context.Background(), other.Value); err != nil || ok {
+		t.Errorf("the other session still works: %v %v", ok, err)
+	}
+}
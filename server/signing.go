@@ -0,0 +1,40 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"strings"
+)
+
+// serverSecret returns the key used to sign cookies and links. If the config doesn't
+// have one, a random key is used, which means everything signed stops working when
+// the server restarts.
+func serverSecret(configured string) []byte {
+	if configured != "" {
+		return []byte(configured)
+	}
+
+	log.Println("No 'secret' in the config, using a random one. Signed cookies and links won't survive a restart.")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+
+	return key
+}
+
+// sign creates a signature of the parts with the server secret.
+func (s *Server) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks if sig is a valid signature of the parts, in constant time.
+func (s *Server) verify(sig string, parts ...string) bool {
+	return hmac.Equal([]byte(sig), []byte(s.sign(parts...)))
+}
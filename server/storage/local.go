@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Local stores objects as files in a directory on the local file system.
+type Local struct {
+	root string
+}
+
+// NewLocal creates a local backend that stores objects in root, creating
+// the directory if it doesn't exist yet.
+func NewLocal(root string) (*Local, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("create storage directory: %w", err)
+	}
+
+	return &Local{root: root}, nil
+}
+
+// path turns an object name into a path on disk, making sure it can't
+// escape the root directory.
+func (l *Local) path(name string) (string, error) {
+	clean := filepath.Clean("/" + filepath.FromSlash(name))
+	if clean == string(filepath.Separator) {
+		return "", fmt.Errorf("invalid object name '%s'", name)
+	}
+
+	return filepath.Join(l.root, clean), nil
+}
+
+func (l *Local) Put(ctx context.Context, name string, r io.Reader) (int64, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return 0, err
+	}
+
+	// Write to a temporary file next to it first and rename it into place, so nobody
+	// can read a half written file and two writers can't mix their contents.
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-"+filepath.Base(p)+"-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name()) // does nothing once it's been renamed
+	defer f.Close()
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return n, err
+	}
+
+	if err := f.Chmod(0o644); err != nil {
+		return n, err
+	}
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+
+	return n, os.Rename(f.Name(), p)
+}
+
+func (l *Local) Get(ctx context.Context, name string) (Object, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotExist
+		}
+
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (l *Local) Stat(ctx context.Context, name string) (Info, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return Info{}, err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return Info{}, ErrNotExist
+		}
+
+		return Info{}, err
+	}
+
+	return Info{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (l *Local) Delete(ctx context.Context, name string) error {
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrNotExist
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string, fn func(Info) error) error {
+	// Only the folder the prefix is in has to be walked, instead of everything.
+	start := l.root
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		dir, err := l.path(prefix[:i])
+		if err != nil {
+			return err
+		}
+		start = dir
+	}
+
+	return filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == start && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		return fn(Info{Name: name, Size: fi.Size(), ModTime: fi.ModTime()})
+	})
+}
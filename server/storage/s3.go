@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/liondadev/quick-image-server/config"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Presigner is implemented by backends that can give clients a temporary URL
+// to download an object from directly, instead of going through us.
+type Presigner interface {
+	// PresignGet returns a URL that's valid for expiry. The params are extra
+	// query parameters, like response-content-type.
+	PresignGet(ctx context.Context, name string, expiry time.Duration, params url.Values) (*url.URL, error)
+}
+
+// S3 stores objects in a bucket of an S3 compatible object storage, like
+// AWS S3 or MinIO.
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 connects to the object storage described by cfg. The bucket is created
+// if it doesn't exist yet, which is mostly useful for local MinIO instances.
+func NewS3(ctx context.Context, cfg config.S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("the s3 storage backend needs an 'endpoint' and a 'bucket'")
+	}
+
+	lookup := minio.BucketLookupAuto
+	if cfg.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure:       cfg.UseSSL,
+		Region:       cfg.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create s3 client: %w", err)
+	}
+
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("check bucket: %w", err)
+	}
+
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, fmt.Errorf("create bucket: %w", err)
+		}
+	}
+
+	return &S3{
+		client: client,
+		bucket: cfg.Bucket,
+		prefix: strings.Trim(cfg.Prefix, "/"),
+	}, nil
+}
+
+// key turns an object name into the key it's stored under in the bucket.
+func (b *S3) key(name string) string {
+	return strings.TrimPrefix(path.Join(b.prefix, path.Clean("/"+name)), "/")
+}
+
+// isNotFound checks if err is the object storage telling us an object doesn't exist.
+func isNotFound(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.StatusCode == http.StatusNotFound || resp.Code == "NoSuchKey"
+}
+
+// s3PartSize is the size of the parts uploads of unknown size are split into. minio-go
+// buffers a whole part in memory, and its default is big enough to fit the largest
+// object S3 allows, which is over half a gigabyte per upload.
+const s3PartSize = 16 << 20
+
+func (b *S3) Put(ctx context.Context, name string, r io.Reader) (int64, error) {
+	opts := minio.PutObjectOptions{
+		// Streaming signatures aren't understood by a lot of S3 stand-ins, and the
+		// payload is still protected by TLS when it's enabled.
+		DisableContentSha256: true,
+	}
+
+	size, err := remainingSize(r)
+	if err != nil {
+		return 0, err
+	}
+	if size < 0 {
+		opts.PartSize = s3PartSize
+	}
+
+	info, err := b.client.PutObject(ctx, b.bucket, b.key(name), r, size, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size, nil
+}
+
+// remainingSize returns how many bytes are left to read from r if it can be seeked, or
+// -1 if it can't.
+func remainingSize(r io.Reader) (int64, error) {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return -1, nil
+	}
+
+	offset, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return end - offset, nil
+}
+
+func (b *S3) Get(ctx context.Context, name string) (Object, error) {
+	obj, err := b.client.GetObject(ctx, b.bucket, b.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// GetObject is lazy, so we have to stat the object to know if it exists.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if isNotFound(err) {
+			return nil, ErrNotExist
+		}
+
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+func (b *S3) Stat(ctx context.Context, name string) (Info, error) {
+	oi, err := b.client.StatObject(ctx, b.bucket, b.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return Info{}, ErrNotExist
+		}
+
+		return Info{}, err
+	}
+
+	return Info{Name: name, Size: oi.Size, ModTime: oi.LastModified}, nil
+}
+
+func (b *S3) Delete(ctx context.Context, name string) error {
+	// Removing an object that doesn't exist isn't an error for S3, but it is for us.
+	if _, err := b.Stat(ctx, name); err != nil {
+		return err
+	}
+
+	return b.client.RemoveObject(ctx, b.bucket, b.key(name), minio.RemoveObjectOptions{})
+}
+
+func (b *S3) List(ctx context.Context, prefix string, fn func(Info) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops the listing goroutine if we return early
+
+	keyPrefix := b.prefix
+	if keyPrefix != "" {
+		keyPrefix += "/"
+	}
+
+	for oi := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: keyPrefix + prefix, Recursive: true}) {
+		if oi.Err != nil {
+			return oi.Err
+		}
+
+		if err := fn(Info{Name: strings.TrimPrefix(oi.Key, keyPrefix), Size: oi.Size, ModTime: oi.LastModified}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *S3) PresignGet(ctx context.Context, name string, expiry time.Duration, params url.Values) (*url.URL, error) {
+	return b.client.PresignedGetObject(ctx, b.bucket, b.key(name), expiry, params)
+}
@@ -0,0 +1,63 @@
+// Package storage contains the backends that uploaded files and their derivatives
+// (thumbnails, bubbles, ...) are stored in.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/liondadev/quick-image-server/config"
+)
+
+// ErrNotExist is returned when an object doesn't exist in the backend.
+var ErrNotExist = errors.New("object does not exist")
+
+// Info describes a single object stored in a backend.
+type Info struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Object is a stored object that's been opened for reading. It can be seeked so
+// it can be served with range requests.
+type Object interface {
+	io.ReadSeekCloser
+}
+
+// Backend is somewhere we can store objects. Object names are flat, slash
+// separated keys like "abc.png" or "abc.thumbnail.png".
+type Backend interface {
+	// Put stores everything read from r as the object name, overwriting it if
+	// it already exists. It returns the amount of bytes written.
+	Put(ctx context.Context, name string, r io.Reader) (int64, error)
+	// Get opens the object name for reading. The caller must close it.
+	Get(ctx context.Context, name string) (Object, error)
+	// Stat returns information about the object name.
+	Stat(ctx context.Context, name string) (Info, error)
+	// Delete removes the object name. It returns ErrNotExist if the object
+	// doesn't exist.
+	Delete(ctx context.Context, name string) error
+	// List calls fn for every object whose name starts with prefix. If fn
+	// returns an error, listing stops and the error is returned.
+	List(ctx context.Context, prefix string, fn func(Info) error) error
+}
+
+// FromConfig creates the backend selected by the config.
+func FromConfig(cfg *config.Config) (Backend, error) {
+	switch cfg.StorageBackend {
+	case "", "local":
+		if cfg.FSPath == "" {
+			return nil, errors.New("the local storage backend needs a 'storage_path'")
+		}
+
+		return NewLocal(cfg.FSPath)
+	case "s3":
+		return NewS3(context.Background(), cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend '%s'", cfg.StorageBackend)
+	}
+}
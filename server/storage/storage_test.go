@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/liondadev/quick-image-server/config"
+)
+
+// fakeS3 is just enough of the S3 API for the S3 backend: a single bucket with path
+// style urls, that stores objects in memory and doesn't check signatures.
+type fakeS3 struct {
+	*httptest.Server
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	parts   map[string]map[int][]byte // upload id -> part number -> contents
+	puts    []fakePut
+}
+
+// fakeModTime is when every object of the fake was last modified.
+var fakeModTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// fakePut is an object being put, all at once or as part of a multipart upload.
+type fakePut struct {
+	key           string
+	contentLength int64
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := &fakeS3{bucket: "test", objects: make(map[string][]byte), parts: make(map[string]map[int][]byte)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+// backend creates an S3 backend for the fake.
+func (f *fakeS3) backend(t *testing.T, prefix string) *S3 {
+	t.Helper()
+
+	b, err := NewS3(context.Background(), config.S3Config{
+		Endpoint:  strings.TrimPrefix(f.URL, "http://"),
+		Bucket:    f.bucket,
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Prefix:    prefix,
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatalf("create s3 backend: %s", err)
+	}
+
+	return b
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	q := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+	case key == "" && r.Method == http.MethodGet && q.Get("list-type") == "2":
+		f.list(w, q.Get("prefix"))
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		id := strconv.Itoa(len(f.parts) + 1)
+		f.parts[id] = make(map[int][]byte)
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && q.Has("partNumber"):
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		data, _ := io.ReadAll(r.Body)
+		f.parts[q.Get("uploadId")][n] = data
+		f.puts = append(f.puts, fakePut{key: key, contentLength: r.ContentLength})
+		w.Header().Set("ETag", `"`+strconv.Itoa(n)+`"`)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		parts := f.parts[q.Get("uploadId")]
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		slices.Sort(numbers)
+
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+		}
+		f.objects[key] = data
+		delete(f.parts, q.Get("uploadId"))
+
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: `"complete"`})
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.parts, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = data
+		f.puts = append(f.puts, fakePut{key: key, contentLength: r.ContentLength})
+		w.Header().Set("ETag", `"object"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		w.Header().Set("ETag", `"object"`)
+		http.ServeContent(w, r, key, fakeModTime, bytes.NewReader(data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		Size         int64
+		LastModified string
+		ETag         string
+	}
+
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: f.bucket, Prefix: prefix}
+
+	for key, data := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{Key: key, Size: int64(len(data)), LastModified: fakeModTime.Format(time.RFC3339), ETag: `"object"`})
+		}
+	}
+	slices.SortFunc(result.Contents, func(a, b content) int { return strings.Compare(a.Key, b.Key) })
+	result.KeyCount = len(result.Contents)
+
+	writeXML(w, result)
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+	}{Code: code})
+}
+
+// testBackend runs the things every backend has to do right against b.
+func testBackend(t *testing.T, b Backend) {
+	ctx := context.Background()
+
+	if _, err := b.Get(ctx, "missing.png"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("get missing: got %v, want ErrNotExist", err)
+	}
+	if _, err := b.Stat(ctx, "missing.png"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("stat missing: got %v, want ErrNotExist", err)
+	}
+	if err := b.Delete(ctx, "missing.png"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("delete missing: got %v, want ErrNotExist", err)
+	}
+
+	objects := map[string]string{
+		"a.png":                "first",
+		"blobs/ab/abcdef":      "second object",
+		"blobs/ab/abcdef.webp": "third",
+		"blobs/cd/cdef":        "fourth",
+	}
+	for name, contents := range objects {
+		n, err := b.Put(ctx, name, strings.NewReader(contents))
+		if err != nil {
+			t.Fatalf("put %s: %s", name, err)
+		}
+		if n != int64(len(contents)) {
+			t.Errorf("put %s: wrote %d bytes, want %d", name, n, len(contents))
+		}
+	}
+
+	// Putting an object again replaces it.
+	if _, err := b.Put(ctx, "a.png", strings.NewReader("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	objects["a.png"] = "replaced"
+
+	for name, contents := range objects {
+		info, err := b.Stat(ctx, name)
+		if err != nil {
+			t.Fatalf("stat %s: %s", name, err)
+		}
+		if info.Name != name || info.Size != int64(len(contents)) {
+			t.Errorf("stat %s: got %+v, want a size of %d", name, info, len(contents))
+		}
+	}
+
+	obj, err := b.Get(ctx, "blobs/ab/abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.Seek(7, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil || string(rest) != "object" {
+		t.Errorf("read after seeking: got %q %v, want \"object\"", rest, err)
+	}
+
+	var listed []string
+	if err := b.List(ctx, "blobs/ab/", func(info Info) error {
+		listed = append(listed, info.Name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(listed)
+	if want := []string{"blobs/ab/abcdef", "blobs/ab/abcdef.webp"}; !slices.Equal(listed, want) {
+		t.Errorf("list: got %q, want %q", listed, want)
+	}
+
+	stop := errors.New("stop")
+	if err := b.List(ctx, "", func(Info) error { return stop }); !errors.Is(err, stop) {
+		t.Errorf("list: got %v, want the error of the callback", err)
+	}
+
+	if err := b.Delete(ctx, "a.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat(ctx, "a.png"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("stat after delete: got %v, want ErrNotExist", err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	b, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testBackend(t, b)
+}
+
+func TestLocalStaysInRoot(t *testing.T) {
+	root := t.TempDir()
+	b, err := NewLocal(root + "/store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Put(context.Background(), "../../escaped", strings.NewReader("nope")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat(context.Background(), "escaped"); err != nil {
+		t.Errorf("the object wasn't stored inside the root: %s", err)
+	}
+}
+
+func TestS3(t *testing.T) {
+	f := newFakeS3(t)
+	testBackend(t, f.backend(t, "qis"))
+
+	for key := range f.objects {
+		if !strings.HasPrefix(key, "qis/") {
+			t.Errorf("%s was stored outside of the prefix", key)
+		}
+	}
+}
+
+func TestS3PutSize(t *testing.T) {
+	f := newFakeS3(t)
+	b := f.backend(t, "")
+	data := bytes.Repeat([]byte("x"), 1000)
+
+	// Objects are often put from a spooled file, which we know the size of.
+	r := bytes.NewReader(data)
+	r.Seek(100, io.SeekStart)
+	if _, err := b.Put(context.Background(), "seekable", r); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.puts) != 1 || f.puts[0].contentLength != 900 {
+		t.Errorf("got puts %+v, want one of 900 bytes", f.puts)
+	}
+	if got := f.objects["seekable"]; !bytes.Equal(got, data[100:]) {
+		t.Errorf("stored %d bytes, want the last 900", len(got))
+	}
+
+	// Anything else is uploaded in parts.
+	f.puts = nil
+	if _, err := b.Put(context.Background(), "stream", io.MultiReader(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.objects["stream"]; !bytes.Equal(got, data) {
+		t.Errorf("stored %d bytes, want %d", len(got), len(data))
+	}
+	if len(f.puts) != 1 || f.puts[0].contentLength != int64(len(data)) {
+		t.Errorf("got puts %+v, want one part of %d bytes", f.puts, len(data))
+	}
+}
+
+func TestS3Presign(t *testing.T) {
+	f := newFakeS3(t)
+	b := f.backend(t, "qis")
+
+	u, err := b.PresignGet(context.Background(), "a.png", time.Minute, url.Values{"response-content-type": {"image/png"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Path != "/test/qis/a.png" {
+		t.Errorf("got path %q, want /test/qis/a.png", u.Path)
+	}
+	q := u.Query()
+	if q.Get("X-Amz-Expires") != "60" || q.Get("X-Amz-Signature") == "" || q.Get("response-content-type") != "image/png" {
+		t.Errorf("got query %v, want a signature valid for a minute", q)
+	}
+}
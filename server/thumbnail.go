@@ -2,43 +2,86 @@ package server
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"fmt"
-	"github.com/nfnt/resize"
-	"image"
-	"image/jpeg"
 	"image/png"
 	"io"
+	"slices"
+
+	"github.com/liondadev/quick-image-server/types"
 )
 
 const (
 	ThumbnailWidth  uint = 1920 / 4
 	ThumbnailHeight uint = 1080 / 4
+
+	// DefaultThumbnailSize is the size served by /thumb/{file}, without a size.
+	DefaultThumbnailSize = "medium"
 )
 
-var AllowedThumbnailMimeTypes = []string{"image/jpeg", "image/png"}
+// defaultThumbnailSizes are the thumbnail sizes used when the config doesn't have any.
+var defaultThumbnailSizes = []types.ThumbnailSize{
+	{Name: "small", Width: int(ThumbnailWidth / 2), Height: int(ThumbnailHeight / 2), Fit: "contain"},
+	{Name: DefaultThumbnailSize, Width: int(ThumbnailWidth), Height: int(ThumbnailHeight), Fit: "contain"},
+	{Name: "large", Width: int(ThumbnailWidth * 2), Height: int(ThumbnailHeight * 2), Fit: "contain"},
+}
 
-// MakeThumbnail creates a thumbnail (png) image from an original upload.
-func (s *Server) MakeThumbnail(mime string, original io.Reader) (io.Reader, error) {
-	var img image.Image
+// thumbnailSizes returns the thumbnail sizes we serve, from narrowest to widest.
+func (s *Server) thumbnailSizes() []types.ThumbnailSize {
+	if len(s.cfg.ThumbnailSizes) == 0 {
+		return defaultThumbnailSizes
+	}
 
-	switch mime {
-	case "image/jpeg":
-		dec, err := jpeg.Decode(original)
-		if err != nil {
-			return nil, fmt.Errorf("decode jpeg: %w", err)
+	sizes := make([]types.ThumbnailSize, 0, len(s.cfg.ThumbnailSizes))
+	for name, size := range s.cfg.ThumbnailSizes {
+		// The config made sure it's either empty, contain or cover.
+		fit := size.Fit
+		if fit == "" {
+			fit = "contain"
 		}
-		img = dec
-	case "image/png":
-		dec, err := png.Decode(original)
-		if err != nil {
-			return nil, fmt.Errorf("decode png: %w", err)
+
+		sizes = append(sizes, types.ThumbnailSize{Name: name, Width: size.Width, Height: size.Height, Fit: fit})
+	}
+
+	slices.SortFunc(sizes, func(a, b types.ThumbnailSize) int {
+		return cmp.Or(cmp.Compare(a.Width, b.Width), cmp.Compare(a.Name, b.Name))
+	})
+
+	return sizes
+}
+
+// thumbnailSize finds the thumbnail size with the name.
+func (s *Server) thumbnailSize(name string) (types.ThumbnailSize, bool) {
+	for _, size := range s.thumbnailSizes() {
+		if size.Name == name {
+			return size, true
 		}
-		img = dec
-	default:
-		return nil, fmt.Errorf("mime type '%s' can't be used to create thumbnails", mime)
 	}
 
-	thumbImg := resize.Resize(ThumbnailWidth, ThumbnailHeight, img, resize.Lanczos3)
+	// Thumbnails without a size have to keep working, even if the config doesn't have it.
+	if name == DefaultThumbnailSize {
+		return defaultThumbnailSizes[1], true
+	}
+
+	return types.ThumbnailSize{}, false
+}
+
+// thumbnailName returns the name a thumbnail of an upload is stored as. The dimensions
+// are part of the name, so changing a size in the config doesn't serve old thumbnails.
+func thumbnailName(fileId string, size types.ThumbnailSize) string {
+	return fmt.Sprintf("%s.thumbnail.%dx%d.%s.png", fileId, size.Width, size.Height, size.Fit)
+}
+
+// MakeThumbnail creates a thumbnail (png) image from an original upload. The image keeps its
+// aspect ratio, and either fits inside the size (contain) or is cropped to fill it (cover).
+func (s *Server) MakeThumbnail(mime string, original io.Reader, size types.ThumbnailSize) (io.Reader, error) {
+	img, err := decodeImage(mime, original, s.maxImagePixels())
+	if err != nil {
+		return nil, fmt.Errorf("mime type '%s' can't be used to create thumbnails: %w", mime, err)
+	}
+
+	thumbImg := scaleThumbnailFrame(img, size)
 	buff := new(bytes.Buffer)
 	if err := png.Encode(buff, thumbImg); err != nil {
 		return nil, fmt.Errorf("encode png: %w", err)
@@ -46,3 +89,41 @@ func (s *Server) MakeThumbnail(mime string, original io.Reader) (io.Reader, erro
 
 	return buff, nil
 }
+
+// thumbnailNameAndType returns the name a thumbnail of an upload is stored as, and its content type.
+func (s *Server) thumbnailNameAndType(up types.Upload, size types.ThumbnailSize) (string, string) {
+	if s.wantsAnimatedThumbnail(up) {
+		return animatedThumbnailName(up.Id, size), "image/gif"
+	}
+
+	return thumbnailName(up.Id, size), "image/png"
+}
+
+// generateThumbnail makes a thumbnail of an upload, animated if it should be.
+func (s *Server) generateThumbnail(ctx context.Context, up types.Upload, size types.ThumbnailSize) ([]byte, error) {
+	origFile, err := s.store.Get(ctx, originalName(up))
+	if err != nil {
+		return nil, err
+	}
+	defer origFile.Close()
+
+	var thumb io.Reader
+	if s.wantsAnimatedThumbnail(up) {
+		info, err := s.store.Stat(ctx, originalName(up))
+		if err != nil {
+			return nil, err
+		}
+
+		thumb, err = s.MakeAnimatedThumbnail(origFile, info.Size, size)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		thumb, err = s.MakeThumbnail(up.MimeType, origFile, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return io.ReadAll(thumb)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/liondadev/quick-image-server/config"
+	"github.com/liondadev/quick-image-server/types"
+)
+
+func TestThumbnailSizes(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.ThumbnailSizes = map[string]config.ThumbnailSize{
+			"wide":   {Width: 800, Height: 200},
+			"square": {Width: 128, Height: 128, Fit: "cover"},
+		}
+	})
+
+	sizes := s.thumbnailSizes()
+	want := []types.ThumbnailSize{
+		{Name: "square", Width: 128, Height: 128, Fit: "cover"},
+		{Name: "wide", Width: 800, Height: 200, Fit: "contain"},
+	}
+	if len(sizes) != len(want) || sizes[0] != want[0] || sizes[1] != want[1] {
+		t.Errorf("got sizes %+v, want %+v", sizes, want)
+	}
+
+	if _, ok := s.thumbnailSize("small"); ok {
+		t.Error("found a default size that isn't in the config")
+	}
+	// Thumbnails without a size keep working.
+	if size, ok := s.thumbnailSize(DefaultThumbnailSize); !ok || size != defaultThumbnailSizes[1] {
+		t.Errorf("got default size %+v %v, want %+v", size, ok, defaultThumbnailSizes[1])
+	}
+}
+
+func TestThumbnailKeepsAspectRatio(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.ThumbnailSizes = map[string]config.ThumbnailSize{
+			"medium": {Width: 100, Height: 100},
+			"square": {Width: 50, Height: 50, Fit: "cover"},
+			"huge":   {Width: 1000, Height: 1000},
+		}
+	})
+	up := newTestUpload(t, s, "alice", "wide.png", "image/png", testPNG(t, 400, 100), uploadOptions{})
+
+	tests := []struct {
+		target string
+		want   image.Point
+	}{
+		{target: "/thumb/" + up.Id + up.Extension, want: image.Pt(100, 25)},
+		{target: "/thumb/square/" + up.Id + up.Extension, want: image.Pt(50, 50)},
+		// Small images aren't scaled up to fit.
+		{target: "/thumb/huge/" + up.Id + up.Extension, want: image.Pt(400, 100)},
+	}
+
+	for _, tt := range tests {
+		res := serve(s, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %d, want %d", tt.target, res.StatusCode, http.StatusOK)
+			continue
+		}
+
+		img, err := png.Decode(res.Body)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.target, err)
+		}
+		if got := img.Bounds().Size(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.target, got, tt.want)
+		}
+	}
+
+	if res := serve(s, httptest.NewRequest(http.MethodGet, "/thumb/tiny/"+up.Id+up.Extension, nil)); res.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown size: got status %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
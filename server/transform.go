@@ -0,0 +1,376 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/go-chi/chi/v5"
+	"github.com/liondadev/quick-image-server/types"
+	"github.com/nfnt/resize"
+)
+
+const (
+	defaultTransformCacheBytes   int64 = 256 << 20
+	defaultTransformMaxDimension       = 4096
+	defaultTransformQuality            = 80
+)
+
+// transformFormats maps the formats images can be converted to to their content type.
+var transformFormats = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+}
+
+// transformParams describes how an image should be transformed by the /i/ endpoint.
+type transformParams struct {
+	Width   int    // 0 to scale with the height
+	Height  int    // 0 to scale with the width
+	Fit     string // cover, contain or fill
+	Format  string // png, jpeg or webp
+	Quality int    // only used for jpeg
+}
+
+// parseTransformParams reads the transformation parameters from a query. Images are
+// converted to defaultFormat if the query doesn't ask for a format.
+func parseTransformParams(q url.Values, defaultFormat string, maxDimension int) (transformParams, error) {
+	p := transformParams{Fit: "contain", Format: defaultFormat, Quality: defaultTransformQuality}
+
+	dimension := func(key string) (int, error) {
+		v := q.Get(key)
+		if v == "" {
+			return 0, nil
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxDimension {
+			return 0, fmt.Errorf("%s must be a number between 1 and %d", key, maxDimension)
+		}
+		return n, nil
+	}
+
+	var err error
+	if p.Width, err = dimension("w"); err != nil {
+		return p, err
+	}
+	if p.Height, err = dimension("h"); err != nil {
+		return p, err
+	}
+
+	if fit := q.Get("fit"); fit != "" {
+		if fit != "cover" && fit != "contain" && fit != "fill" {
+			return p, errors.New("fit must be cover, contain or fill")
+		}
+		p.Fit = fit
+	}
+
+	if format := q.Get("format"); format != "" {
+		if _, ok := transformFormats[format]; !ok {
+			return p, errors.New("format must be webp, png or jpeg")
+		}
+		p.Format = format
+	}
+
+	if p.Format == "jpeg" {
+		if v := q.Get("q"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 100 {
+				return p, errors.New("q must be a number between 1 and 100")
+			}
+			p.Quality = n
+		}
+	} else {
+		// Quality doesn't mean anything for the other formats, so it shouldn't make
+		// another variant.
+		p.Quality = 0
+	}
+
+	return p, nil
+}
+
+// String returns the parameters in a canonical form, so the same transformation
+// always has the same cache key and signature.
+func (p transformParams) String() string {
+	return fmt.Sprintf("w=%d&h=%d&fit=%s&format=%s&q=%d", p.Width, p.Height, p.Fit, p.Format, p.Quality)
+}
+
+// cacheKey is the name a transformed image is cached as.
+func (p transformParams) cacheKey() string {
+	sum := sha256.Sum256([]byte(p.String()))
+	return hex.EncodeToString(sum[:16]) + "." + p.Format
+}
+
+// transformFormatFor returns the format images with the mime type are converted to
+// when no format is asked for.
+func transformFormatFor(mime string) string {
+	if mime == "image/jpeg" {
+		return "jpeg"
+	}
+
+	return "png"
+}
+
+// transformCachePath returns the directory transformed images are cached in.
+func (s *Server) transformCachePath() string {
+	if s.cfg.Transform.CachePath != "" {
+		return s.cfg.Transform.CachePath
+	}
+
+	return filepath.Join(os.TempDir(), "quick-image-server-transform")
+}
+
+func (s *Server) transformMaxDimension() int {
+	if s.cfg.Transform.MaxDimension > 0 {
+		return s.cfg.Transform.MaxDimension
+	}
+
+	return defaultTransformMaxDimension
+}
+
+// transformSignature signs a set of parameters for a file, so it can be requested even
+// though it isn't one of the presets.
+func (s *Server) transformSignature(fileId string, p transformParams) string {
+	return s.sign("transform", fileId, p.String())
+}
+
+// transformAllowed checks if a request may transform a file with the parameters. To
+// stop people from filling our disk and using up our cpu with endless variants, only
+// presets and parameters signed by the owner of a file are allowed.
+func (s *Server) transformAllowed(r *http.Request, fileId string, p transformParams, defaultFormat string) bool {
+	if s.verify(r.URL.Query().Get("tsig"), "transform", fileId, p.String()) {
+		return true
+	}
+
+	for _, preset := range s.cfg.Transform.Presets {
+		q, err := url.ParseQuery(preset)
+		if err != nil {
+			continue
+		}
+
+		pp, err := parseTransformParams(q, defaultFormat, s.transformMaxDimension())
+		if err == nil && pp == p {
+			return true
+		}
+	}
+
+	return false
+}
+
+// transformImage resizes and crops an image as described by the parameters.
+func transformImage(src image.Image, p transformParams) image.Image {
+	b := src.Bounds()
+	sw, sh := float64(b.Dx()), float64(b.Dy())
+	w, h := p.Width, p.Height
+
+	if w == 0 && h == 0 {
+		return src
+	}
+
+	// Without both dimensions, there's nothing to crop or stretch to, so we
+	// only scale it.
+	if w == 0 || h == 0 || p.Fit == "contain" {
+		scale := math.Inf(1)
+		if w != 0 {
+			scale = float64(w) / sw
+		}
+		if h != 0 {
+			scale = min(scale, float64(h)/sh)
+		}
+
+		return resize.Resize(uint(max(1, math.Round(sw*scale))), uint(max(1, math.Round(sh*scale))), src, resize.Lanczos3)
+	}
+
+	if p.Fit == "fill" {
+		return resize.Resize(uint(w), uint(h), src, resize.Lanczos3)
+	}
+
+	// cover: scale it so it covers the whole box, then crop out the middle.
+	scale := max(float64(w)/sw, float64(h)/sh)
+	scaled := resize.Resize(uint(max(float64(w), math.Round(sw*scale))), uint(max(float64(h), math.Round(sh*scale))), src, resize.Lanczos3)
+
+	sb := scaled.Bounds()
+	offset := image.Pt(sb.Min.X+(sb.Dx()-w)/2, sb.Min.Y+(sb.Dy()-h)/2)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), scaled, offset, draw.Src)
+
+	return dst
+}
+
+// encodeImage encodes an image in one of the transformFormats.
+func encodeImage(w io.Writer, img image.Image, p transformParams) error {
+	switch p.Format {
+	case "png":
+		return png.Encode(w, img)
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: p.Quality})
+	case "webp":
+		return nativewebp.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("can't encode images as '%s'", p.Format)
+	}
+}
+
+// MakeTransformedImage decodes an original upload and transforms it as described by the parameters.
+func (s *Server) MakeTransformedImage(mime string, original io.Reader, p transformParams) ([]byte, error) {
+	src, err := decodeImage(mime, original, s.maxImagePixels())
+	if err != nil {
+		return nil, fmt.Errorf("mime type '%s' can't be transformed: %w", mime, err)
+	}
+
+	buff := new(bytes.Buffer)
+	if err := encodeImage(buff, transformImage(src, p), p); err != nil {
+		return nil, fmt.Errorf("encode %s: %w", p.Format, err)
+	}
+
+	return buff.Bytes(), nil
+}
+
+// handleTransformView handles people viewing resized or converted versions of images.
+func (s *Server) handleTransformView(w http.ResponseWriter, r *http.Request) error {
+	fileName, fileId := getFileDetails(r)
+
+	var upload types.Upload
+	if err := s.db.Get(&upload, `SELECT "id", "mime", "uploaded_at", "ext", "blob", "expires_at", "burn_after_read", "user", "password_hash", "visibility" FROM "uploads" WHERE "id" = $1`, fileId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return PublicError{http.StatusNotFound, "File not Found."}
+		}
+
+		return err
+	}
+
+	// The format is picked with the format parameter, so only the extension of the
+	// original is valid, just like for /f/.
+	if fileName != upload.Id+upload.Extension {
+		return PublicError{http.StatusNotFound, "File not Found."}
+	}
+
+	if isExpired(upload) {
+		return PublicError{http.StatusGone, "This file has expired."}
+	}
+
+	// Derivatives would let people see a one-time file without burning it.
+	if upload.BurnAfterRead {
+		return PublicError{http.StatusNotFound, "File not Found."}
+	}
+
+	if ok, err := s.checkAccess(w, r, upload); !ok {
+		return err
+	}
+
+	if !CanDecode(upload.MimeType) {
+		return PublicError{http.StatusUnsupportedMediaType, "This file can't be transformed."}
+	}
+
+	defaultFormat := transformFormatFor(upload.MimeType)
+	params, err := parseTransformParams(r.URL.Query(), defaultFormat, s.transformMaxDimension())
+	if err != nil {
+		return PublicError{http.StatusBadRequest, err.Error() + "."}
+	}
+
+	if !s.transformAllowed(r, upload.Id, params, defaultFormat) {
+		return PublicError{http.StatusForbidden, "These transformation parameters aren't allowed."}
+	}
+
+	contentType := transformFormats[params.Format]
+	etag := contentETag(upload, "i?"+params.String())
+	key := params.cacheKey()
+
+	if f, err := s.transforms.Open(upload.Id, key); err == nil {
+		defer f.Close()
+
+		serveContent(w, r, upload, contentType, etag, f)
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	data, err := s.derivatives.Do(r.Context(), "transform:"+upload.Id+"/"+key, func() ([]byte, error) {
+		if f, err := s.transforms.Open(upload.Id, key); err == nil {
+			defer f.Close()
+			return io.ReadAll(f)
+		}
+
+		origFile, err := s.store.Get(context.Background(), originalName(upload))
+		if err != nil {
+			return nil, err
+		}
+		defer origFile.Close()
+
+		data, err := s.MakeTransformedImage(upload.MimeType, origFile, params)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.transforms.Put(upload.Id, key, data); err != nil {
+			return nil, err
+		}
+
+		return data, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	serveContent(w, r, upload, contentType, etag, bytes.NewReader(data))
+	return nil
+}
+
+// handleSignTransform handles the owner of a file creating a link to a transformation of
+// it that isn't one of the presets.
+func (s *Server) handleSignTransform(w http.ResponseWriter, r *http.Request) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	var up types.Upload
+	if err := s.db.Get(&up, `SELECT "id", "mime", "ext" FROM "uploads" WHERE "id" = $1 AND "user" = $2`, chi.URLParam(r, "fileId"), userName); err != nil {
+		return PublicError{http.StatusNotFound, "File not found."}
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return PublicError{http.StatusBadRequest, "Invalid form."}
+	}
+
+	params, err := parseTransformParams(r.Form, transformFormatFor(up.MimeType), s.transformMaxDimension())
+	if err != nil {
+		return PublicError{http.StatusBadRequest, err.Error() + "."}
+	}
+
+	transformUrl, err := url.JoinPath(s.cfg.BasePath, "/i/", up.Id+up.Extension)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"fit": {params.Fit}, "format": {params.Format}, "tsig": {s.transformSignature(up.Id, params)}}
+	if params.Width != 0 {
+		query.Set("w", strconv.Itoa(params.Width))
+	}
+	if params.Height != 0 {
+		query.Set("h", strconv.Itoa(params.Height))
+	}
+	if params.Quality != 0 {
+		query.Set("q", strconv.Itoa(params.Quality))
+	}
+
+	writeJson(w, http.StatusOK, jMap{"url": transformUrl + "?" + query.Encode()})
+	return nil
+}
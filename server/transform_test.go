@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liondadev/quick-image-server/config"
+)
+
+func TestParseTransformParams(t *testing.T) {
+	tests := []struct {
+		query string
+		want  transformParams
+		err   bool
+	}{
+		{query: "", want: transformParams{Fit: "contain", Format: "png"}},
+		{query: "w=640", want: transformParams{Width: 640, Fit: "contain", Format: "png"}},
+		{query: "w=640&h=480&fit=cover&format=webp", want: transformParams{Width: 640, Height: 480, Fit: "cover", Format: "webp"}},
+		{query: "format=jpeg", want: transformParams{Fit: "contain", Format: "jpeg", Quality: defaultTransformQuality}},
+		{query: "format=jpeg&q=50", want: transformParams{Fit: "contain", Format: "jpeg", Quality: 50}},
+		// Quality means nothing for png, so it doesn't make another variant.
+		{query: "q=50", want: transformParams{Fit: "contain", Format: "png"}},
+		{query: "w=0", err: true},
+		{query: "w=1001", err: true},
+		{query: "h=big", err: true},
+		{query: "fit=stretch", err: true},
+		{query: "format=gif", err: true},
+		{query: "format=jpeg&q=101", err: true},
+	}
+
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		got, err := parseTransformParams(q, "png", 1000)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: got %+v, want an error", tt.query, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %+v %v, want %+v", tt.query, got, err, tt.want)
+		}
+	}
+}
+
+func TestTransformAllowed(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.Transform.Presets = []string{"w=640&format=webp", "not a %% query"}
+	})
+
+	allowed := func(query string) bool {
+		q, _ := url.ParseQuery(query)
+		p, err := parseTransformParams(q, "png", s.transformMaxDimension())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/i/abc.png?"+query, nil)
+		return s.transformAllowed(r, "abc", p, "png")
+	}
+
+	sig := func(fileId string, query string) string {
+		q, _ := url.ParseQuery(query)
+		p, _ := parseTransformParams(q, "png", s.transformMaxDimension())
+		return s.transformSignature(fileId, p)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  bool
+	}{
+		{name: "preset", query: "w=640&format=webp", want: true},
+		{name: "preset written differently", query: "format=webp&fit=contain&w=640", want: true},
+		{name: "not a preset", query: "w=641&format=webp"},
+		{name: "signed", query: "w=641&format=webp&tsig=" + sig("abc", "w=641&format=webp"), want: true},
+		{name: "signed for another file", query: "w=641&format=webp&tsig=" + sig("def", "w=641&format=webp")},
+		{name: "signed for other parameters", query: "w=642&format=webp&tsig=" + sig("abc", "w=641&format=webp")},
+	}
+
+	for _, tt := range tests {
+		if got := allowed(tt.query); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTransformImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+
+	tests := []struct {
+		params transformParams
+		want   image.Point
+	}{
+		{params: transformParams{}, want: image.Pt(200, 100)},
+		{params: transformParams{Width: 100}, want: image.Pt(100, 50)},
+		{params: transformParams{Height: 20}, want: image.Pt(40, 20)},
+		{params: transformParams{Width: 50, Height: 50, Fit: "contain"}, want: image.Pt(50, 25)},
+		{params: transformParams{Width: 50, Height: 50, Fit: "cover"}, want: image.Pt(50, 50)},
+		{params: transformParams{Width: 50, Height: 80, Fit: "fill"}, want: image.Pt(50, 80)},
+	}
+
+	for _, tt := range tests {
+		if got := transformImage(src, tt.params).Bounds().Size(); got != tt.want {
+			t.Errorf("%+v: got %s, want %s", tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestTransformView(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.Transform.Presets = []string{"w=32&format=png"}
+		cfg.MaxImagePixels = 100 * 100
+	})
+	key, _ := newTestKey(t, s, "alice", []string{ScopeReadOwn}, time.Time{})
+	up := newTestUpload(t, s, "alice", "cat.png", "image/png", testPNG(t, 64, 48), uploadOptions{})
+	target := "/i/" + up.Id + up.Extension
+
+	view := func(target string) (*http.Response, image.Point) {
+		res := serve(s, httptest.NewRequest(http.MethodGet, target, nil))
+		if res.StatusCode != http.StatusOK {
+			return res, image.Point{}
+		}
+
+		img, err := png.Decode(res.Body)
+		if err != nil {
+			t.Fatalf("decode %s: %s", target, err)
+		}
+		return res, img.Bounds().Size()
+	}
+
+	if res, size := view(target + "?w=32&format=png"); res.StatusCode != http.StatusOK || size != image.Pt(32, 24) {
+		t.Errorf("preset: got status %d and size %s, want 32x24", res.StatusCode, size)
+	}
+	if res, _ := view(target + "?w=16"); res.StatusCode != http.StatusForbidden {
+		t.Errorf("not a preset: got status %d, want %d", res.StatusCode, http.StatusForbidden)
+	}
+	if res, _ := view(target + "?w=-1"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid parameters: got status %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+
+	// Only the extension of the original is valid, the format is picked with a parameter.
+	if res, _ := view("/i/" + up.Id + ".webp?w=32&format=png"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("other extension: got status %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+
+	// The owner can sign other parameters.
+	r := httptest.NewRequest(http.MethodPost, "/app/uploads/"+up.Id+"/transform", strings.NewReader(url.Values{"w": {"16"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Server-Api-Key", key)
+	res := serve(s, r)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("sign: got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	var signed struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&signed); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, size := view(u.RequestURI()); res.StatusCode != http.StatusOK || size != image.Pt(16, 12) {
+		t.Errorf("signed: got status %d and size %s, want 16x12", res.StatusCode, size)
+	}
+
+	text := newTestUpload(t, s, "alice", "hello.txt", "text/plain", []byte("hello"), uploadOptions{})
+	if res, _ := view("/i/" + text.Id + text.Extension + "?w=32&format=png"); res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("not an image: got status %d, want %d", res.StatusCode, http.StatusUnsupportedMediaType)
+	}
+
+	// Images with more pixels than the limit are refused before they're decoded.
+	huge := newTestUpload(t, s, "alice", "huge.png", "image/png", pngClaimingSize(t, 20000, 20000), uploadOptions{})
+	if res, _ := view("/i/" + huge.Id + huge.Extension + "?w=32&format=png"); res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("too many pixels: got status %d, want %d", res.StatusCode, http.StatusUnprocessableEntity)
+	}
+}
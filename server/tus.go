@@ -0,0 +1,498 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/liondadev/quick-image-server/types"
+)
+
+// This file implements the core, creation, termination and expiration parts of the tus 1.0
+// resumable upload protocol (https://tus.io/protocols/resumable-upload). The chunks are
+// collected in a local directory, and once the last one arrives the file is stored just
+// like a normal upload.
+
+const (
+	TusVersion            = "1.0.0"
+	TusExtensions         = "creation,termination,expiration"
+	tusIdLength           = 32
+	defaultTusExpiryHours = 24
+)
+
+// tusPath returns the directory partial tus uploads are collected in.
+func (s *Server) tusPath() string {
+	if s.cfg.TusPath != "" {
+		return s.cfg.TusPath
+	}
+
+	return filepath.Join(os.TempDir(), "quick-image-server-tus")
+}
+
+// tusPartPath returns the path to the file the chunks of an upload are appended to.
+func (s *Server) tusPartPath(id string) string {
+	return filepath.Join(s.tusPath(), id+".part")
+}
+
+// tusExpiry returns how long tus uploads are kept around for after a chunk last arrived,
+// or after they finished.
+func (s *Server) tusExpiry() time.Duration {
+	hours := s.cfg.TusExpiryHours
+	if hours <= 0 {
+		hours = defaultTusExpiryHours
+	}
+
+	return time.Duration(hours) * time.Hour
+}
+
+// setTusExpires tells the client when an unfinished upload is thrown away.
+func (s *Server) setTusExpires(w http.ResponseWriter, up types.TusUpload) {
+	if up.FileId != "" {
+		return
+	}
+
+	expires := time.Unix(int64(up.UpdatedAt), 0).Add(s.tusExpiry())
+	w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+}
+
+// tusLock locks the upload with the id so only one PATCH can append to it at once. It
+// returns false if someone is already holding the lock.
+func (s *Server) tusLock(id string) (unlock func(), ok bool) {
+	mu, _ := s.tusLocks.LoadOrStore(id, &sync.Mutex{})
+	m := mu.(*sync.Mutex)
+	if !m.TryLock() {
+		return nil, false
+	}
+
+	return m.Unlock, true
+}
+
+// parseTusMetadata parses the Upload-Metadata header, which is a comma separated list of
+// keys and base64 encoded values.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if header == "" {
+		return meta, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+
+		val, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decode metadata value for '%s': %w", key, err)
+		}
+
+		meta[key] = string(val)
+	}
+
+	return meta, nil
+}
+
+// withoutTusMetadata returns the Upload-Metadata header without the key, so secrets like
+// the password aren't kept or sent back.
+func withoutTusMetadata(header string, key string) string {
+	if header == "" {
+		return ""
+	}
+
+	var kept []string
+	for _, pair := range strings.Split(header, ",") {
+		if k, _, _ := strings.Cut(strings.TrimSpace(pair), " "); k != key {
+			kept = append(kept, strings.TrimSpace(pair))
+		}
+	}
+
+	return strings.Join(kept, ",")
+}
+
+// preHandleTus sets the headers every tus response needs, and makes sure the client
+// speaks a version of the protocol we understand.
+func (s *Server) preHandleTus(next http.Handler) http.Handler {
+	return HandlerWithError(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Tus-Resumable", TusVersion)
+
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != TusVersion {
+			w.Header().Set("Tus-Version", TusVersion)
+			return PublicError{http.StatusPreconditionFailed, "Unsupported tus version."}
+		}
+
+		next.ServeHTTP(w, r)
+		return nil
+	})
+}
+
+// getTusUpload gets the tus upload from the url that belongs to the authenticated user.
+func (s *Server) getTusUpload(r *http.Request) (types.TusUpload, error) {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	var up types.TusUpload
+	if err := s.db.Get(&up, `SELECT "id", "user", "length", "offset", "metadata", "created_at", "updated_at", COALESCE("file_id", '') AS "file_id", "password_hash" FROM "tus_uploads" WHERE "id" = $1 AND "user" = $2`, chi.URLParam(r, "uploadId"), userName); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.TusUpload{}, PublicError{http.StatusNotFound, "Upload not found."}
+		}
+
+		return types.TusUpload{}, err
+	}
+
+	return up, nil
+}
+
+// handleTusOptions tells clients what parts of the protocol we support.
+func (s *Server) handleTusOptions(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Tus-Version", TusVersion)
+	w.Header().Set("Tus-Extension", TusExtensions)
+	if s.cfg.TusMaxSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.cfg.TusMaxSize, 10))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleTusCreate creates a new, empty, tus upload.
+func (s *Server) handleTusCreate(w http.ResponseWriter, r *http.Request) error {
+	userName, ok := r.Context().Value(AuthenticatedUserContextKey).(string)
+	if !ok {
+		panic("user in middleware but not in context key?")
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return PublicError{http.StatusBadRequest, "Missing or invalid Upload-Length header."}
+	}
+
+	if s.cfg.TusMaxSize > 0 && length > s.cfg.TusMaxSize {
+		return PublicError{http.StatusRequestEntityTooLarge, "Upload is larger than the maximum allowed size."}
+	}
+
+	metadata := r.Header.Get("Upload-Metadata")
+	meta, err := parseTusMetadata(metadata)
+	if err != nil {
+		return PublicError{http.StatusBadRequest, "Invalid Upload-Metadata header."}
+	}
+
+	// Make sure the options are valid now, instead of after everything is uploaded. The
+	// password is only kept hashed, like it is for normal uploads.
+	opts, err := s.parseUploadOptions(userName, func(key string) string { return meta[key] })
+	if err != nil {
+		return err
+	}
+	metadata = withoutTusMetadata(metadata, "password")
+
+	if err := os.MkdirAll(s.tusPath(), 0o755); err != nil {
+		return err
+	}
+
+	id := randomString(tusIdLength)
+	f, err := os.Create(s.tusPartPath(id))
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	if _, err := s.db.Exec(`INSERT INTO "tus_uploads" ("id", "user", "length", "offset", "metadata", "created_at", "updated_at", "password_hash") VALUES ($1, $2, $3, 0, $4, $5, $5, $6)`, id, userName, length, metadata, time.Now().Unix(), opts.PasswordHash); err != nil {
+		_ = os.Remove(s.tusPartPath(id))
+		return err
+	}
+
+	location, err := url.JoinPath(s.cfg.BasePath, "/tus/", id)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Location", location)
+	w.Header().Set("Upload-Expires", time.Now().Add(s.tusExpiry()).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// handleTusHead tells the client how much of the upload we already have.
+func (s *Server) handleTusHead(w http.ResponseWriter, r *http.Request) error {
+	up, err := s.getTusUpload(r)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+	s.setTusExpires(w, up)
+	// Uploads from before passwords were hashed still have theirs in the metadata.
+	if metadata := withoutTusMetadata(up.Metadata, "password"); metadata != "" {
+		w.Header().Set("Upload-Metadata", metadata)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// handleTusPatch appends a chunk to an upload. When the upload is complete, it's
+// stored as a normal upload.
+func (s *Server) handleTusPatch(w http.ResponseWriter, r *http.Request) error {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return PublicError{http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream."}
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return PublicError{http.StatusBadRequest, "Missing or invalid Upload-Offset header."}
+	}
+
+	up, err := s.getTusUpload(r)
+	if err != nil {
+		return err
+	}
+
+	unlock, ok := s.tusLock(up.Id)
+	if !ok {
+		return PublicError{http.StatusLocked, "Another request is already writing to this upload."}
+	}
+	defer unlock()
+
+	// Someone else might have appended to it while we were waiting for the lock.
+	up, err = s.getTusUpload(r)
+	if err != nil {
+		return err
+	}
+
+	if offset != up.Offset {
+		return PublicError{http.StatusConflict, "Upload-Offset doesn't match the current offset."}
+	}
+
+	if up.FileId == "" && up.Offset < up.Length {
+		f, err := os.OpenFile(s.tusPartPath(up.Id), os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return err
+		}
+
+		// Whatever we managed to write before an error is still kept, so the client
+		// can resume from there.
+		n, copyErr := io.Copy(f, io.LimitReader(r.Body, up.Length-up.Offset))
+		closeErr := f.Close()
+
+		up.Offset += n
+		up.UpdatedAt = uint64(time.Now().Unix())
+		if _, err := s.db.Exec(`UPDATE "tus_uploads" SET "offset" = $1, "updated_at" = $2 WHERE "id" = $3`, up.Offset, up.UpdatedAt, up.Id); err != nil {
+			return err
+		}
+
+		if copyErr != nil {
+			return copyErr
+		}
+		if closeErr != nil {
+			return closeErr
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+
+	if up.Offset < up.Length {
+		s.setTusExpires(w, up)
+	}
+
+	if up.Offset == up.Length {
+		fileId, err := s.finishTusUpload(r, up)
+		if err != nil {
+			return err
+		}
+
+		var stored types.Upload
+		if err := s.db.Get(&stored, `SELECT * FROM "uploads" WHERE "id" = $1`, fileId); err != nil {
+			return err
+		}
+
+		urls, err := s.uploadUrls(stored)
+		if err != nil {
+			return err
+		}
+
+		// PATCH responses can't have a body, so we give the urls back as headers as well.
+		w.Header().Set("X-File-Url", urls["file_url"].(string))
+		w.Header().Set("X-Thumbnail-Url", urls["thumbnail_url"].(string))
+		w.Header().Set("X-Delete-Url", urls["delete_url"].(string))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// finishTusUpload stores a completed tus upload as a normal upload, returning the id of
+// the new upload. It's safe to call again if it has already finished.
+func (s *Server) finishTusUpload(r *http.Request, up types.TusUpload) (string, error) {
+	if up.FileId != "" {
+		return up.FileId, nil
+	}
+
+	meta, err := parseTusMetadata(up.Metadata)
+	if err != nil {
+		return "", err
+	}
+
+	fileName := meta["filename"]
+	if fileName == "" {
+		fileName = meta["name"] // uppy calls it name instead
+	}
+	mimeType := meta["filetype"]
+	if mimeType == "" {
+		mimeType = meta["type"]
+	}
+
+	f, err := os.Open(s.tusPartPath(up.Id))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	opts, err := s.parseUploadOptions(up.User, func(key string) string { return meta[key] })
+	if err != nil {
+		return "", err
+	}
+	if up.PasswordHash != "" {
+		opts.PasswordHash = up.PasswordHash
+	}
+
+	stored, n, err := s.storeUpload(r.Context(), up.User, fileName, mimeType, f, opts)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("User '%s' uploaded file (using tus) '%s' (%s), n=%d\n", up.User, fileName, stored.Id+stored.Extension, n)
+
+	if _, err := s.db.Exec(`UPDATE "tus_uploads" SET "file_id" = $1, "updated_at" = $2 WHERE "id" = $3`, stored.Id, time.Now().Unix(), up.Id); err != nil {
+		return "", err
+	}
+
+	f.Close()
+	if err := os.Remove(s.tusPartPath(up.Id)); err != nil {
+		log.Printf("Failed to remove finished tus upload part '%s': %s", up.Id, err.Error())
+	}
+
+	return stored.Id, nil
+}
+
+// handleTusStatus returns the same json /upload does once a tus upload has finished.
+func (s *Server) handleTusStatus(w http.ResponseWriter, r *http.Request) error {
+	up, err := s.getTusUpload(r)
+	if err != nil {
+		return err
+	}
+
+	if up.FileId == "" {
+		return PublicError{http.StatusConflict, "The upload hasn't finished yet."}
+	}
+
+	var stored types.Upload
+	if err := s.db.Get(&stored, `SELECT * FROM "uploads" WHERE "id" = $1`, up.FileId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return PublicError{http.StatusGone, "The uploaded file has been deleted."}
+		}
+
+		return err
+	}
+
+	urls, err := s.uploadUrls(stored)
+	if err != nil {
+		return err
+	}
+
+	writeJson(w, http.StatusOK, urls)
+	return nil
+}
+
+// handleTusTerminate cancels an upload and throws away everything we have of it.
+func (s *Server) handleTusTerminate(w http.ResponseWriter, r *http.Request) error {
+	up, err := s.getTusUpload(r)
+	if err != nil {
+		return err
+	}
+
+	unlock, ok := s.tusLock(up.Id)
+	if !ok {
+		return PublicError{http.StatusLocked, "Another request is currently writing to this upload."}
+	}
+	defer unlock()
+
+	if _, err := s.db.Exec(`DELETE FROM "tus_uploads" WHERE "id" = $1`, up.Id); err != nil {
+		return err
+	}
+	s.tusLocks.Delete(up.Id)
+
+	if err := os.Remove(s.tusPartPath(up.Id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// reapExpiredTusUploads throws away every unfinished tus upload that no chunk arrived for
+// in longer than the expiry, and forgets about finished ones after the same time.
+func (s *Server) reapExpiredTusUploads(ctx context.Context) error {
+	cutoff := time.Now().Add(-s.tusExpiry()).Unix()
+
+	var ids []string
+	if err := s.db.SelectContext(ctx, &ids, `SELECT "id" FROM "tus_uploads" WHERE "file_id" IS NULL AND "updated_at" <= $1`, cutoff); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		// If someone is still writing to it, it can go next time.
+		unlock, ok := s.tusLock(id)
+		if !ok {
+			continue
+		}
+
+		// It might have been finished, terminated or written to in the meantime.
+		res, err := s.db.ExecContext(ctx, `DELETE FROM "tus_uploads" WHERE "id" = $1 AND "file_id" IS NULL AND "updated_at" <= $2`, id, cutoff)
+		if err != nil {
+			unlock()
+			return err
+		}
+
+		n, _ := res.RowsAffected()
+		if n == 0 {
+			unlock()
+			continue
+		}
+		s.tusLocks.Delete(id)
+		unlock()
+
+		if err := os.Remove(s.tusPartPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to delete the part file of expired tus upload '%s': %s", id, err.Error())
+			continue
+		}
+
+		log.Printf("Reaped expired tus upload '%s'.", id)
+	}
+
+	// Finished uploads only have to stick around so clients can ask for their urls, the
+	// files themselves are normal uploads by now.
+	var finished []string
+	if err := s.db.SelectContext(ctx, &finished, `DELETE FROM "tus_uploads" WHERE "file_id" IS NOT NULL AND "updated_at" <= $1 RETURNING "id"`, cutoff); err != nil {
+		return err
+	}
+	for _, id := range finished {
+		s.tusLocks.Delete(id)
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liondadev/quick-image-server/types"
+)
+
+// tusRequest creates a tus request authenticated with key.
+func tusRequest(method string, target string, key string, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", TusVersion)
+	r.Header.Set("X-Server-Api-Key", key)
+	if method == http.MethodPatch {
+		r.Header.Set("Content-Type", "application/offset+octet-stream")
+	}
+
+	return r
+}
+
+// createTusUpload starts a tus upload of length bytes, returning its path.
+func createTusUpload(t *testing.T, s *Server, key string, length int, metadata string) string {
+	t.Helper()
+
+	r := tusRequest(http.MethodPost, "/tus", key, "")
+	r.Header.Set("Upload-Length", strconv.Itoa(length))
+	r.Header.Set("Upload-Metadata", metadata)
+	res := serve(s, r)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("create: got status %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	if res.Header.Get("Upload-Expires") == "" {
+		t.Error("create: no Upload-Expires header")
+	}
+
+	return strings.TrimPrefix(res.Header.Get("Location"), s.cfg.BasePath)
+}
+
+// patchTus appends a chunk at offset to the upload.
+func patchTus(s *Server, key string, target string, offset int, chunk string) *http.Response {
+	r := tusRequest(http.MethodPatch, target, key, chunk)
+	r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+
+	return serve(s, r)
+}
+
+func tusMetadata(pairs ...string) string {
+	var encoded []string
+	for i := 0; i < len(pairs); i += 2 {
+		encoded = append(encoded, pairs[i]+" "+base64.StdEncoding.EncodeToString([]byte(pairs[i+1])))
+	}
+
+	return strings.Join(encoded, ",")
+}
+
+func TestTusUpload(t *testing.T) {
+	s := newTestServer(t, nil)
+	key, _ := newTestKey(t, s, "alice", []string{ScopeUpload}, time.Time{})
+	bobKey, _ := newTestKey(t, s, "bob", []string{ScopeUpload}, time.Time{})
+
+	target := createTusUpload(t, s, key, 11, tusMetadata("filename", "hello.txt", "filetype", "text/plain", "password", "hunter2"))
+
+	if res := patchTus(s, bobKey, target, 0, "hello"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("patch the upload of someone else: got status %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+
+	if res := patchTus(s, key, target, 0, "hello"); res.StatusCode != http.StatusNoContent || res.Header.Get("Upload-Offset") != "5" {
+		t.Fatalf("first chunk: got status %d and offset %q", res.StatusCode, res.Header.Get("Upload-Offset"))
+	}
+	if res := patchTus(s, key, target, 2, " world"); res.StatusCode != http.StatusConflict {
+		t.Errorf("chunk at the wrong offset: got status %d, want %d", res.StatusCode, http.StatusConflict)
+	}
+
+	res := serve(s, tusRequest(http.MethodHead, target, key, ""))
+	if res.StatusCode != http.StatusOK || res.Header.Get("Upload-Offset") != "5" || res.Header.Get("Upload-Length") != "11" {
+		t.Errorf("head: got status %d, offset %q and length %q", res.StatusCode, res.Header.Get("Upload-Offset"), res.Header.Get("Upload-Length"))
+	}
+	if strings.Contains(res.Header.Get("Upload-Metadata"), "password") {
+		t.Error("head: the password was sent back")
+	}
+
+	if res := serve(s, tusRequest(http.MethodGet, target, key, "")); res.StatusCode != http.StatusConflict {
+		t.Errorf("status of an unfinished upload: got %d, want %d", res.StatusCode, http.StatusConflict)
+	}
+
+	// A chunk that's longer than what's left is cut off.
+	res = patchTus(s, key, target, 5, " world and more")
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("Upload-Offset") != "11" {
+		t.Fatalf("last chunk: got status %d and offset %q", res.StatusCode, res.Header.Get("Upload-Offset"))
+	}
+	if res.Header.Get("X-File-Url") == "" {
+		t.Error("last chunk: no X-File-Url header")
+	}
+
+	var tus types.TusUpload
+	if err := s.db.Get(&tus, `SELECT "id", "file_id", "metadata" FROM "tus_uploads" WHERE "id" = $1`, strings.TrimPrefix(target, "/tus/")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(tus.Metadata, "password") {
+		t.Error("the password was kept in the metadata")
+	}
+	if _, err := os.Stat(s.tusPartPath(tus.Id)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the part file is still there: %v", err)
+	}
+
+	var up types.Upload
+	if err := s.db.Get(&up, `SELECT * FROM "uploads" WHERE "id" = $1`, tus.FileId); err != nil {
+		t.Fatal(err)
+	}
+	if up.User != "alice" || up.UploadedAs != "hello.txt" || up.MimeType != "text/plain" || up.PasswordHash == "" {
+		t.Errorf("got upload %+v", up)
+	}
+
+	f, err := s.store.Get(context.Background(), originalName(up))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if data, _ := io.ReadAll(f); string(data) != "hello world" {
+		t.Errorf("stored %q, want \"hello world\"", data)
+	}
+
+	if res := serve(s, tusRequest(http.MethodGet, target, key, "")); res.StatusCode != http.StatusOK {
+		t.Errorf("status of a finished upload: got %d, want %d", res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestTusTerminate(t *testing.T) {
+	s := newTestServer(t, nil)
+	key, _ := newTestKey(t, s, "alice", []string{ScopeUpload}, time.Time{})
+
+	target := createTusUpload(t, s, key, 10, "")
+	patchTus(s, key, target, 0, "abc")
+
+	if res := serve(s, tusRequest(http.MethodDelete, target, key, "")); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("terminate: got status %d, want %d", res.StatusCode, http.StatusNoContent)
+	}
+	if res := serve(s, tusRequest(http.MethodHead, target, key, "")); res.StatusCode != http.StatusNotFound {
+		t.Errorf("head after terminating: got status %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+	if _, err := os.Stat(s.tusPartPath(strings.TrimPrefix(target, "/tus/"))); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the part file is still there: %v", err)
+	}
+}
+
+func TestReapExpiredTusUploads(t *testing.T) {
+	s := newTestServer(t, nil)
+	key, _ := newTestKey(t, s, "alice", []string{ScopeUpload}, time.Time{})
+	longAgo := time.Now().Add(-2 * s.tusExpiry()).Unix()
+
+	abandoned := createTusUpload(t, s, key, 10, "")
+	patchTus(s, key, abandoned, 0, "abc")
+
+	// Created long ago, but still going.
+	slow := createTusUpload(t, s, key, 10, "")
+	finished := createTusUpload(t, s, key, 3, "")
+	patchTus(s, key, finished, 0, "abc")
+
+	id := func(target string) string { return strings.TrimPrefix(target, "/tus/") }
+	if _, err := s.db.Exec(`UPDATE "tus_uploads" SET "created_at" = $1, "updated_at" = $1`, longAgo); err != nil {
+		t.Fatal(err)
+	}
+	if res := patchTus(s, key, slow, 0, "abc"); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("patch: got status %d, want %d", res.StatusCode, http.StatusNoContent)
+	}
+
+	res := serve(s, tusRequest(http.MethodHead, slow, key, ""))
+	expires, err := http.ParseTime(res.Header.Get("Upload-Expires"))
+	if err != nil || expires.Before(time.Now().Add(s.tusExpiry()-time.Minute)) {
+		t.Errorf("the upload that's still going expires at %s, want a full expiry from now: %v", expires, err)
+	}
+
+	if err := s.reapExpiredTusUploads(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var left []string
+	if err := s.db.Select(&left, `SELECT "id" FROM "tus_uploads"`); err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || left[0] != id(slow) {
+		t.Errorf("got tus uploads %q after reaping, want only %s", left, id(slow))
+	}
+
+	if _, err := os.Stat(s.tusPartPath(id(abandoned))); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the part file of the abandoned upload is still there: %v", err)
+	}
+	if _, err := os.Stat(s.tusPartPath(id(slow))); err != nil {
+		t.Errorf("the part file of the upload that's still going is gone: %v", err)
+	}
+	for _, target := range []string{abandoned, finished} {
+		if _, ok := s.tusLocks.Load(id(target)); ok {
+			t.Errorf("the lock of %s is still around", target)
+		}
+	}
+
+	// The file of the finished upload is a normal upload by now.
+	var uploads int
+	if err := s.db.Get(&uploads, `SELECT COUNT(*) FROM "uploads"`); err != nil {
+		t.Fatal(err)
+	}
+	if uploads != 1 {
+		t.Errorf("got %d uploads, want the finished one", uploads)
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/liondadev/quick-image-server/server/storage"
+	"github.com/liondadev/quick-image-server/types"
+)
+
+// uploadOptions are the optional settings clients can give for a new upload.
+type uploadOptions struct {
+	ExpiresAt     time.Time // zero if it never expires
+	BurnAfterRead bool      // the file can only be viewed once
+	PasswordHash  string    // bcrypt hash of the password needed to see it, if any
+	Visibility    string    // who can see it
+}
+
+// parseUploadOptions reads the upload options from get, which returns the value of
+// a form field (or tus metadata key) by name.
+func (s *Server) parseUploadOptions(userName string, get func(key string) string) (uploadOptions, error) {
+	expiresAt, err := s.uploadExpiry(userName, get("expires_in"), get("expires_at"))
+	if err != nil {
+		return uploadOptions{}, err
+	}
+
+	passwordHash, err := hashUploadPassword(get("password"))
+	if err != nil {
+		return uploadOptions{}, err
+	}
+
+	visibility := get("visibility")
+	if visibility == "" {
+		visibility = types.VisibilityPublic
+	}
+	if !validVisibility(visibility) {
+		return uploadOptions{}, PublicError{http.StatusBadRequest, "Invalid visibility, it must be public, unlisted or private."}
+	}
+
+	return uploadOptions{
+		ExpiresAt:     expiresAt,
+		BurnAfterRead: formBool(get("burn_after_read")),
+		PasswordHash:  passwordHash,
+		Visibility:    visibility,
+	}, nil
+}
+
+// formBool checks if a form field (or tus metadata value) is set to something truthy.
+func formBool(val string) bool {
+	switch strings.ToLower(val) {
+	case "1", "true", "on", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// storeUpload stores everything read from r as a new upload owned by userName and
+// records it in the database. It returns the new upload and its size in bytes.
+func (s *Server) storeUpload(ctx context.Context, userName string, uploadedAs string, mimeType string, r io.Reader, opts uploadOptions) (types.Upload, int64, error) {
+	fileId, err := s.getFreeFileId(FileIdLength)
+	if err != nil {
+		fmt.Println(err)
+		return types.Upload{}, 0, PublicError{http.StatusInternalServerError, "failed to generate id"}
+	}
+
+	if mimeType == "" {
+		mimeType = "application/octet-stream" // default for binary data
+	}
+
+	// Handle storing the file
+	hash, n, err := s.acquireBlob(ctx, r)
+	if err != nil {
+		return types.Upload{}, 0, err
+	}
+
+	up := types.Upload{
+		Id:          fileId,
+		MimeType:    mimeType,
+		User:        userName,
+		Timestamp:   uint64(time.Now().Unix()),
+		UploadedAs:  uploadedAs,
+		Extension:   path.Ext(uploadedAs),
+		DeleteToken: s.generateDeleteToken(32),
+		Blob:        hash,
+
+		BurnAfterRead: opts.BurnAfterRead,
+		PasswordHash:  opts.PasswordHash,
+		Visibility:    opts.Visibility,
+	}
+	if !opts.ExpiresAt.IsZero() {
+		up.ExpiresAt = uint64(opts.ExpiresAt.Unix())
+	}
+
+	// Handle storing the upload in the database
+	if _, err := s.db.Exec(`INSERT INTO "uploads" ("id", "mime", "user", "uploaded_at", "uploaded_as", "delete_token", "ext", "blob", "expires_at", "burn_after_read", "password_hash", "visibility") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`, up.Id, up.MimeType, up.User, up.Timestamp, up.UploadedAs, up.DeleteToken, up.Extension, up.Blob, up.ExpiresAt, up.BurnAfterRead, up.PasswordHash, up.Visibility); err != nil {
+		// If we fail the database query we need to give the blob back
+		_ = s.releaseBlob(ctx, hash) // if we error here it's already too late
+
+		return types.Upload{}, 0, err
+	}
+
+	s.generateThumbnailsEagerly(up)
+
+	return up, n, nil
+}
+
+// uploadUrls returns the urls that are given back to clients after they upload a file.
+func (s *Server) uploadUrls(up types.Upload) (jMap, error) {
+	diskName := up.Id + up.Extension
+
+	uploadUrl, err := url.JoinPath(s.cfg.BasePath, "/f/", diskName)
+	if err != nil {
+		return nil, err
+	}
+
+	thumbUrl, err := url.JoinPath(s.cfg.BasePath, "/thumb/", diskName)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteUrl, err := url.JoinPath(s.cfg.BasePath, "/delete/", up.Id, "/", up.DeleteToken)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := jMap{
+		"file_url":      uploadUrl,
+		"thumbnail_url": thumbUrl,
+		"delete_url":    deleteUrl,
+	}
+	if up.ExpiresAt != 0 {
+		urls["expires_at"] = up.ExpiresAt
+	}
+
+	return urls, nil
+}
+
+// legacyDerivativeNames are the names of the derivatives an upload might have that were
+// generated before there was a registry of them.
+func (s *Server) legacyDerivativeNames(fileId string) []string {
+	names := []string{
+		fileId + ".thumbnail.png", // thumbnails from before there were sizes
+		fileId + ".bubble.png",
+		fileId + ".bubble.gif",
+		fileId + ".bubble.jpg",
+		fileId + ".bubble.jpeg",
+	}
+
+	for _, size := range s.thumbnailSizes() {
+		names = append(names, thumbnailName(fileId, size), animatedThumbnailName(fileId, size))
+	}
+
+	return names
+}
+
+// deleteUploadFiles deletes the original and every derivative of an upload that has
+// already been removed from the database with deleteUpload, which gives the names of
+// its registered derivatives.
+func (s *Server) deleteUploadFiles(ctx context.Context, up types.Upload, derivatives []string) error {
+	if up.Blob != "" {
+		// Other uploads might still be using the same blob.
+		if err := s.releaseBlob(ctx, up.Blob); err != nil {
+			return err
+		}
+	} else if err := s.store.Delete(ctx, originalName(up)); err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return err
+	}
+
+	// Derivatives with other masks, positions or captions from before the registry are
+	// left to the sweep-derivatives command, since finding them means listing the store.
+	names := append(derivatives, s.legacyDerivativeNames(up.Id)...)
+	slices.Sort(names)
+	for _, name := range slices.Compact(names) {
+		if err := s.store.Delete(ctx, name); err != nil && !errors.Is(err, storage.ErrNotExist) {
+			return err
+		}
+	}
+
+	// Transformed images and captions are only kept in a local cache, so they aren't registered.
+	if err := s.transforms.Purge(up.Id); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,392 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/liondadev/quick-image-server/types"
+)
+
+const (
+	apiKeyPrefix       = "qis_"
+	apiKeyLength       = 40 // random characters after apiKeyPrefix
+	apiKeyIdLength     = 12
+	maxKeyPrefixLength = len(apiKeyPrefix) + 8
+
+	// lastUsedInterval is how often the last used time of a key is updated, so not
+	// every request has to write to the database.
+	lastUsedInterval = time.Minute
+
+	configUsersImportedSetting = "config_users_imported"
+)
+
+// The scopes an API key can have, which decide what it can be used for.
+const (
+	ScopeUpload    = "upload"     // upload files, and change the password and visibility of them
+	ScopeReadOwn   = "read-own"   // see the dashboard and private files, and make share links
+	ScopeDeleteOwn = "delete-own" // delete own uploads and bubble masks
+	ScopeImport    = "import"     // import uploads from another server
+	ScopeAdmin     = "admin"      // everything, including creating keys with any scope
+)
+
+// Scopes are all the scopes, in the order they're shown in.
+var Scopes = []string{ScopeUpload, ScopeReadOwn, ScopeDeleteOwn, ScopeImport, ScopeAdmin}
+
+var (
+	ErrUserExists      = errors.New("user already exists")
+	ErrUserNotFound    = errors.New("user not found")
+	ErrAPIKeyNotFound  = errors.New("api key not found")
+	ErrInvalidScopes   = errors.New("api keys need at least one scope, out of " + strings.Join(Scopes, ", "))
+	ErrInvalidUserName = errors.New("user names can't be empty, longer than 64 characters or have spaces around them")
+)
+
+// hashToken returns the hash of an API key or session token that's stored in the database.
+// They're long and random, so they don't need a slow hash like passwords do.
+func hashToken(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyDisplayPrefix returns the start of a key that's stored in plain text, so people
+// can tell their keys apart and keys can be found without scanning every hash. Short
+// keys (like ones from the config) get a shorter prefix, so the prefix doesn't give
+// most of them away.
+func apiKeyDisplayPrefix(key string) string {
+	return key[:min(maxKeyPrefixLength, len(key)/3)]
+}
+
+// parseScopes turns a list of scopes into the form they're stored in, making sure every
+// scope exists.
+func parseScopes(scopes []string) (string, error) {
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return "", ErrInvalidScopes
+		}
+	}
+
+	// Always in the same order, no matter how they were given.
+	var valid []string
+	for _, scope := range Scopes {
+		if slices.Contains(scopes, scope) {
+			valid = append(valid, scope)
+		}
+	}
+
+	if len(valid) == 0 {
+		return "", ErrInvalidScopes
+	}
+
+	return strings.Join(valid, " "), nil
+}
+
+// scopesInclude checks if space separated scopes include scope. Admin includes every scope.
+func scopesInclude(scopes string, scope string) bool {
+	fields := strings.Fields(scopes)
+	return slices.Contains(fields, scope) || slices.Contains(fields, ScopeAdmin)
+}
+
+// grantableScopes returns the scopes out of Scopes that are included in scopes, which are
+// the scopes someone authenticated with them can give to new keys.
+func grantableScopes(scopes string) []string {
+	var grantable []string
+	for _, scope := range Scopes {
+		if scopesInclude(scopes, scope) {
+			grantable = append(grantable, scope)
+		}
+	}
+
+	return grantable
+}
+
+// scopesCover checks if space separated scopes include every one of want, so a key with
+// them can manage keys with want without gaining anything.
+func scopesCover(scopes string, want string) bool {
+	for _, scope := range strings.Fields(want) {
+		if !scopesInclude(scopes, scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ImportConfigUsers imports the users and API keys from the config into the database,
+// the first time it's run on a database. After that, the users in the config are ignored.
+func (s *Server) ImportConfigUsers(ctx context.Context) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var imported bool
+	if err := tx.GetContext(ctx, &imported, `SELECT COUNT(*) > 0 FROM "settings" WHERE "key" = $1`, configUsersImportedSetting); err != nil {
+		return err
+	}
+
+	if imported {
+		if len(s.cfg.Users) > 0 {
+			log.Printf("The 'users' in the config have already been imported into the database and are ignored. Use the 'users' command to manage users instead.")
+		}
+
+		return nil
+	}
+
+	now := time.Now().Unix()
+	for key, name := range s.cfg.Users {
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO "users" ("name", "created_at") VALUES ($1, $2)`, name, now); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO "api_keys" ("id", "user", "hash", "prefix", "label", "created_at") VALUES ($1, $2, $3, $4, $5, $6)`, randomString(apiKeyIdLength), name, hashToken(key), apiKeyDisplayPrefix(key), "config", now); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO "settings" ("key", "value") VALUES ($1, $2)`, configUsersImportedSetting, fmt.Sprint(now)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if len(s.cfg.Users) > 0 {
+		log.Printf("Imported %d API keys from the config into the database. The 'users' can be removed from the config now.", len(s.cfg.Users))
+	}
+
+	return nil
+}
+
+// authenticateAPIKey finds the API key key. It returns false if there's no such key, or
+// if it has expired.
+func (s *Server) authenticateAPIKey(ctx context.Context, key string) (types.APIKey, bool, error) {
+	if key == "" {
+		return types.APIKey{}, false, nil
+	}
+
+	var candidates []types.APIKey
+	if err := s.db.SelectContext(ctx, &candidates, `SELECT * FROM "api_keys" WHERE "prefix" = substr($1, 1, length("prefix"))`, key); err != nil {
+		return types.APIKey{}, false, err
+	}
+
+	// Compare every candidate, in constant time, so how long this takes doesn't tell
+	// anyone how close they got.
+	hash := []byte(hashToken(key))
+	var found types.APIKey
+	ok := false
+	for _, c := range candidates {
+		if subtle.ConstantTimeCompare([]byte(c.Hash), hash) == 1 {
+			found = c
+			ok = true
+		}
+	}
+
+	now := time.Now()
+	if !ok || (found.ExpiresAt != 0 && found.ExpiresAt <= uint64(now.Unix())) {
+		return types.APIKey{}, false, nil
+	}
+
+	if now.Sub(time.Unix(int64(found.LastUsedAt), 0)) > lastUsedInterval {
+		if _, err := s.db.ExecContext(ctx, `UPDATE "api_keys" SET "last_used_at" = $1 WHERE "id" = $2`, now.Unix(), found.Id); err != nil {
+			return types.APIKey{}, false, err
+		}
+		found.LastUsedAt = uint64(now.Unix())
+	}
+
+	return found, true, nil
+}
+
+// ListUsers returns every user, by name.
+func (s *Server) ListUsers(ctx context.Context) ([]types.User, error) {
+	var users []types.User
+	if err := s.db.SelectContext(ctx, &users, `SELECT * FROM "users" ORDER BY "name"`); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// CreateUser adds a new user, without any API keys.
+func (s *Server) CreateUser(ctx context.Context, name string) error {
+	return createUser(ctx, s.db, name)
+}
+
+// createUser adds a new user with db, which can be a transaction.
+func createUser(ctx context.Context, db sqlx.ExecerContext, name string) error {
+	if name == "" || len(name) > 64 || strings.TrimSpace(name) != name {
+		return ErrInvalidUserName
+	}
+
+	res, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO "users" ("name", "created_at") VALUES ($1, $2)`, name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrUserExists
+	}
+
+	return nil
+}
+
+// DeleteUser removes a user and all of their API keys and sessions. Their uploads are kept.
+func (s *Server) DeleteUser(ctx context.Context, name string) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "api_keys" WHERE "user" = $1`, name); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "sessions" WHERE "user" = $1`, name); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "oidc_identities" WHERE "user" = $1`, name); err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM "users" WHERE "name" = $1`, name)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+
+	return tx.Commit()
+}
+
+// CreateAPIKey creates a new API key for a user with the scopes, which expires at
+// expiresAt unless it's zero. The key itself is only returned here, it can't be
+// recovered later.
+func (s *Server) CreateAPIKey(ctx context.Context, user string, label string, scopes []string, expiresAt time.Time) (string, types.APIKey, error) {
+	scopeStr, err := parseScopes(scopes)
+	if err != nil {
+		return "", types.APIKey{}, err
+	}
+
+	exists, err := s.userExists(ctx, user)
+	if err != nil {
+		return "", types.APIKey{}, err
+	}
+	if !exists {
+		return "", types.APIKey{}, ErrUserNotFound
+	}
+
+	key := apiKeyPrefix + secretString(apiKeyLength)
+	k := types.APIKey{
+		Id:        randomString(apiKeyIdLength),
+		User:      user,
+		Hash:      hashToken(key),
+		Prefix:    apiKeyDisplayPrefix(key),
+		Label:     label,
+		CreatedAt: uint64(time.Now().Unix()),
+		Scopes:    scopeStr,
+	}
+	if !expiresAt.IsZero() {
+		k.ExpiresAt = uint64(expiresAt.Unix())
+	}
+
+	if _, err := s.db.NamedExecContext(ctx, `INSERT INTO "api_keys" ("id", "user", "hash", "prefix", "label", "created_at", "scopes", "expires_at") VALUES (:id, :user, :hash, :prefix, :label, :created_at, :scopes, :expires_at)`, k); err != nil {
+		return "", types.APIKey{}, err
+	}
+
+	return key, k, nil
+}
+
+// GetAPIKey returns the API key with the id of a user.
+func (s *Server) GetAPIKey(ctx context.Context, user string, id string) (types.APIKey, error) {
+	var k types.APIKey
+	if err := s.db.GetContext(ctx, &k, `SELECT * FROM "api_keys" WHERE "user" = $1 AND "id" = $2`, user, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.APIKey{}, ErrAPIKeyNotFound
+		}
+
+		return types.APIKey{}, err
+	}
+
+	return k, nil
+}
+
+// ListAPIKeys returns the API keys of a user, newest first.
+func (s *Server) ListAPIKeys(ctx context.Context, user string) ([]types.APIKey, error) {
+	var keys []types.APIKey
+	if err := s.db.SelectContext(ctx, &keys, `SELECT * FROM "api_keys" WHERE "user" = $1 ORDER BY "created_at" DESC`, user); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// LabelAPIKey changes the label of the API key with the id of a user.
+func (s *Server) LabelAPIKey(ctx context.Context, user string, id string, label string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE "api_keys" SET "label" = $1 WHERE "user" = $2 AND "id" = $3`, label, user, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// RevokeAPIKey deletes the API key with the id of a user, and logs out everyone that
+// logged into the dashboard with it.
+func (s *Server) RevokeAPIKey(ctx context.Context, user string, id string) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM "api_keys" WHERE "user" = $1 AND "id" = $2`, user, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "sessions" WHERE "key_id" = $1`, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// userExists checks if there's a user with the name.
+func (s *Server) userExists(ctx context.Context, name string) (bool, error) {
+	var exists bool
+	if err := s.db.GetContext(ctx, &exists, `SELECT COUNT(*) > 0 FROM "users" WHERE "name" = $1`, name); err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
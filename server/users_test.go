@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/liondadev/quick-image-server/config"
+)
+
+func TestImportConfigUsers(t *testing.T) {
+	const configKey = "an api key from the config"
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.Users = map[string]string{configKey: "alice"}
+	})
+	ctx := context.Background()
+
+	if err := s.ImportConfigUsers(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	k, ok, err := s.authenticateAPIKey(ctx, configKey)
+	if err != nil || !ok || k.User != "alice" {
+		t.Fatalf("authenticate the imported key: got %+v %v %v", k, ok, err)
+	}
+	if k.Hash == configKey || k.Prefix != configKey[:len(configKey)/3] {
+		t.Errorf("the key isn't only stored hashed: got hash %q and prefix %q", k.Hash, k.Prefix)
+	}
+
+	// The config is only imported once, so users removed from the database stay removed.
+	if err := s.DeleteUser(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ImportConfigUsers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := s.userExists(ctx, "alice"); err != nil || exists {
+		t.Errorf("the user was imported again: %v %v", exists, err)
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	s := newTestServer(t, nil)
+	ctx := context.Background()
+	key, k := newTestKey(t, s, "alice", []string{ScopeUpload}, time.Time{})
+
+	found, ok, err := s.authenticateAPIKey(ctx, key)
+	if err != nil || !ok || found.Id != k.Id {
+		t.Fatalf("got %+v %v %v, want the key", found, ok, err)
+	}
+	if found.LastUsedAt == 0 {
+		t.Error("the last time the key was used wasn't updated")
+	}
+
+	// Keys with the same prefix, or only part of the key, don't work.
+	for _, wrong := range []string{"", key[:len(key)-1], key + "x", key[:len(key)-1] + "?"} {
+		if _, ok, err := s.authenticateAPIKey(ctx, wrong); err != nil || ok {
+			t.Errorf("authenticated with %q: %v %v", wrong, ok, err)
+		}
+	}
+
+	expired, _, err := s.CreateAPIKey(ctx, "alice", "expired", []string{ScopeUpload}, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.authenticateAPIKey(ctx, expired); err != nil || ok {
+		t.Errorf("authenticated with an expired key: %v %v", ok, err)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	s := newTestServer(t, nil)
+	ctx := context.Background()
+
+	for _, name := range []string{"", " alice", "bob ", string(make([]byte, 65))} {
+		if err := s.CreateUser(ctx, name); !errors.Is(err, ErrInvalidUserName) {
+			t.Errorf("create user %q: got %v, want ErrInvalidUserName", name, err)
+		}
+	}
+
+	key, _ := newTestKey(t, s, "alice", []string{ScopeReadOwn}, time.Time{})
+	if err := s.CreateUser(ctx, "alice"); !errors.Is(err, ErrUserExists) {
+		t.Errorf("create alice again: got %v, want ErrUserExists", err)
+	}
+	if _, _, err := s.CreateAPIKey(ctx, "bob", "test", []string{ScopeUpload}, time.Time{}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("create a key for a user that doesn't exist: got %v, want ErrUserNotFound", err)
+	}
+
+	up := newTestUpload(t, s, "alice", "hello.txt", "text/plain", []byte("hello"), uploadOptions{})
+	session := login(t, s, key)
+
+	users, err := s.ListUsers(ctx)
+	if err != nil || len(users) != 1 || users[0].Name != "alice" {
+		t.Errorf("list users: got %+v %v, want alice", users, err)
+	}
+
+	// Deleting a user logs them out everywhere, but keeps their uploads.
+	if err := s.DeleteUser(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.authenticateAPIKey(ctx, key); err != nil || ok {
+		t.Errorf("the key of the deleted user still works: %v %v", ok, err)
+	}
+	if _, ok, err := s.authenticateSession(ctx, session.Value); err != nil || ok {
+		t.Errorf("the session of the deleted user still works: %v %v", ok, err)
+	}
+	if !uploadExists(t, s, up.Id) {
+		t.Error("the upload of the deleted user was deleted")
+	}
+
+	if err := s.DeleteUser(ctx, "alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("delete alice again: got %v, want ErrUserNotFound", err)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+
+	"github.com/liondadev/quick-image-server/types"
+	"golang.org/x/sync/singleflight"
+)
+
+const defaultDerivativeQueue = 64
+
+// errNotQueued is the result of a flight whose job never made it onto the queue, because
+// the queue was full or whoever was waiting for room in it gave up.
+var errNotQueued = errors.New("derivative job wasn't queued")
+
+// workerPool generates derivatives (thumbnails, bubbles and the like) on a fixed number of
+// workers. Jobs with the same key that are asked for at the same time only run once, and
+// everyone asking gets the same result.
+type workerPool struct {
+	jobs  chan func()
+	group singleflight.Group
+}
+
+// newWorkerPool starts a pool with a number of workers, and room for queue jobs waiting
+// for a worker.
+func newWorkerPool(workers int, queue int) *workerPool {
+	p := &workerPool{jobs: make(chan func(), queue)}
+	for range workers {
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+
+	return p
+}
+
+type jobResult struct {
+	data []byte
+	err  error
+}
+
+// flight runs fn on a worker as the flight for key. If the queue is full, it waits for
+// room until ctx is done, or doesn't run fn at all if wait is false.
+func (p *workerPool) flight(ctx context.Context, key string, fn func() ([]byte, error), wait bool) <-chan singleflight.Result {
+	return p.group.DoChan(key, func() (any, error) {
+		done := make(chan jobResult, 1)
+		job := func() {
+			data, err := fn()
+			done <- jobResult{data, err}
+		}
+
+		if wait {
+			select {
+			case p.jobs <- job:
+			case <-ctx.Done():
+				return nil, errNotQueued
+			}
+		} else {
+			select {
+			case p.jobs <- job:
+			default:
+				return nil, errNotQueued
+			}
+		}
+
+		res := <-done
+		return res.data, res.err
+	})
+}
+
+// Do runs fn on a worker and waits for its result, or joins a run of fn with the same
+// key that's already going on. Once fn is queued it keeps running if ctx is done before
+// it finishes, since others might be waiting on it too.
+func (p *workerPool) Do(ctx context.Context, key string, fn func() ([]byte, error)) ([]byte, error) {
+	for {
+		select {
+		case res := <-p.flight(ctx, key, fn, true):
+			// We joined a job that never got queued (from Go, or from a request that gave up
+			// waiting for room), so try again.
+			if errors.Is(res.Err, errNotQueued) {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if res.Err != nil {
+				return nil, res.Err
+			}
+
+			return res.Val.([]byte), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Go runs fn on a worker in the background, unless the queue is full. Nothing happens if
+// fn with the same key is already running.
+func (p *workerPool) Go(key string, fn func() ([]byte, error)) {
+	p.flight(context.Background(), key, fn, false)
+}
+
+// derivative returns the contents of the derivative of an upload stored as name,
+// generating and storing it on a worker if it isn't stored yet.
+func (s *Server) derivative(ctx context.Context, fileId string, name string, generate func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	return s.derivatives.Do(ctx, name, func() ([]byte, error) {
+		return s.generateDerivative(fileId, name, generate)
+	})
+}
+
+// generateDerivative generates and stores a derivative, unless someone else stored it
+// since we last looked. It doesn't use the context of a request, since everyone waiting
+// on it should get it even if the request that started it is gone.
+func (s *Server) generateDerivative(fileId string, name string, generate func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	ctx := context.Background()
+
+	if f, err := s.store.Get(ctx, name); err == nil {
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+
+	data, err := generate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := s.store.Put(ctx, name, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	recorded, err := s.recordDerivative(ctx, fileId, name, n)
+	if err != nil {
+		_ = s.store.Delete(ctx, name)
+		return nil, err
+	}
+	if !recorded {
+		// The upload was deleted while we were generating it, so nothing would clean it up.
+		_ = s.store.Delete(ctx, name)
+	}
+
+	return data, nil
+}
+
+// generateThumbnailsEagerly queues thumbnails of every size for an upload that was just
+// stored, so they're ready by the time someone looks at them.
+func (s *Server) generateThumbnailsEagerly(up types.Upload) {
+	if !s.cfg.EagerThumbnails || up.BurnAfterRead || !CanDecode(up.MimeType) {
+		return
+	}
+
+	for _, size := range s.thumbnailSizes() {
+		name, _ := s.thumbnailNameAndType(up, size)
+		s.derivatives.Go(name, func() ([]byte, error) {
+			data, err := s.generateDerivative(up.Id, name, func(ctx context.Context) ([]byte, error) {
+				return s.generateThumbnail(ctx, up, size)
+			})
+			if err != nil {
+				log.Printf("Failed to generate thumbnail '%s' eagerly: %s", name, err.Error())
+			}
+
+			return data, err
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolCoalesces(t *testing.T) {
+	p := newWorkerPool(2, 4)
+	release := make(chan struct{})
+	var runs atomic.Int32
+
+	fn := func() ([]byte, error) {
+		runs.Add(1)
+		<-release
+		return []byte("done"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			data, err := p.Do(context.Background(), "key", fn)
+			if err != nil || string(data) != "done" {
+				t.Errorf("got %q %v, want \"done\"", data, err)
+			}
+		}()
+	}
+
+	// Give everyone time to join the first run before it finishes.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := runs.Load(); n != 1 {
+		t.Errorf("fn ran %d times, want once", n)
+	}
+}
+
+// busyPool returns a pool with one worker and no queue, whose worker is busy until the
+// returned function is called.
+func busyPool(t *testing.T) (*workerPool, func()) {
+	p := newWorkerPool(1, 0)
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	go p.Do(context.Background(), "busy", func() ([]byte, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	<-started
+
+	var once sync.Once
+	free := func() { once.Do(func() { close(release) }) }
+	t.Cleanup(free)
+
+	return p, free
+}
+
+func TestWorkerPoolStopsWaitingWithContext(t *testing.T) {
+	p, free := busyPool(t)
+	var runs atomic.Int32
+	fn := func() ([]byte, error) {
+		runs.Add(1)
+		return []byte("other"), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.Do(ctx, "other", fn); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline to be exceeded", err)
+	}
+
+	// The request that gave up mustn't leave its job behind, queued or waiting for room.
+	free()
+	time.Sleep(50 * time.Millisecond)
+	if n := runs.Load(); n != 0 {
+		t.Fatalf("fn ran %d times after its request gave up", n)
+	}
+
+	data, err := p.Do(context.Background(), "other", fn)
+	if err != nil || string(data) != "other" {
+		t.Errorf("got %q %v, want \"other\"", data, err)
+	}
+}
+
+func TestWorkerPoolGoDropsWhenFull(t *testing.T) {
+	p, free := busyPool(t)
+	var runs atomic.Int32
+
+	// This is what Go does, without throwing away the result.
+	res := <-p.flight(context.Background(), "dropped", func() ([]byte, error) {
+		runs.Add(1)
+		return nil, nil
+	}, false)
+	if !errors.Is(res.Err, errNotQueued) {
+		t.Errorf("got %v, want errNotQueued", res.Err)
+	}
+
+	free()
+	time.Sleep(50 * time.Millisecond)
+	if n := runs.Load(); n != 0 {
+		t.Errorf("fn ran %d times even though the queue was full", n)
+	}
+}
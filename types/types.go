@@ -1,5 +1,12 @@
 package types
 
+// The visibilities an upload can have.
+const (
+	VisibilityPublic   = "public"   // anyone with the link can see it
+	VisibilityUnlisted = "unlisted" // anyone with the link can see it, but it's kept out of search engines
+	VisibilityPrivate  = "private"  // only the owner can see it
+)
+
 // Upload represents an uploaded file in the database.
 type Upload struct {
 	Id          string `db:"id"`
@@ -9,4 +16,75 @@ type Upload struct {
 	UploadedAs  string `db:"uploaded_as"`
 	Extension   string `db:"ext"`
 	DeleteToken string `db:"delete_token"` // can't be omitted from json because it breaks templ scripts
+	Blob        string `db:"blob"`         // sha256 hash of the contents, empty for uploads from before deduplication
+	ExpiresAt   uint64 `db:"expires_at"`   // unix timestamp, or 0 if it never expires
+
+	BurnAfterRead bool   `db:"burn_after_read"`        // deleted after it's been viewed once
+	PasswordHash  string `db:"password_hash" json:"-"` // bcrypt hash, or empty if there's no password
+	Visibility    string `db:"visibility"`             // one of the Visibility constants
+}
+
+// TusUpload represents a resumable (tus) upload that may still be in progress.
+type TusUpload struct {
+	Id        string `db:"id"`
+	User      string `db:"user"`
+	Length    int64  `db:"length"`
+	Offset    int64  `db:"offset"`
+	Metadata  string `db:"metadata"` // the Upload-Metadata header, without the password
+	CreatedAt uint64 `db:"created_at"`
+	UpdatedAt uint64 `db:"updated_at"` // when a chunk last arrived, or when it finished
+	FileId    string `db:"file_id"`    // the id of the upload once it's finished, or empty
+
+	PasswordHash string `db:"password_hash" json:"-"` // bcrypt hash of the password from the metadata, or empty
+}
+
+// ThumbnailSize is one of the sizes thumbnails can be generated in.
+type ThumbnailSize struct {
+	Name   string
+	Width  int
+	Height int
+	Fit    string // contain or cover
+}
+
+// BubbleMask represents a bubble mask uploaded by a user in the database.
+type BubbleMask struct {
+	User      string `db:"user"`
+	Name      string `db:"name"`
+	Blob      string `db:"blob"` // sha256 hash of the mask image
+	CreatedAt uint64 `db:"created_at"`
+}
+
+// User represents a user in the database. Uploads and keys refer to users by name.
+type User struct {
+	Name      string `db:"name"`
+	CreatedAt uint64 `db:"created_at"`
+}
+
+// APIKey represents an API key of a user in the database. Only a hash of the key
+// itself is stored.
+type APIKey struct {
+	Id         string `db:"id"`
+	User       string `db:"user"`
+	Hash       string `db:"hash" json:"-"` // sha256 hash of the key
+	Prefix     string `db:"prefix"`        // the first few characters of the key, to recognize it by
+	Label      string `db:"label"`
+	CreatedAt  uint64 `db:"created_at"`
+	LastUsedAt uint64 `db:"last_used_at"` // unix timestamp, or 0 if it's never been used
+	Scopes     string `db:"scopes"`       // space separated scopes, like "upload read-own"
+	ExpiresAt  uint64 `db:"expires_at"`   // unix timestamp, or 0 if it never expires
+}
+
+// Session represents someone logged into the dashboard in the database. Only a hash of
+// the session token in their cookie is stored.
+type Session struct {
+	Id         string `db:"id"`
+	Hash       string `db:"hash" json:"-"` // sha256 hash of the session token
+	User       string `db:"user"`
+	KeyId      string `db:"key_id"` // the API key they logged in with, if they did
+	Scopes     string `db:"scopes"` // space separated, the same as the scopes of the key
+	CreatedAt  uint64 `db:"created_at"`
+	LastSeenAt uint64 `db:"last_seen_at"`
+	UserAgent  string `db:"user_agent"`
+	IP         string `db:"ip"`
+	ExpiresAt  uint64 `db:"expires_at"` // unix timestamp the key it was made with expires at, or 0
 }